@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Suffixes of the model objects which are a single compressed tar archive of the model directory
+var modelArchiveSuffixes = []string{".tar.gz", ".tgz"}
+
+//Return true if the model path is a compressed tar archive, instead of a directory
+func isModelArchive(path string) bool {
+	for _, suffix := range modelArchiveSuffixes {
+		if strings.HasSuffix(strings.ToLower(path), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//Download the model in the local directory: the objects of the model directory, or the extracted model archive
+func downloadModel(ctx context.Context, store ObjectStore, path string, localDest string) error {
+	if isModelArchive(path) {
+		return downloadModelArchive(ctx, store, path, localDest)
+	}
+	return downloadFiles(ctx, store, path, localDest)
+}
+
+//Download the model archive and extract it in the local directory while it's read. A single top level directory,
+//which isn't a numeric version, is the model directory of the archive and is stripped. The archive content is
+//verified against its checksums. The objects decompressed by the storage on download have none
+func downloadModelArchive(ctx context.Context, store ObjectStore, path string, localDest string) error {
+	list, err := listFiles(ctx, store, path)
+	if err != nil {
+		return err
+	}
+	if len(list) != 1 || list[0].RelativePath+list[0].FileName != path[strings.LastIndex(path, "/")+1:] {
+		return &notFoundError{message: fmt.Sprintf("model archive %s not found", store.Location(path))}
+	}
+	start := time.Now()
+	defer func() { modelDownloadSeconds.Observe(time.Since(start).Seconds()) }()
+	spanFromContext(ctx).set("objects", 1)
+	spanFromContext(ctx).set("bytes", list[0].Size)
+	progress, stopProgress := startDownloadProgress(ctx, store.Location(path), 1, list[0].Size)
+	defer stopProgress()
+
+	src, err := store.Download(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	verifier := newChecksumVerifier(list[0].Checksums)
+	reader := bufio.NewReader(io.TeeReader(src, io.MultiWriter(verifier, progress)))
+	var archive io.Reader = reader
+	if isGzip(reader) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		archive = gz
+	}
+	if err = extractTar(archive, localDest); err != nil {
+		return errors.New(fmt.Sprintf("extraction of the model archive %s: %s", store.Location(path), err))
+	}
+	// The end of the stream, after the tar trailer, is also verified
+	if _, err = io.Copy(ioutil.Discard, reader); err != nil {
+		return err
+	}
+	if err = verifier.verify(); err != nil {
+		return errors.New(fmt.Sprintf("download of %s corrupted: %s", store.Location(path), err))
+	}
+	return stripArchiveDir(localDest)
+}
+
+//Extract the directories and the regular files of the tar archive in the local directory. The links and the entries
+//outside of the directory are rejected
+func extractTar(archive io.Reader, localDest string) error {
+	if err := os.MkdirAll(localDest, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(header.Name)), "./")
+		if name == "." || header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		localFile := filepath.Join(localDest, name)
+		if strings.HasPrefix(header.Name, "/") || hasParentSegment(name) || !isWithinDir(localDest, localFile) {
+			return errors.New(fmt.Sprintf("entry %s rejected, outside of the model directory", header.Name))
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(localFile, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+				return err
+			}
+			destination, err := os.Create(localFile)
+			if err != nil {
+				return err
+			}
+			if _, err = io.Copy(destination, tr); err != nil {
+				destination.Close()
+				return err
+			}
+			if err = destination.Close(); err != nil {
+				return err
+			}
+		default:
+			return errors.New(fmt.Sprintf("entry %s rejected, only the directories and the regular files are supported", header.Name))
+		}
+	}
+}
+
+//Move the content of the single top level directory of the extracted archive in the local directory, when this
+//directory isn't a numeric version of the versioned layout
+func stripArchiveDir(localDest string) error {
+	entries, err := ioutil.ReadDir(localDest)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return nil
+	}
+	if _, err = strconv.ParseInt(entries[0].Name(), 10, 64); err == nil {
+		return nil
+	}
+	// Moved aside first, a child can have the name of the directory
+	tmp, err := ioutil.TempDir(localDest, ".archive-")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(tmp, entries[0].Name())
+	if err = os.Rename(filepath.Join(localDest, entries[0].Name()), dir); err != nil {
+		return err
+	}
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err = os.Rename(filepath.Join(dir, c.Name()), filepath.Join(localDest, c.Name())); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(tmp)
+}
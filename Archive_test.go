@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Tar archive of the entries, the regular files have their name as content
+func tarBytes(t *testing.T, entries ...tar.Header) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, header := range entries {
+		h := header
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write([]byte(h.Name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tar.Header
+		files   []string
+		err     string
+	}{
+		{name: "model", entries: []tar.Header{
+			{Name: "./m/", Typeflag: tar.TypeDir},
+			{Name: "m/saved_model.pb", Typeflag: tar.TypeReg},
+			{Name: "m/variables/variables.index", Typeflag: tar.TypeReg},
+		}, files: []string{"m/saved_model.pb", "m/variables/variables.index"}},
+		{name: "parent", entries: []tar.Header{{Name: "../evil", Typeflag: tar.TypeReg}}, err: "outside of the model directory"},
+		{name: "nested parent", entries: []tar.Header{{Name: "m/../../evil", Typeflag: tar.TypeReg}}, err: "outside of the model directory"},
+		{name: "absolute", entries: []tar.Header{{Name: "/tmp/evil", Typeflag: tar.TypeReg}}, err: "outside of the model directory"},
+		{name: "symlink", entries: []tar.Header{{Name: "m/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}, err: "only the directories and the regular files"},
+		{name: "hard link", entries: []tar.Header{{Name: "m/link", Typeflag: tar.TypeLink, Linkname: "../evil"}}, err: "only the directories and the regular files"},
+	}
+	for _, test := range tests {
+		scratch, err := ioutil.TempDir("", "embedded-tf-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(scratch, "dest")
+		err = extractTar(bytes.NewReader(tarBytes(t, test.entries...)), dest)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, %q expected", test.name, err, test.err)
+			}
+			// Nothing is written outside of the destination
+			if entries, _ := ioutil.ReadDir(scratch); len(entries) != 1 {
+				t.Errorf("%s: %d entries written next to the destination", test.name, len(entries)-1)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		for _, name := range test.files {
+			if content, err := ioutil.ReadFile(filepath.Join(dest, name)); err != nil || string(content) != name {
+				t.Errorf("%s: file %s %q, %v", test.name, name, content, err)
+			}
+		}
+		os.RemoveAll(scratch)
+	}
+}
+
+//The archive which isn't gzip compressed is also verified against its checksums
+func TestDownloadModelArchiveChecksums(t *testing.T) {
+	archive := tarBytes(t, tar.Header{Name: "saved_model.pb", Typeflag: tar.TypeReg})
+	sum := md5.Sum(archive)
+	for _, test := range []struct {
+		name string
+		md5  []byte
+		err  bool
+	}{
+		{name: "valid", md5: sum[:]},
+		{name: "corrupted", md5: make([]byte, md5.Size), err: true},
+		{name: "no checksums"},
+	} {
+		store := newMemStore(SCHEME_GCS, "models")
+		store.put("m/model.tgz", archive, "application/x-tar")
+		store.get("m/model.tgz").checksums = objectChecksums{MD5: test.md5}
+		scratch, err := ioutil.TempDir("", "embedded-tf-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = downloadModelArchive(context.Background(), store, "m/model.tgz", scratch)
+		if test.err {
+			if err == nil || !strings.Contains(err.Error(), "corrupted") {
+				t.Errorf("%s: error %v, corrupted download expected", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if _, err = os.Stat(filepath.Join(scratch, "saved_model.pb")); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		os.RemoveAll(scratch)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//Header of the API key, for the services whose Authorization header is already used, like by the Cloud Run IAM
+const API_KEY_HEADER = "X-Api-Key"
+
+//Key required on the requests, except the liveness checks. Empty by default, the requests aren't authenticated
+var apiKey = getEnvString("API_KEY", "")
+
+//Wrap the handler for rejecting with a 401 the requests without the API key, in a "Authorization: Bearer <key>" or a
+//X-Api-Key header. Nothing is checked without API_KEY
+func authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKey == "" || r.URL.Path == "/health" || validAPIKey(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logWarningf(r.Context(), "request on %s rejected, missing or invalid API key", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "missing or invalid API key")
+	})
+}
+
+//The keys are compared in constant time
+func validAPIKey(r *http.Request) bool {
+	keys := []string{r.Header.Get(API_KEY_HEADER)}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		keys = append(keys, strings.TrimPrefix(auth, "Bearer "))
+	}
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const (
+	//Exit code of a failed batch run
+	BATCH_EXIT_FAILURE = 1
+	//Exit code of a batch run rejected with a 4xx, like an invalid param or a missing model. A new attempt would fail
+	//the same
+	BATCH_EXIT_INVALID = 2
+)
+
+//Params of the batch mode, from the flags, else from the environment variables
+var (
+	batchFlag     = flag.Bool("batch", false, "run one prediction and exit, without HTTP server. Also set by the INPUT environment variable")
+	batchInputEnv = getEnvString("INPUT", "")
+	batchModel    = flag.String("model", getEnvString("MODEL", ""), "location of the model, MODEL by default")
+	batchInput    = flag.String("input", batchInputEnv, "location of the input files, INPUT by default")
+	batchOutput   = flag.String("output", getEnvString("OUTPUT", ""), "locations of the outputs, OUTPUT by default")
+	batchParams   = flag.String("params", getEnvString("PARAMS", ""), "other params of the prediction, as a query string like continue_on_error=true&write_manifest=true, PARAMS by default")
+)
+
+//Return true if a single prediction is run instead of the HTTP server: with the --batch flag, or when the INPUT
+//environment variable is set, like in the Cloud Run and the Kubernetes jobs
+func isBatchMode() bool {
+	return *batchFlag || batchInputEnv != ""
+}
+
+//Run one prediction with the params of the flags, like a GET / request, and return the exit code of the process. The
+//Tensorflow servers are stopped before returning. SIGINT and SIGTERM cancel the run
+func runBatch() int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	query, err := url.ParseQuery(*batchParams)
+	if err != nil {
+		logErrorf(ctx, "invalid batch params '%s': %s", *batchParams, err)
+		return BATCH_EXIT_INVALID
+	}
+	for name, value := range map[string]string{"model": *batchModel, "input": *batchInput, "output": *batchOutput} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			logInfof(ctx, "%s received, batch run cancelled", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/?"+query.Encode(), nil)
+	if err != nil {
+		logError(ctx, err)
+		return BATCH_EXIT_INVALID
+	}
+	// The log entries of the run have the fields of a request
+	fields := logFields{RequestID: getRequestID(r), Model: query.Get("model"), Input: query.Get("input")}
+	r = r.WithContext(context.WithValue(ctx, logFieldsKey{}, fields))
+
+	logInfof(r.Context(), "batch prediction of %s", query.Get("input"))
+	response := &jobResponse{header: http.Header{}}
+	LoadAndPredict(response, r)
+	stopServers(r.Context())
+
+	body := strings.TrimSpace(response.body.String())
+	switch {
+	case response.status == 0 || response.status == http.StatusOK:
+		logInfof(r.Context(), "batch prediction completed: %s", body)
+		return 0
+	case response.status >= 400 && response.status < 500 && response.status != STATUS_REQUEST_CANCELLED:
+		logErrorf(r.Context(), "batch prediction rejected with status %d: %s", response.status, body)
+		return BATCH_EXIT_INVALID
+	}
+	logErrorf(r.Context(), "batch prediction failed with status %d: %s", response.status, body)
+	return BATCH_EXIT_FAILURE
+}
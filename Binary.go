@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+//Field of the Tensorflow Serving JSON encoding of the binary values, like the images
+const B64_KEY = "b64"
+
+//Suffixes of the input files still read as JSON, or CSV, in binary mode, compressed or not
+var textInputSuffixes = []string{".json", ".jsonl", ".ndjson", CSV_SUFFIX}
+
+//Return true if the input file is read as a single binary instance: in binary mode, the files which aren't named
+//like a JSON or a CSV file
+func isBinaryInput(input filePath, opts *predictionOptions) bool {
+	if !opts.Binary {
+		return false
+	}
+	name := strings.TrimSuffix(strings.ToLower(input.FileName), GZIP_SUFFIX)
+	for _, suffix := range textInputSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+//Read the full content of the input as one {"b64": "..."} instance, handled like a batch of readBatches. The
+//instance is subject to the sampling
+func readBinaryInstance(input io.Reader, sampler *instanceSampler, handle func(positions []int, batch []interface{}) error) (int, error) {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return 0, err
+	}
+	if !sampler.keep() {
+		return 0, nil
+	}
+	instance := map[string]interface{}{B64_KEY: base64.StdEncoding.EncodeToString(content)}
+	if err = handle([]int{0}, []interface{}{instance}); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
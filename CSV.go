@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	//Input files in JSON line or JSON array format
+	INPUT_FORMAT_JSON = "json"
+	//Input files in CSV format, with a header row
+	INPUT_FORMAT_CSV = "csv"
+	//The suffix of the CSV input files, compressed or not
+	CSV_SUFFIX = ".csv"
+)
+
+//CSV values converted to JSON numbers. The leading zeros, like in the codes, keep the value as a string
+var csvNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+//Extract the optional csv_delim param, the field delimiter of the CSV input files. It must be a single char, other
+//than the quote and the line breaks. A comma by default
+func getCSVDelimParam(r *http.Request) (rune, error) {
+	value := getStringParam(r, "csv_delim", ",")
+	delim, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || delim == utf8.RuneError || delim == 0 || delim == '"' || delim == '\r' || delim == '\n' {
+		return 0, errors.New(`'csv_delim' must be a single char, other than '"', '\r' and '\n'`)
+	}
+	return delim, nil
+}
+
+//Return true if the input file is read as CSV: with the csv input_format, or a .csv or .csv.gz name
+func isCSVInput(input filePath, opts *predictionOptions) bool {
+	if opts.InputFormat != "" {
+		return opts.InputFormat == INPUT_FORMAT_CSV
+	}
+	name := strings.TrimSuffix(strings.ToLower(input.FileName), GZIP_SUFFIX)
+	return strings.HasSuffix(name, CSV_SUFFIX)
+}
+
+//Reader of a CSV input converted to JSON lines, one JSON object per data row keyed by the header fields. The rows are
+//converted while they are read
+type csvJSONReader struct {
+	csv        *csv.Reader
+	header     []string
+	allStrings bool
+	line       bytes.Buffer
+	err        error
+}
+
+func newCSVJSONReader(input io.Reader, allStrings bool, delim rune) *csvJSONReader {
+	r := csv.NewReader(input)
+	r.Comma = delim
+	r.ReuseRecord = true
+	return &csvJSONReader{csv: r, allStrings: allStrings}
+}
+
+func (r *csvJSONReader) Read(p []byte) (int, error) {
+	for r.line.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.nextLine()
+	}
+	return r.line.Read(p)
+}
+
+//Convert the next data row to a JSON line. The header is read first
+func (r *csvJSONReader) nextLine() error {
+	if r.header == nil {
+		header, err := r.csv.Read()
+		if err != nil {
+			// An empty input has no instance
+			return err
+		}
+		names := map[string]bool{}
+		for i, name := range header {
+			if i == 0 {
+				// Byte order mark of the files exported by some spreadsheets
+				name = strings.TrimPrefix(name, "\ufeff")
+			}
+			name = strings.TrimSpace(name)
+			if name == "" || names[name] {
+				return errors.New(fmt.Sprintf("csv header field %d must be a unique non empty name", i))
+			}
+			names[name] = true
+			r.header = append(r.header, name)
+		}
+	}
+
+	record, err := r.csv.Read()
+	if err != nil {
+		return err
+	}
+	o := make(map[string]interface{}, len(record))
+	for i, value := range record {
+		if !r.allStrings && csvNumber.MatchString(value) {
+			o[r.header[i]] = json.Number(value)
+		} else {
+			o[r.header[i]] = value
+		}
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	r.line.Write(b)
+	r.line.WriteByte('\n')
+	return nil
+}
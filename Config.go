@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Range of the valid values of an integer environment variable. No max if 0
+type envIntRange struct {
+	min int
+	max int
+}
+
+//Range of the integer environment variables which can't be 0, like the attempts and the timeouts, or are bounded.
+//The other integers must be positive or 0
+var envIntRanges = map[string]envIntRange{
+	"TF_REST_PORT":                  {min: 1, max: 65535},
+	"TF_GRPC_PORT":                  {min: 1, max: 65535},
+	"TF_STARTUP_TIMEOUT":            {min: 1},
+	"TF_READY_RETRIES":              {min: 1},
+	"TF_REQUEST_TIMEOUT":            {min: 1},
+	"TF_POST_ATTEMPTS":              {min: 1},
+	"TF_LOG_TAIL_BYTES":             {min: 1},
+	"STORAGE_ATTEMPTS":              {min: 1},
+	"UPLOAD_ATTEMPTS":               {min: 1},
+	"DOWNLOAD_CONCURRENCY":          {min: 1},
+	"UPLOAD_CONCURRENCY":            {min: 1},
+	"PREDICT_CONCURRENCY":           {min: 1},
+	"JOB_CONCURRENCY":               {min: 1},
+	"MAX_LINE_BYTES":                {min: 1},
+	"ESTIMATE_DOWNLOAD_MBPS":        {min: 1},
+	"ESTIMATE_INSTANCES_PER_SECOND": {min: 1},
+	"ESTIMATE_PREDICTION_MBPS":      {min: 1},
+	"PORT":                          {min: 1, max: 65535},
+}
+
+//Environment variables which contain secrets, like the credentials. Their values are redacted in the logs and in the
+//errors
+var envSecrets = map[string]bool{
+	"API_KEY":                    true,
+	"OTEL_EXPORTER_OTLP_HEADERS": true,
+}
+
+//Value of the redacted secrets
+const REDACTED = "<redacted>"
+
+//Configuration of the server, read from the environment variables at the package initialization. All the variables
+//are read with the getEnv functions, which record them here: the invalid values are kept for failing the startup
+//before serving, instead of falling back on the defaults in the middle of the requests, and the effective values are
+//logged at the startup
+type Config struct {
+	sync.Mutex
+	//Effective value of each variable read, the default included
+	values map[string]string
+	errors []string
+}
+
+//Configuration of the server
+var config = &Config{values: map[string]string{}}
+
+//Record the effective value of the environment variable, and the error of an invalid value
+func (c *Config) record(name string, value string, err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[name] = redact(name, value)
+	if err != nil {
+		c.errors = append(c.errors, fmt.Sprintf("%s=%s: %s", name, redact(name, os.Getenv(name)), err))
+	}
+}
+
+//Return an error listing all the invalid environment variables, nil if all of them are valid
+func (c *Config) check() error {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.errors) == 0 {
+		return nil
+	}
+	sort.Strings(c.errors)
+	return errors.New(fmt.Sprintf("invalid configuration, %d environment variable(s) to fix: %s", len(c.errors), strings.Join(c.errors, "; ")))
+}
+
+//Effective configuration, as NAME=value pairs sorted by name, for the startup logs. The secrets are redacted
+func (c *Config) effective() string {
+	c.Lock()
+	defer c.Unlock()
+	var pairs []string
+	for name, value := range c.values {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+//Redact the value of a secret environment variable. The empty value is kept, for showing that the secret isn't set
+func redact(name string, value string) string {
+	if envSecrets[name] && value != "" {
+		return REDACTED
+	}
+	return value
+}
+
+//Record the environment variable in the configuration
+func recordEnv(name string, value string, err error) {
+	config.record(name, value, err)
+}
+
+//Get an integer from an environment variable. The default value is used when the variable is missing. An invalid
+//value, or a value out of its range, fails the startup
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		recordEnv(name, strconv.Itoa(defaultValue), nil)
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		recordEnv(name, strconv.Itoa(defaultValue), errors.New("not an integer"))
+		return defaultValue
+	}
+	r := envIntRanges[name]
+	if i < r.min {
+		recordEnv(name, value, errors.New(fmt.Sprintf("must be at least %d", r.min)))
+	} else if r.max > 0 && i > r.max {
+		recordEnv(name, value, errors.New(fmt.Sprintf("must be at most %d", r.max)))
+	} else {
+		recordEnv(name, value, nil)
+	}
+	return i
+}
+
+//Get a string from an environment variable. The default value is used when the variable is missing
+func getEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = defaultValue
+	}
+	recordEnv(name, value, nil)
+	return value
+}
+
+//Get a string from an environment variable which must be one of the options. The default value is used when the
+//variable is missing. Another value fails the startup
+func getEnvEnum(name string, defaultValue string, options ...string) string {
+	value := getEnvString(name, defaultValue)
+	for _, o := range options {
+		if value == o {
+			return value
+		}
+	}
+	recordEnv(name, value, errors.New(fmt.Sprintf("must be '%s'", strings.Join(options, "', '"))))
+	return value
+}
+
+//Get a comma separated list of key=value pairs from an environment variable, nil if missing. A bad formatted list
+//fails the startup
+func getEnvKeyValues(name string) map[string]string {
+	value := getEnvString(name, "")
+	ret, err := parseKeyValues(name, value)
+	if err != nil {
+		recordEnv(name, value, errors.New("must be a comma separated list of key=value pairs"))
+	}
+	return ret
+}
+
+//Get a boolean from an environment variable. The default value is used when the variable is missing. An invalid
+//value fails the startup
+func getEnvBool(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		recordEnv(name, strconv.FormatBool(defaultValue), nil)
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		recordEnv(name, strconv.FormatBool(defaultValue), errors.New("not a boolean, must be 'true' or 'false'"))
+		return defaultValue
+	}
+	recordEnv(name, strconv.FormatBool(b), nil)
+	return b
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//Prefix of the object written and deleted in each output destination for checking the write permission
+const DRY_RUN_PROBE_PREFIX = ".embedded-tf-dry-run-"
+
+//JSON response of a dry run
+type dryRunReport struct {
+	Model struct {
+		Location string `json:"location"`
+		//0 for the served, the local and the remote models, which aren't listed
+		Objects int `json:"objects"`
+	} `json:"model"`
+	Input struct {
+		Location string `json:"location"`
+		Files    int    `json:"files"`
+	} `json:"input"`
+	//Destinations where the write permission is checked
+	Outputs []string `json:"outputs"`
+}
+
+//Check the params of a run without running it: the model and the input objects exist and the output destinations are
+//writable. Nothing is downloaded, the Tensorflow server isn't started and the model lock isn't taken. A missing model
+//or input answers a 404, an output not writable a 403 and an existing output a 409 with overwrite=false
+func dryRun(ctx context.Context, w http.ResponseWriter, model *storeLocation, input storeLocation, outputLocations []storeLocation,
+	inputManifest *storeLocation, opts *predictionOptions) {
+	report := dryRunReport{}
+	clients := newStoreProvider()
+	modelStore, modelPath, err := getModelStore(ctx, clients, model)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+	inputStore, err := clients.Store(ctx, input, inputProject)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+
+	switch {
+	case modelStore != nil:
+		report.Model.Location = modelStore.Location(modelPath)
+		models, err := listFiles(ctx, modelStore, modelPath)
+		if err == nil && len(models) == 0 {
+			err = &notFoundError{message: fmt.Sprintf("no object in %s", report.Model.Location)}
+		}
+		if err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			if _, ok := err.(*notFoundError); ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintln(w, "model not found: "+err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when listing model files")
+			return
+		}
+		report.Model.Objects = len(models)
+	case len(servedModels) > 0:
+		report.Model.Location = servedModels[opts.ModelName]
+	case tfRemoteURL != "":
+		report.Model.Location = predictor.StatusURL()
+	default:
+		report.Model.Location = SCHEME_FILE + "://" + modelBasePath
+	}
+
+	var inputs []filePath
+	report.Input.Location = inputStore.Location(input.Path)
+	if inputManifest != nil {
+		manifestStore, err := clients.Store(ctx, *inputManifest, inputProject)
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when creating storage client")
+			return
+		}
+		report.Input.Location = manifestStore.Location(inputManifest.Path)
+		inputs, err = readInputManifest(ctx, manifestStore, inputManifest.Path)
+		if err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "error when reading the input manifest: "+err.Error())
+			return
+		}
+	} else {
+		inputs, err = listFiles(ctx, inputStore, input.Path)
+		if err == nil {
+			inputs = filterSubdirs(ctx, inputs, opts.IncludeSubdirs, opts.ExcludeSubdirs)
+			inputs = filterFileNames(ctx, inputs, opts.InputFilter)
+			if len(inputs) == 0 {
+				err = &notFoundError{message: fmt.Sprintf("no input file in %s", report.Input.Location)}
+			}
+		}
+		if err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			if _, ok := err.(*notFoundError); ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintln(w, "input not found: "+err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when listing input files")
+			return
+		}
+	}
+	report.Input.Files = len(inputs)
+
+	var destinations []*outputDestination
+	for _, l := range outputLocations {
+		store, err := clients.Store(ctx, l, outputProject)
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when creating storage client")
+			return
+		}
+		d := &outputDestination{store: store, path: l.Path}
+		if err = checkWritable(ctx, d); err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "output not writable: "+err.Error())
+			return
+		}
+		report.Outputs = append(report.Outputs, d.location(""))
+		destinations = append(destinations, d)
+	}
+
+	if !opts.Overwrite {
+		if opts.SkipExisting {
+			inputs, _, err = skipExistingOutputs(ctx, inputs, destinations, opts)
+		}
+		if err == nil {
+			err = checkExistingOutputs(ctx, inputs, destinations, opts)
+		}
+		if err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			if _, ok := err.(*conflictError); ok {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintln(w, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when listing output files")
+			return
+		}
+	}
+
+	logInfof(ctx, "dry run succeeded, %d input file(s) to predict", report.Input.Files)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+//Write a small object in the destination and delete it
+func checkWritable(ctx context.Context, d *outputDestination) error {
+	b := make([]byte, 8)
+	rand.Read(b)
+	name := DRY_RUN_PROBE_PREFIX + hex.EncodeToString(b)
+	writer := d.store.Upload(ctx, d.path+name, "text/plain", "", nil)
+	if _, err := writer.Write([]byte("dry run\n")); err != nil {
+		writer.Close()
+		return errors.New(fmt.Sprintf("%s: %s", d.location(name), err))
+	}
+	if err := writer.Close(); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", d.location(name), err))
+	}
+	return d.store.Delete(ctx, d.path+name)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v4"
+	"io"
+)
+
+const (
+	//JSON line output, one JSON prediction per line. The default format
+	OUTPUT_FORMAT_JSONL = "jsonl"
+	//MessagePack output, a binary stream of one MessagePack value per prediction
+	OUTPUT_FORMAT_MSGPACK = "msgpack"
+	//JSON line output loadable in BigQuery, with the nested objects flattened into top level fields
+	OUTPUT_FORMAT_BQ_NDJSON = "bq_ndjson"
+	//JSON line output of the serving responses, one full response per prediction request, with their envelope
+	OUTPUT_FORMAT_RAW = "raw"
+	//BigQuery field of the predictions which aren't JSON objects
+	BQ_PREDICTION_FIELD = "prediction"
+	//Content type of the MessagePack output objects, also accepted in the Accept header of the request
+	MSGPACK_CONTENT_TYPE = "application/msgpack"
+)
+
+//Encoder of the predictions in the output objects
+type predictionEncoder interface {
+	//Content type of the output objects and of the returned predictions
+	ContentType() string
+	//Write the predictions, in the input instances order
+	Encode(w io.Writer, predictions []interface{}) error
+}
+
+//Get the encoder of the output format. JSON line by default. The raw format isn't encoded from the predictions, the
+//serving responses are written with writeRawResponses
+func getEncoder(format string) predictionEncoder {
+	switch format {
+	case OUTPUT_FORMAT_MSGPACK:
+		return &msgpackEncoder{}
+	case OUTPUT_FORMAT_BQ_NDJSON:
+		return &bqEncoder{}
+	}
+	return &jsonlEncoder{}
+}
+
+type jsonlEncoder struct{}
+
+func (e *jsonlEncoder) ContentType() string {
+	return NDJSON_CONTENT_TYPE
+}
+
+func (e *jsonlEncoder) Encode(w io.Writer, predictions []interface{}) error {
+	for _, p := range predictions {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//The values are written one after the other, without separator. The stream isn't line delimited
+type msgpackEncoder struct{}
+
+func (e *msgpackEncoder) ContentType() string {
+	return MSGPACK_CONTENT_TYPE
+}
+
+func (e *msgpackEncoder) Encode(w io.Writer, predictions []interface{}) error {
+	encoder := msgpack.NewEncoder(w)
+	for _, p := range predictions {
+		if err := encoder.Encode(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Each prediction is a flat JSON object: the nested object fields are joined with "_", the arrays are JSON encoded
+//as strings and the predictions which aren't objects are set in the "prediction" field
+type bqEncoder struct{}
+
+func (e *bqEncoder) ContentType() string {
+	return NDJSON_CONTENT_TYPE
+}
+
+func (e *bqEncoder) Encode(w io.Writer, predictions []interface{}) error {
+	flat := make([]interface{}, len(predictions))
+	for i, p := range predictions {
+		row := map[string]interface{}{}
+		if o, ok := p.(map[string]interface{}); ok {
+			if err := flattenObject(row, "", o); err != nil {
+				return err
+			}
+		} else if err := setBqField(row, BQ_PREDICTION_FIELD, p); err != nil {
+			return err
+		}
+		flat[i] = row
+	}
+	return (&jsonlEncoder{}).Encode(w, flat)
+}
+
+//Set the fields of the object in the row, prefixed by the names of the parent objects
+func flattenObject(row map[string]interface{}, prefix string, o map[string]interface{}) error {
+	for k, v := range o {
+		name := prefix + bqFieldName(k)
+		if child, ok := v.(map[string]interface{}); ok {
+			if err := flattenObject(row, name+"_", child); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := setBqField(row, name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Set the value in the row, the arrays are JSON encoded. 2 fields flattened to the same name are rejected
+func setBqField(row map[string]interface{}, name string, value interface{}) error {
+	if _, ok := row[name]; ok {
+		return errors.New(fmt.Sprintf("several prediction fields are flattened to the BigQuery field '%s'", name))
+	}
+	if a, ok := value.([]interface{}); ok {
+		b, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		value = string(b)
+	}
+	row[name] = value
+	return nil
+}
+
+//Replace the characters not allowed in a BigQuery column name by "_". A name can't start by a digit
+func bqFieldName(key string) string {
+	b := []byte(key)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
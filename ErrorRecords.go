@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+//Prefix of the error records object of an output, written next to it with error_records
+const ERROR_RECORDS_PREFIX = "errors_"
+
+//Instance of a batch rejected by the serving backend, written in the error records of the output with error_records.
+//Its prediction isn't in the output
+type rejectedInstance struct {
+	Input string `json:"input"`
+	//Index of the instance in the input file
+	Index    int         `json:"index"`
+	Instance interface{} `json:"instance"`
+	Error    string      `json:"error"`
+}
+
+//Return true if the serving backend answered the batch with a 4xx status: the instances are bad, not the server
+func isRejectedBatch(err error) bool {
+	e, ok := err.(*servingStatusError)
+	return ok && e.status >= 400 && e.status < 500
+}
+
+//Predict the instances of a rejected batch one by one, for isolating the rejected instances. The predictions of the
+//accepted instances are returned in the instances order, and the rejected ones are passed to onRejected with their
+//position in the input. Another error stops the predictions
+func isolateRejected(ctx context.Context, p Predictor, instances []interface{}, positions []int, opts *predictionOptions, trace *[]manifestRequest, onRejected func(index int, instance interface{}, err *servingStatusError)) ([]interface{}, error) {
+	var predictions []interface{}
+	for i := range instances {
+		prediction, err := predictBatch(ctx, p, instances[i:i+1], positions[i:i+1], opts, trace)
+		if err != nil {
+			if !isRejectedBatch(err) {
+				return nil, err
+			}
+			onRejected(positions[i], instances[i], err.(*servingStatusError))
+			continue
+		}
+		predictions = append(predictions, prediction...)
+	}
+	return predictions, nil
+}
+
+//Name of the error records object of the output, errors_<name>.jsonl in the same directory. The compression and the
+//extension of the output are removed
+func errorRecordsName(output string) string {
+	dir, base := path.Split(strings.TrimSuffix(output, GZIP_SUFFIX))
+	return dir + ERROR_RECORDS_PREFIX + strings.TrimSuffix(base, path.Ext(base)) + ".jsonl"
+}
+
+//Write the rejected instances of the predicted files in the error records of their output, one JSON line per
+//instance. Nothing is written for the outputs without rejected instance. The number of rejected instances is returned
+func writeErrorRecords(ctx context.Context, store ObjectStore, outputPath string, files []manifestFile, opts *predictionOptions) (int, error) {
+	// The files of an output are contiguous
+	count := 0
+	for start := 0; start < len(files); {
+		end := start
+		var rejected []rejectedInstance
+		for ; end < len(files) && files[end].Output == files[start].Output; end++ {
+			rejected = append(rejected, files[end].rejected...)
+		}
+		if len(rejected) > 0 {
+			w := store.Upload(ctx, outputPath+errorRecordsName(files[start].Output), NDJSON_CONTENT_TYPE, "", objectMetadata(opts))
+			encoder := json.NewEncoder(w)
+			for _, r := range rejected {
+				if err := encoder.Encode(r); err != nil {
+					w.Close()
+					return count, err
+				}
+			}
+			if err := w.Close(); err != nil {
+				return count, err
+			}
+			count += len(rejected)
+		}
+		start = end
+	}
+	return count, nil
+}
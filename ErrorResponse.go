@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	//The error responses of the prediction runs are the plain text messages
+	ERROR_FORMAT_TEXT = "text"
+	//The error responses of the prediction runs are JSON objects with a machine-readable code. The default
+	ERROR_FORMAT_JSON = "json"
+)
+
+//Format of the error responses of the prediction runs, json or text. With text, the JSON format is still used when
+//the Accept header of the request lists application/json
+var errorFormat = getEnvEnum("ERROR_FORMAT", ERROR_FORMAT_JSON, ERROR_FORMAT_JSON, ERROR_FORMAT_TEXT)
+
+//JSON error response of a prediction run
+type errorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Detail  string `json:"detail,omitempty"`
+	} `json:"error"`
+}
+
+//Response writer which converts the plain text error responses of a run in JSON error responses. The body of an
+//error status is kept until the end of the run, and the code follows the status and the phase of the run at the
+//error. The successful and the JSON responses are written as is
+type errorResponseWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	status int
+	body   *bytes.Buffer
+}
+
+//Wrap the response writer of the run if the JSON error responses are requested. The returned flush writes the
+//converted error, at the end of the run
+func newErrorResponseWriter(ctx context.Context, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if q, listed := acceptQuality(r.Header.Get("Accept"), TF_CONTENT_TYPE); errorFormat != ERROR_FORMAT_JSON && !(listed && q > 0) {
+		return w, func() {}
+	}
+	ew := &errorResponseWriter{ResponseWriter: w, ctx: ctx}
+	return ew, ew.flush
+}
+
+func (w *errorResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= http.StatusBadRequest && !strings.HasPrefix(w.Header().Get("Content-Type"), TF_CONTENT_TYPE) {
+		// The status is written with the converted body
+		w.body = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body != nil {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+//Flush the data already written to the client, for the streamed responses
+func (w *errorResponseWriter) Flush() {
+	if w.body != nil {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Write the kept error as JSON: the first line of the text is the message, the next ones, like the partial outputs,
+//are the detail
+func (w *errorResponseWriter) flush() {
+	if w.body == nil {
+		return
+	}
+	resp := errorResponse{}
+	resp.Error.Code = errorCode(w.status, getPhase(w.ctx))
+	lines := strings.SplitN(strings.TrimSpace(w.body.String()), "\n", 2)
+	resp.Error.Message = lines[0]
+	if len(lines) == 2 {
+		resp.Error.Detail = strings.TrimSpace(lines[1])
+	}
+	w.Header().Set("Content-Type", TF_CONTENT_TYPE)
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	json.NewEncoder(w.ResponseWriter).Encode(resp)
+}
+
+//Get the code of the error response, from its status and the phase of the run at the error. The codes are stable,
+//the clients can branch on them
+func errorCode(status int, phase string) string {
+	switch status {
+	case http.StatusBadRequest:
+		switch phase {
+		case PHASE_MODEL_LOAD:
+			return "INVALID_MODEL"
+		case PHASE_PREDICTION, PHASE_UPLOAD:
+			return "INVALID_INPUT"
+		}
+		return "INVALID_PARAM"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		switch phase {
+		case PHASE_MODEL_LOAD:
+			return "MODEL_NOT_FOUND"
+		case PHASE_PREDICTION:
+			return "INPUT_NOT_FOUND"
+		}
+		return "NOT_FOUND"
+	case http.StatusConflict:
+		return "OUTPUT_CONFLICT"
+	case http.StatusRequestEntityTooLarge:
+		return "INPUT_TOO_LARGE"
+	case STATUS_REQUEST_CANCELLED:
+		return "REQUEST_CANCELLED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "REQUEST_TIMEOUT"
+	}
+	switch phase {
+	case PHASE_MODEL_LOAD:
+		return "MODEL_DOWNLOAD_FAILED"
+	case PHASE_TF_STARTUP:
+		return "TF_STARTUP_FAILED"
+	case PHASE_PREDICTION:
+		return "PREDICTION_FAILED"
+	case PHASE_UPLOAD:
+		return "UPLOAD_FAILED"
+	case PHASE_REPORTS:
+		return "REPORT_FAILED"
+	}
+	return "INTERNAL_ERROR"
+}
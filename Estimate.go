@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	//Throughput, in MB per second, of the download of the model
+	estimateDownloadMBps = getEnvInt("ESTIMATE_DOWNLOAD_MBPS", 50)
+	//Duration, in seconds, of the Tensorflow server startup
+	estimateStartupSeconds = getEnvInt("ESTIMATE_STARTUP_SECONDS", 10)
+	//Throughput, in instances per second, of the predictions. Used when the instances are counted
+	estimateInstancesPerSecond = getEnvInt("ESTIMATE_INSTANCES_PER_SECOND", 500)
+	//Throughput, in MB of input per second, of the predictions. Used when the instances aren't counted
+	estimatePredictionMBps = getEnvInt("ESTIMATE_PREDICTION_MBPS", 1)
+)
+
+//JSON response of the estimation of a run
+type runEstimate struct {
+	Model struct {
+		Objects int   `json:"objects"`
+		Bytes   int64 `json:"bytes"`
+	} `json:"model"`
+	Input struct {
+		Files int   `json:"files"`
+		Bytes int64 `json:"bytes"`
+		//Only set if the instances are counted
+		Instances *int64 `json:"instances,omitempty"`
+	} `json:"input"`
+	EstimatedSeconds struct {
+		Download   float64 `json:"download"`
+		Startup    float64 `json:"startup"`
+		Prediction float64 `json:"prediction"`
+		Total      float64 `json:"total"`
+	} `json:"estimated_seconds"`
+}
+
+//Estimate the size and the duration of a run, without downloading the model nor starting the Tensorflow server.
+//The model and the input objects are listed. With count_instances=true, the input files are read for counting the
+//instances. The durations are rough estimations based on the ESTIMATE_* throughput constants
+func Estimate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	model, err := getModelParam(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	input, err := getParam(r, "input")
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	opts, err := getPredictionOptions(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	countInstances, err := getBoolParam(r, "count_instances", false)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	clients := newStoreProvider()
+	modelStore, modelPath, err := getModelStore(ctx, clients, model)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+	inputStore, err := clients.Store(ctx, input, inputProject)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+
+	estimate := runEstimate{}
+	var models []filePath
+	if modelStore != nil {
+		// The local model isn't downloaded
+		models, err = listFiles(ctx, modelStore, modelPath)
+	}
+	if err != nil {
+		logError(ctx, err)
+		if writeCancelled(ctx, w) {
+			return
+		}
+		if _, ok := err.(*notFoundError); ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "model not found: "+err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when listing model files")
+		return
+	}
+	for _, m := range models {
+		estimate.Model.Objects++
+		estimate.Model.Bytes += m.Size
+	}
+
+	inputs, err := listFiles(ctx, inputStore, input.Path)
+	if err != nil {
+		logError(ctx, err)
+		if writeCancelled(ctx, w) {
+			return
+		}
+		if _, ok := err.(*notFoundError); ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "input not found: "+err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when listing input files")
+		return
+	}
+	inputs = filterSubdirs(ctx, inputs, opts.IncludeSubdirs, opts.ExcludeSubdirs)
+	inputs = filterFileNames(ctx, inputs, opts.InputFilter)
+	for _, i := range inputs {
+		estimate.Input.Files++
+		estimate.Input.Bytes += i.Size
+	}
+
+	if countInstances {
+		rootInputPath := input.Path[:strings.LastIndex(input.Path, "/")+1]
+		var instances int64
+		for _, i := range inputs {
+			if isBinaryInput(i, opts) {
+				instances++
+				continue
+			}
+			n, err := countLines(ctx, inputStore, rootInputPath+i.RelativePath+i.FileName)
+			if err != nil {
+				logError(ctx, err)
+				if writeCancelled(ctx, w) {
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "error when counting input instances")
+				return
+			}
+			if isCSVInput(i, opts) && n > 0 {
+				// Header row
+				n--
+			}
+			instances += n
+		}
+		estimate.Input.Instances = &instances
+	}
+
+	estimate.EstimatedSeconds.Download = float64(estimate.Model.Bytes) / float64(estimateDownloadMBps*1024*1024)
+	// The remote Tensorflow server is already started
+	if tfRemoteURL == "" {
+		estimate.EstimatedSeconds.Startup = float64(estimateStartupSeconds)
+	}
+	if estimate.Input.Instances != nil {
+		estimate.EstimatedSeconds.Prediction = float64(*estimate.Input.Instances) * opts.SampleRate / float64(estimateInstancesPerSecond)
+	} else {
+		estimate.EstimatedSeconds.Prediction = float64(estimate.Input.Bytes) * opts.SampleRate / float64(estimatePredictionMBps*1024*1024)
+	}
+	estimate.EstimatedSeconds.Total = estimate.EstimatedSeconds.Download + estimate.EstimatedSeconds.Startup +
+		estimate.EstimatedSeconds.Prediction
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(estimate)
+}
+
+//Count the non empty lines of an object, which are the instances of a JSON line input file
+func countLines(ctx context.Context, store ObjectStore, name string) (int64, error) {
+	src, err := store.Download(ctx, name, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	var lines int64
+	reader := bufio.NewReader(src)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			lines++
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return 0, err
+		}
+		// Long line, skip the rest of it
+		for err == bufio.ErrBufferFull {
+			_, err = reader.ReadSlice('\n')
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
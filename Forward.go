@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+//Request headers forwarded to the serving backend, like the routing or the tracing headers of a remote serving layer.
+//A comma separated list, none by default
+var forwardHeaders = getHeaderList(getEnvString("FORWARD_HEADERS", ""))
+
+func getHeaderList(value string) []string {
+	var ret []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ret = append(ret, http.CanonicalHeaderKey(name))
+		}
+	}
+	return ret
+}
+
+type forwardedHeadersKey struct{}
+
+//Wrap the handler for keeping the forwarded headers of the request in its context, for the prediction requests. The
+//request id is the one of the logs, also when it's generated
+func forwardHeadersHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(forwardHeaders) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		headers := http.Header{}
+		for _, name := range forwardHeaders {
+			if values := r.Header[name]; len(values) > 0 {
+				headers[name] = values
+			}
+		}
+		if fields, ok := r.Context().Value(logFieldsKey{}).(logFields); ok && headers.Get(REQUEST_ID_HEADER) == "" {
+			for _, name := range forwardHeaders {
+				if name == REQUEST_ID_HEADER {
+					headers.Set(REQUEST_ID_HEADER, fields.RequestID)
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedHeadersKey{}, headers)))
+	})
+}
+
+//Get the headers to forward to the serving backend, nil if none
+func getForwardedHeaders(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(forwardedHeadersKey{}).(http.Header)
+	return headers
+}
+
+//Add the forwarded headers to the gRPC metadata of the prediction requests
+func withForwardedMetadata(ctx context.Context) context.Context {
+	headers := getForwardedHeaders(ctx)
+	if len(headers) == 0 {
+		return ctx
+	}
+	md := metadata.MD{}
+	for name, values := range headers {
+		md.Append(strings.ToLower(name), values...)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	//Prediction requests posted on the REST API of the serving backend, the default protocol
+	PROTOCOL_REST = "rest"
+	//Prediction requests sent to the gRPC PredictionService of Tensorflow Serving
+	PROTOCOL_GRPC = "grpc"
+
+	//Full name of the Predict method of the Tensorflow Serving gRPC API
+	TF_GRPC_PREDICT_METHOD = "/tensorflow.serving.PredictionService/Predict"
+)
+
+//Tensorflow DataType values of the supported tensors
+const (
+	DT_FLOAT  = 1
+	DT_DOUBLE = 2
+	DT_INT32  = 3
+	DT_UINT8  = 4
+	DT_INT16  = 5
+	DT_INT8   = 6
+	DT_STRING = 7
+	DT_INT64  = 9
+	DT_BOOL   = 10
+)
+
+//DataType of the dtype names of the model metadata
+var tfDataTypes = map[string]uint64{
+	"DT_FLOAT":  DT_FLOAT,
+	"DT_DOUBLE": DT_DOUBLE,
+	"DT_INT32":  DT_INT32,
+	"DT_UINT8":  DT_UINT8,
+	"DT_INT16":  DT_INT16,
+	"DT_INT8":   DT_INT8,
+	"DT_STRING": DT_STRING,
+	"DT_INT64":  DT_INT64,
+	"DT_BOOL":   DT_BOOL,
+}
+
+//Fields of the TensorProto message used for the values of each DataType
+var tfValueFields = map[uint64]protowire.Number{
+	DT_FLOAT:  5,
+	DT_DOUBLE: 6,
+	DT_INT32:  7,
+	DT_UINT8:  7,
+	DT_INT16:  7,
+	DT_INT8:   7,
+	DT_STRING: 8,
+	DT_INT64:  10,
+	DT_BOOL:   11,
+}
+
+//Connection to the gRPC API of the Tensorflow server, opened on the first gRPC prediction. It reconnects by itself
+//when the server is restarted
+var tfGRPC struct {
+	once sync.Once
+	conn *grpc.ClientConn
+	err  error
+}
+
+func getGRPCConn() (*grpc.ClientConn, error) {
+	tfGRPC.once.Do(func() {
+		// Like the REST responses, the gRPC responses are bounded by TF_MAX_RESPONSE_BYTES
+		maxResponseBytes := math.MaxInt32
+		if tfMaxResponseBytes > 0 && tfMaxResponseBytes < math.MaxInt32 {
+			maxResponseBytes = int(tfMaxResponseBytes)
+		}
+		tfGRPC.conn, tfGRPC.err = grpc.Dial("localhost:"+tfGRPCPort, grpc.WithInsecure(),
+			grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{}), grpc.MaxCallRecvMsgSize(maxResponseBytes)))
+	})
+	return tfGRPC.conn, tfGRPC.err
+}
+
+//Codec of the messages already encoded in protobuf, for not depending on the generated Tensorflow Serving messages.
+//The request is a []byte, the response a *[]byte
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected gRPC request type %T", v))
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return errors.New(fmt.Sprintf("unexpected gRPC response type %T", v))
+	}
+	*b = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+//Call the Predict method of the Tensorflow server with the instances converted to tensors, and return the
+//predictions. The tensor types are the ones of the signature inputs in the model metadata
+func predictGRPC(ctx context.Context, p Predictor, instances []interface{}, opts *predictionOptions, trace *[]manifestRequest) ([]interface{}, error) {
+	tf, ok := p.(*tfPredictor)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the '%s' protocol requires the '%s' backend", PROTOCOL_GRPC, BACKEND_TENSORFLOW))
+	}
+	inputs, err := tf.signatureInputs(opts.ModelName, opts.Signature)
+	if err != nil {
+		return nil, err
+	}
+	body, err := encodePredictRequest(inputs, instances, opts.ModelName, opts.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if tfMaxRequestBytes > 0 && len(body) > tfMaxRequestBytes {
+		return nil, errors.New(fmt.Sprintf("prediction request of %d bytes, more than the %d bytes allowed by TF_MAX_REQUEST_BYTES, reduce BATCH_SIZE", len(body), tfMaxRequestBytes))
+	}
+
+	// Record the request once completed, successful or not
+	request := manifestRequest{URL: "grpc://localhost:" + tfGRPCPort + TF_GRPC_PREDICT_METHOD, RequestBytes: len(body)}
+	if trace != nil {
+		defer func() { *trace = append(*trace, request) }()
+	}
+
+	output, err := invokeWithBackoff(ctx, body, &request.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	request.Status = http.StatusOK
+	predictions, err := decodePredictResponse(output, len(instances), opts)
+	request.Predictions = len(predictions)
+	return predictions, err
+}
+
+//Send the prediction request, with the same attempts and backoff as postWithBackoff. Only the unavailable server,
+//like during the warmup, is retried. Each attempt is recorded with its outcome in the attempts, if not nil
+func invokeWithBackoff(ctx context.Context, body []byte, attempts *[]manifestAttempt) ([]byte, error) {
+	conn, err := getGRPCConn()
+	if err != nil {
+		return nil, err
+	}
+	ctx = withForwardedMetadata(ctx)
+	backoff := time.Duration(tfPostBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		var output []byte
+		release, err := acquireInflight(ctx)
+		if err != nil {
+			return nil, err
+		}
+		callCtx, cancel := context.WithTimeout(ctx, time.Duration(tfRequestTimeout)*time.Second)
+		err = conn.Invoke(callCtx, TF_GRPC_PREDICT_METHOD, body, &output)
+		cancel()
+		release()
+		if err == nil {
+			recordAttempt(attempts, http.StatusOK, nil)
+			return output, nil
+		}
+		recordAttempt(attempts, 0, err)
+		s := status.Convert(err)
+		if s.Code() == codes.DeadlineExceeded && ctx.Err() == nil {
+			return nil, errors.New(fmt.Sprintf("no serving response after %d seconds, limit set by TF_REQUEST_TIMEOUT: %s", tfRequestTimeout, s.Message()))
+		}
+		// The response larger than MaxCallRecvMsgSize, like a too large REST response, isn't retried
+		if s.Code() == codes.ResourceExhausted && tfMaxResponseBytes > 0 && strings.Contains(s.Message(), "larger than max") {
+			return nil, errors.New(fmt.Sprintf("serving response larger than the %d bytes allowed by TF_MAX_RESPONSE_BYTES, reduce BATCH_SIZE", tfMaxResponseBytes))
+		}
+		// Like a 400 of the REST API, the instances are rejected
+		if s.Code() == codes.InvalidArgument {
+			return nil, &servingStatusError{status: http.StatusBadRequest, message: fmt.Sprintf("serving response status %s: %s", s.Code(), s.Message())}
+		}
+		if s.Code() != codes.Unavailable || attempt >= tfPostAttempts {
+			return nil, errors.New(fmt.Sprintf("serving response status %s: %s", s.Code(), s.Message()))
+		}
+		logWarningf(ctx, "prediction request attempt %d/%d failed, new attempt in %s: %s", attempt, tfPostAttempts, backoff, s.Message())
+		if err = sleepContext(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+//Encode the PredictRequest of the instances for the signature, with one tensor per signature input. Each instance is a JSON object
+//with one field per input, or directly the value of the input if the signature has only one input
+func encodePredictRequest(inputs map[string]tfTensorInfo, instances []interface{}, model string, signature string) ([]byte, error) {
+	var spec []byte
+	spec = protowire.AppendTag(spec, 1, protowire.BytesType)
+	spec = protowire.AppendString(spec, model)
+	spec = protowire.AppendTag(spec, 3, protowire.BytesType)
+	spec = protowire.AppendString(spec, signature)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, spec)
+
+	// Sorted for a deterministic request
+	var names []string
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tensor, err := encodeTensor(name, inputs[name].Dtype, instances, len(inputs))
+		if err != nil {
+			return nil, err
+		}
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, tensor)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+//Encode the TensorProto of the input, batched on the first dimension
+func encodeTensor(name string, dtypeName string, instances []interface{}, inputCount int) ([]byte, error) {
+	dtype, ok := tfDataTypes[dtypeName]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("input '%s' has the unsupported dtype '%s' with the '%s' protocol", name, dtypeName, PROTOCOL_GRPC))
+	}
+
+	var data []interface{}
+	var instanceShape []int
+	for i, instance := range instances {
+		value, err := getInstanceInput(instance, name, inputCount)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("instance %d: %s", i, err))
+		}
+		shape := getShape(value)
+		if i == 0 {
+			instanceShape = shape
+		} else if !equalShapes(shape, instanceShape) {
+			return nil, errors.New(fmt.Sprintf("instance %d: input '%s' shape %v different from %v", i, name, shape, instanceShape))
+		}
+		data = flatten(value, data)
+	}
+
+	var shape []byte
+	for _, size := range append([]int{len(instances)}, instanceShape...) {
+		var dim []byte
+		dim = protowire.AppendTag(dim, 1, protowire.VarintType)
+		dim = protowire.AppendVarint(dim, uint64(size))
+		shape = protowire.AppendTag(shape, 2, protowire.BytesType)
+		shape = protowire.AppendBytes(shape, dim)
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, dtype)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, shape)
+
+	field := tfValueFields[dtype]
+	var packed []byte
+	for _, v := range data {
+		if dtype == DT_STRING {
+			s, err := toTensorString(v)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("input '%s': %s", name, err))
+			}
+			b = protowire.AppendTag(b, field, protowire.BytesType)
+			b = protowire.AppendBytes(b, s)
+			continue
+		}
+		if dtype == DT_BOOL {
+			x, ok := v.(bool)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("input '%s': %v isn't a boolean", name, v))
+			}
+			packed = protowire.AppendVarint(packed, protowire.EncodeBool(x))
+			continue
+		}
+		x, ok := v.(float64)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("input '%s': %v isn't a number", name, v))
+		}
+		switch dtype {
+		case DT_FLOAT:
+			packed = protowire.AppendFixed32(packed, math.Float32bits(float32(x)))
+		case DT_DOUBLE:
+			packed = protowire.AppendFixed64(packed, math.Float64bits(x))
+		default:
+			if x != math.Trunc(x) {
+				return nil, errors.New(fmt.Sprintf("input '%s': %v isn't an integer", name, v))
+			}
+			packed = protowire.AppendVarint(packed, uint64(int64(x)))
+		}
+	}
+	if len(packed) > 0 {
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	return b, nil
+}
+
+//Bytes of a string input. The binary values are JSON objects with a base64 "b64" field, like with the REST API
+func toTensorString(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case string:
+		return []byte(x), nil
+	case map[string]interface{}:
+		if s, ok := x["b64"].(string); ok && len(x) == 1 {
+			return base64.StdEncoding.DecodeString(s)
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%v isn't a string", v))
+}
+
+//Decoded TensorProto. The numeric values are kept as raw varint or fixed values until converted with the dtype
+type tfTensor struct {
+	dtype   uint64
+	shape   []int
+	content []byte
+	values  []uint64
+	strings [][]byte
+}
+
+//Decode the PredictResponse and split the output tensors per instance. With only one output, the prediction is the
+//value of the output, else it's a JSON object with one field per output, like the REST API
+func decodePredictResponse(b []byte, count int, opts *predictionOptions) ([]interface{}, error) {
+	outputs := map[string]*tfTensor{}
+	err := forEachField(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var name string
+		var tensor *tfTensor
+		err := forEachField(data, func(num protowire.Number, v uint64, data []byte) error {
+			var err error
+			switch num {
+			case 1:
+				name = string(data)
+			case 2:
+				tensor, err = decodeTensor(data)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if tensor != nil {
+			outputs[name] = tensor
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid gRPC serving response: %s", err))
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("no outputs in the gRPC serving response")
+	}
+
+	predictions := make([]interface{}, count)
+	for name, o := range outputs {
+		if len(o.shape) == 0 {
+			return nil, errors.New(fmt.Sprintf("output '%s' without batch dimension", name))
+		}
+		if o.shape[0] != count {
+			return nil, errors.New(fmt.Sprintf("output '%s' batch size %d different from %d", name, o.shape[0], count))
+		}
+		size := 1
+		for _, d := range o.shape[1:] {
+			size *= d
+		}
+		data, err := o.data(count*size, opts)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("output '%s': %s", name, err))
+		}
+		for i := range predictions {
+			value := reshape(data[i*size:(i+1)*size], o.shape[1:])
+			if len(outputs) == 1 {
+				predictions[i] = value
+				continue
+			}
+			if predictions[i] == nil {
+				predictions[i] = map[string]interface{}{}
+			}
+			predictions[i].(map[string]interface{})[name] = value
+		}
+	}
+	return predictions, nil
+}
+
+func decodeTensor(b []byte) (*tfTensor, error) {
+	t := &tfTensor{}
+	err := forEachField(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			t.dtype = v
+		case 2:
+			return forEachField(data, func(num protowire.Number, v uint64, data []byte) error {
+				if num != 2 {
+					return nil
+				}
+				return forEachField(data, func(num protowire.Number, v uint64, data []byte) error {
+					if num == 1 {
+						t.shape = append(t.shape, int(int64(v)))
+					}
+					return nil
+				})
+			})
+		case 4:
+			t.content = data
+		case 8:
+			t.strings = append(t.strings, data)
+		case 5, 6, 7, 10, 11:
+			if data == nil {
+				t.values = append(t.values, v)
+				return nil
+			}
+			// Packed values
+			var err error
+			t.values, err = appendPacked(t.values, num, data)
+			return err
+		}
+		return nil
+	})
+	return t, err
+}
+
+//Decode the packed repeated values of the TensorProto field
+func appendPacked(values []uint64, num protowire.Number, data []byte) ([]uint64, error) {
+	for len(data) > 0 {
+		var v uint64
+		var n int
+		switch num {
+		case 5:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(data)
+			v = uint64(x)
+		case 6:
+			v, n = protowire.ConsumeFixed64(data)
+		default:
+			v, n = protowire.ConsumeVarint(data)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+//Get the count values of the tensor as JSON values. Like in Tensorflow, the last value is repeated when the tensor
+//has fewer values than elements
+func (t *tfTensor) data(count int, opts *predictionOptions) ([]interface{}, error) {
+	var data []interface{}
+	if t.content != nil {
+		size := map[uint64]int{DT_FLOAT: 4, DT_DOUBLE: 8, DT_INT32: 4, DT_UINT8: 1, DT_INT16: 2, DT_INT8: 1, DT_INT64: 8, DT_BOOL: 1}[t.dtype]
+		if size == 0 || len(t.content) != count*size {
+			return nil, errors.New(fmt.Sprintf("tensor content of %d bytes invalid for %d values of dtype %d", len(t.content), count, t.dtype))
+		}
+		for i := 0; i < count; i++ {
+			c := t.content[i*size : (i+1)*size]
+			var v uint64
+			switch size {
+			case 1:
+				v = uint64(c[0])
+				if t.dtype == DT_INT8 {
+					v = uint64(int8(c[0]))
+				}
+			case 2:
+				v = uint64(int16(binary.LittleEndian.Uint16(c)))
+			case 4:
+				v = uint64(binary.LittleEndian.Uint32(c))
+			case 8:
+				v = binary.LittleEndian.Uint64(c)
+			}
+			t.values = append(t.values, v)
+		}
+	}
+
+	if t.dtype == DT_STRING {
+		for _, s := range t.strings {
+			if utf8.Valid(s) {
+				data = append(data, string(s))
+			} else {
+				data = append(data, map[string]interface{}{"b64": base64.StdEncoding.EncodeToString(s)})
+			}
+		}
+	} else {
+		for _, v := range t.values {
+			value, err := toJSONValue(t.dtype, v, opts)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, value)
+		}
+	}
+	if len(data) == 0 && count > 0 {
+		return nil, errors.New(fmt.Sprintf("no value for %d elements", count))
+	}
+	if len(data) > count {
+		return nil, errors.New(fmt.Sprintf("%d values for %d elements", len(data), count))
+	}
+	for len(data) < count {
+		data = append(data, data[len(data)-1])
+	}
+	return data, nil
+}
+
+//Convert the raw value of the dtype to a JSON value. The float values keep their shortest float32 representation,
+//like in the REST responses, and the non finite values are replaced according to on_nonfinite
+func toJSONValue(dtype uint64, v uint64, opts *predictionOptions) (interface{}, error) {
+	var f float64
+	switch dtype {
+	case DT_FLOAT:
+		f, _ = strconv.ParseFloat(strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32), 64)
+	case DT_DOUBLE:
+		f = math.Float64frombits(v)
+	case DT_BOOL:
+		return v != 0, nil
+	case DT_INT32, DT_INT16, DT_INT8:
+		return int64(int32(v)), nil
+	case DT_UINT8, DT_INT64:
+		return int64(v), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported dtype %d with the '%s' protocol", dtype, PROTOCOL_GRPC))
+	}
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f, nil
+	}
+
+	token := "NaN"
+	if math.IsInf(f, 1) {
+		token = "Infinity"
+	} else if math.IsInf(f, -1) {
+		token = "-Infinity"
+	}
+	switch opts.OnNonFinite {
+	case ON_NONFINITE_FAIL:
+		return nil, errors.New(fmt.Sprintf("non finite value %s in the serving response, set on_nonfinite for replacing it", token))
+	case ON_NONFINITE_NULL:
+		return nil, nil
+	case ON_NONFINITE_STRING:
+		return token, nil
+	}
+	// Number, already validated with the options
+	return strconv.ParseFloat(opts.OnNonFinite, 64)
+}
+
+//Call f on each field of the protobuf message. The value of a bytes field is in data, the value of a varint or a
+//fixed field in v
+func forEachField(b []byte, f func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(b)
+			v = uint64(x)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+			if data == nil {
+				// Empty, but still a bytes field
+				data = []byte{}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := f(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//Decode the JSON value, like the instances read from the files
+func jsonValue(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+//PredictResponse with the tensors of the PredictRequest as outputs. The inputs and the outputs are both maps of
+//TensorProto, only their field number differs
+func requestToResponse(t *testing.T, request []byte) []byte {
+	t.Helper()
+	var b []byte
+	err := forEachField(request, func(num protowire.Number, v uint64, data []byte) error {
+		if num == 2 {
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//PredictResponse with the single output tensor
+func outputResponse(name string, tensor []byte) []byte {
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, name)
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, tensor)
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, entry)
+}
+
+//TensorProto header of the dtype and the shape
+func tensorHeader(dtype uint64, shape ...int) []byte {
+	var dims []byte
+	for _, size := range shape {
+		var dim []byte
+		dim = protowire.AppendTag(dim, 1, protowire.VarintType)
+		dim = protowire.AppendVarint(dim, uint64(size))
+		dims = protowire.AppendTag(dims, 2, protowire.BytesType)
+		dims = protowire.AppendBytes(dims, dim)
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, dtype)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, dims)
+}
+
+//The instances encoded in a request and decoded from the same tensors in the response are unchanged, for each dtype
+func TestGRPCRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		inputs    map[string]string
+		instances string
+		want      string
+	}{
+		{name: "float", inputs: map[string]string{"x": "DT_FLOAT"}, instances: `[[0.1,-2.5],[3,1e-7]]`},
+		{name: "double", inputs: map[string]string{"x": "DT_DOUBLE"}, instances: `[0.1,-1.7976931348623157e308]`},
+		{name: "int32", inputs: map[string]string{"x": "DT_INT32"}, instances: `[[1,-1],[2147483647,-2147483648]]`},
+		{name: "uint8", inputs: map[string]string{"x": "DT_UINT8"}, instances: `[0,255]`},
+		{name: "int16", inputs: map[string]string{"x": "DT_INT16"}, instances: `[-32768,32767]`},
+		{name: "int8", inputs: map[string]string{"x": "DT_INT8"}, instances: `[-128,-1,127]`},
+		{name: "int64", inputs: map[string]string{"x": "DT_INT64"}, instances: `[-9007199254740991,9007199254740991]`},
+		{name: "bool", inputs: map[string]string{"x": "DT_BOOL"}, instances: `[[true,false],[false,true]]`},
+		{name: "string", inputs: map[string]string{"x": "DT_STRING"}, instances: `["abc","","é"]`},
+		{name: "b64", inputs: map[string]string{"x": "DT_STRING"}, instances: `[{"b64":"/wA="},{"b64":"YWJj"}]`, want: `[{"b64":"/wA="},"abc"]`},
+		{name: "scalar", inputs: map[string]string{"x": "DT_INT32"}, instances: `[7]`},
+		{name: "several inputs", inputs: map[string]string{"a": "DT_FLOAT", "b": "DT_STRING"}, instances: `[{"a":[1,2],"b":"x"},{"a":[3,4],"b":"y"}]`},
+	}
+	for _, test := range tests {
+		inputs := map[string]tfTensorInfo{}
+		for name, dtype := range test.inputs {
+			inputs[name] = tfTensorInfo{Dtype: dtype}
+		}
+		instances := jsonValue(t, test.instances).([]interface{})
+		request, err := encodePredictRequest(inputs, instances, "model", "serving_default")
+		if err != nil {
+			t.Errorf("%s: encode: %s", test.name, err)
+			continue
+		}
+		predictions, err := decodePredictResponse(requestToResponse(t, request), len(instances), &predictionOptions{OnNonFinite: ON_NONFINITE_FAIL})
+		if err != nil {
+			t.Errorf("%s: decode: %s", test.name, err)
+			continue
+		}
+		want := test.want
+		if want == "" {
+			want = test.instances
+		}
+		got, _ := json.Marshal(predictions)
+		if string(got) != string(mustMarshal(t, jsonValue(t, want))) {
+			t.Errorf("%s: predictions %s, %s expected", test.name, got, want)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//The negative integers are 10 bytes varints, sign extended to 64 bits like in the Tensorflow messages
+func TestEncodeTensorNegativeVarint(t *testing.T) {
+	for _, dtype := range []string{"DT_INT32", "DT_INT8"} {
+		b, err := encodeTensor("x", dtype, []interface{}{-1.0}, 1)
+		if err != nil {
+			t.Fatalf("%s: %s", dtype, err)
+		}
+		tensor, err := decodeTensor(b)
+		if err != nil {
+			t.Fatalf("%s: %s", dtype, err)
+		}
+		if len(tensor.values) != 1 || tensor.values[0] != math.MaxUint64 {
+			t.Errorf("%s: -1 encoded as %v", dtype, tensor.values)
+		}
+		if !strings.HasSuffix(string(b), string(protowire.AppendVarint(nil, math.MaxUint64))) {
+			t.Errorf("%s: -1 not encoded as a 64 bits varint", dtype)
+		}
+	}
+}
+
+//The values are decoded from the tensor_content bytes, the packed and the unpacked repeated fields, and the last
+//value is repeated for the missing elements
+func TestDecodeTensorValues(t *testing.T) {
+	le16 := make([]byte, 2)
+	binary.LittleEndian.PutUint16(le16, uint16(0xfffe))
+	le32 := make([]byte, 8)
+	binary.LittleEndian.PutUint32(le32, math.Float32bits(1.5))
+	binary.LittleEndian.PutUint32(le32[4:], math.Float32bits(-0.25))
+	content := func(dtype uint64, data []byte, shape ...int) []byte {
+		b := tensorHeader(dtype, shape...)
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		return protowire.AppendBytes(b, data)
+	}
+	unpacked := tensorHeader(DT_INT32, 3)
+	for _, v := range []int64{-3, 0, 5} {
+		unpacked = protowire.AppendTag(unpacked, 7, protowire.VarintType)
+		unpacked = protowire.AppendVarint(unpacked, uint64(v))
+	}
+	broadcast := tensorHeader(DT_FLOAT, 3)
+	broadcast = protowire.AppendTag(broadcast, 5, protowire.BytesType)
+	broadcast = protowire.AppendBytes(broadcast, protowire.AppendFixed32(nil, math.Float32bits(2)))
+	texts := tensorHeader(DT_STRING, 2, 2)
+	texts = protowire.AppendTag(texts, 8, protowire.BytesType)
+	texts = protowire.AppendString(texts, "a")
+
+	tests := []struct {
+		name   string
+		tensor []byte
+		count  int
+		want   string
+	}{
+		{name: "content int8", tensor: content(DT_INT8, []byte{0xff, 0x80, 0x7f}, 3), count: 3, want: `[-1,-128,127]`},
+		{name: "content uint8", tensor: content(DT_UINT8, []byte{0xff, 0}, 2), count: 2, want: `[255,0]`},
+		{name: "content int16", tensor: content(DT_INT16, le16, 1), count: 1, want: `[-2]`},
+		{name: "content float", tensor: content(DT_FLOAT, le32, 2), count: 2, want: `[1.5,-0.25]`},
+		{name: "content bool", tensor: content(DT_BOOL, []byte{1, 0}, 2), count: 2, want: `[true,false]`},
+		{name: "unpacked int32", tensor: unpacked, count: 3, want: `[-3,0,5]`},
+		{name: "scalar broadcast", tensor: broadcast, count: 3, want: `[2,2,2]`},
+		{name: "string broadcast", tensor: texts, count: 2, want: `[["a","a"],["a","a"]]`},
+	}
+	for _, test := range tests {
+		predictions, err := decodePredictResponse(outputResponse("y", test.tensor), test.count, &predictionOptions{OnNonFinite: ON_NONFINITE_FAIL})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := mustMarshal(t, predictions); string(got) != test.want {
+			t.Errorf("%s: predictions %s, %s expected", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEncodePredictRequestErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		inputs    map[string]string
+		instances string
+		err       string
+	}{
+		{name: "ragged", inputs: map[string]string{"x": "DT_FLOAT"}, instances: `[[1,2],[3]]`, err: "instance 1: input 'x' shape [1] different from [2]"},
+		{name: "rank", inputs: map[string]string{"x": "DT_FLOAT"}, instances: `[[1],[[2]]]`, err: "shape [1 1] different from [1]"},
+		{name: "missing input", inputs: map[string]string{"a": "DT_FLOAT", "b": "DT_FLOAT"}, instances: `[{"a":1}]`, err: "instance 0: missing input 'b'"},
+		{name: "unsupported dtype", inputs: map[string]string{"x": "DT_HALF"}, instances: `[1]`, err: "unsupported dtype 'DT_HALF'"},
+		{name: "not an integer", inputs: map[string]string{"x": "DT_INT64"}, instances: `[1.5]`, err: "isn't an integer"},
+		{name: "not a number", inputs: map[string]string{"x": "DT_DOUBLE"}, instances: `["1"]`, err: "isn't a number"},
+		{name: "not a boolean", inputs: map[string]string{"x": "DT_BOOL"}, instances: `[1]`, err: "isn't a boolean"},
+		{name: "not a string", inputs: map[string]string{"x": "DT_STRING"}, instances: `[{"b64":"YQ==","x":1}]`, err: "isn't a string"},
+		{name: "invalid b64", inputs: map[string]string{"x": "DT_STRING"}, instances: `[{"b64":"%%"}]`, err: "illegal base64"},
+	}
+	for _, test := range tests {
+		inputs := map[string]tfTensorInfo{}
+		for name, dtype := range test.inputs {
+			inputs[name] = tfTensorInfo{Dtype: dtype}
+		}
+		_, err := encodePredictRequest(inputs, jsonValue(t, test.instances).([]interface{}), "model", "serving_default")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, %q expected", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDecodePredictResponseErrors(t *testing.T) {
+	values := func(shape ...int) []byte {
+		b := tensorHeader(DT_INT64, shape...)
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		return protowire.AppendBytes(b, protowire.AppendVarint(protowire.AppendVarint(nil, 1), 2))
+	}
+	content := tensorHeader(DT_INT32, 2)
+	content = protowire.AppendTag(content, 4, protowire.BytesType)
+	content = protowire.AppendBytes(content, []byte{1, 2, 3})
+
+	tests := []struct {
+		name     string
+		response []byte
+		count    int
+		err      string
+	}{
+		{name: "no outputs", response: nil, count: 1, err: "no outputs"},
+		{name: "truncated", response: outputResponse("y", values(2))[:5], count: 2, err: "invalid gRPC serving response"},
+		{name: "no batch dimension", response: outputResponse("y", values()), count: 2, err: "without batch dimension"},
+		{name: "batch size", response: outputResponse("y", values(3)), count: 2, err: "batch size 3 different from 2"},
+		{name: "too many values", response: outputResponse("y", values(1)), count: 1, err: "2 values for 1 elements"},
+		{name: "no value", response: outputResponse("y", tensorHeader(DT_INT64, 2)), count: 2, err: "no value for 2 elements"},
+		{name: "content size", response: outputResponse("y", content), count: 2, err: "tensor content of 3 bytes invalid"},
+	}
+	for _, test := range tests {
+		_, err := decodePredictResponse(test.response, test.count, &predictionOptions{OnNonFinite: ON_NONFINITE_FAIL})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, %q expected", test.name, err, test.err)
+		}
+	}
+}
+
+//Like with the REST API, a request larger than TF_MAX_REQUEST_BYTES isn't sent
+func TestPredictGRPCMaxRequestBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"metadata":{"signature_def":{"signature_def":{"serving_default":{"inputs":{"x":{"dtype":"DT_FLOAT"}}}}}}}`))
+	}))
+	defer server.Close()
+	previousURL, previousMax := tfRemoteURL, tfMaxRequestBytes
+	tfRemoteURL, tfMaxRequestBytes = server.URL, 16
+	defer func() { tfRemoteURL, tfMaxRequestBytes = previousURL, previousMax }()
+
+	opts := &predictionOptions{ModelName: modelName, Signature: TF_DEFAULT_SIGNATURE, OnNonFinite: ON_NONFINITE_FAIL}
+	_, err := predictGRPC(context.Background(), &tfPredictor{layout: MODEL_LAYOUT_FLAT}, []interface{}{1.0, 2.0, 3.0}, opts, nil)
+	if err == nil || !strings.Contains(err.Error(), "allowed by TF_MAX_REQUEST_BYTES") {
+		t.Errorf("request larger than TF_MAX_REQUEST_BYTES: %v", err)
+	}
+}
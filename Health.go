@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Timeout of the check of the Tensorflow server REST API by the readiness probe
+const READY_CHECK_TIMEOUT = 2 * time.Second
+
+//Liveness probe. Answers as soon as the web server is up, without any prediction
+func Health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+//Readiness probe. In persistent mode, when a model is loaded, the Tensorflow server must answer on its REST API. With
+//served models, all of them must be available
+func Ready(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if servedServer != nil {
+		if err := predictor.ModelAvailable(); err != nil {
+			logWarningf(ctx, "served models not ready: %s", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "served models not ready")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "ready, models %s served\n", strings.Join(tfModelNames(), ", "))
+		return
+	}
+	tf, key := currentModel.get()
+	if !persistentModel || tf == nil {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ready")
+		return
+	}
+
+	client := &http.Client{Timeout: READY_CHECK_TIMEOUT}
+	resp, err := client.Get(predictor.StatusURL())
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = errors.New(fmt.Sprintf("model status returned %s", resp.Status))
+		}
+	}
+	if err != nil {
+		logWarningf(ctx, "model %s not ready: %s", key, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "model %s not ready\n", key)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "ready, model %s loaded\n", key)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+//Content type of the JSON line predictions returned in the response
+const NDJSON_CONTENT_TYPE = "application/x-ndjson"
+
+//Predict the instances of the request body and return the predictions in the response, without input and output objects.
+//The body has the input file format, JSON line or JSON array. The model param and the optional params are the same
+//as LoadAndPredict, except the ones related to the input and output objects
+func PredictBody(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !acquireRequestSlot(ctx, w) {
+		return
+	}
+	defer releaseRequestSlot()
+
+	// Get Model param, nil for the local model
+	model, err := getModelParam(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	// Get the optional params
+	opts, err := getPredictionOptions(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	// All the instances are read in memory, the body size is bounded by MAX_REQUEST_BYTES
+	if maxRequestBytes > 0 && r.ContentLength > maxRequestBytes {
+		logErrorf(ctx, "request body of %d bytes rejected", r.ContentLength)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "request body larger than the %d bytes allowed by MAX_REQUEST_BYTES\n", maxRequestBytes)
+		return
+	}
+	limited := &limitedBody{ReadCloser: r.Body}
+	if maxRequestBytes > 0 {
+		limited.ReadCloser = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+	}
+
+	// Read the instances before loading the model, for failing fast on an invalid body
+	var body io.Reader = limited
+	if opts.InputFormat == INPUT_FORMAT_CSV {
+		body = newCSVJSONReader(limited, opts.CSVAllStrings, opts.CSVDelim)
+	}
+	instances, positions, err := readInstances(body, newInstanceSampler(ctx, opts, opts.SampleSeed), opts)
+	if err != nil && limited.exceeded {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "request body larger than the %d bytes allowed by MAX_REQUEST_BYTES\n", maxRequestBytes)
+		return
+	}
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "error when reading the instances of the body: "+err.Error())
+		return
+	}
+
+	// Only one request at the time uses the model directory and the Tensorflow server. The remote server is shared
+	if tfRemoteURL == "" {
+		currentModel.mu.Lock()
+		defer currentModel.mu.Unlock()
+	}
+
+	//Create the storage client
+	modelStore, modelPath, err := getModelStore(ctx, newStoreProvider(), model)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+
+	// Load the model, or reuse the one already loaded in persistent mode
+	tf, _, ok := loadModel(ctx, w, modelStore, modelPath, opts, &runMetrics{})
+	defer releaseModel(ctx, tf, opts)
+	if !ok {
+		return
+	}
+
+	encoder := getEncoder(opts.OutputFormat)
+	contentType := encoder.ContentType()
+	if len(instances) == 0 {
+		logInfof(ctx, "no instance in the body, prediction skipped")
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if opts.ValidateShapes {
+		if err = validateShapes(predictor, instances, positions, opts); err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+	}
+
+	// In raw format, the serving responses are recorded for returning them
+	var responses []manifestRequest
+	var trace *[]manifestRequest
+	if opts.OutputFormat == OUTPUT_FORMAT_RAW {
+		trace = &responses
+	}
+	predictions, err := predictBatches(ctx, predictor, instances, positions, opts, trace)
+	if err != nil {
+		logError(ctx, err)
+		if writeCancelled(ctx, w) {
+			return
+		}
+		if tf != nil && tf.isRestarting() {
+			writeRestarting(ctx, w)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		if tf != nil && !tf.isRunning() {
+			fmt.Fprintln(w, "error when making predictions: tensorflow server exited during the predictions")
+		} else {
+			fmt.Fprintln(w, "error when making predictions: "+err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if trace != nil {
+		err = writeRawResponses(w, responses)
+	} else {
+		err = encoder.Encode(w, predictions)
+	}
+	if err != nil {
+		logError(ctx, err)
+	}
+}
+
+//Request body which records if the MAX_REQUEST_BYTES limit of http.MaxBytesReader is exceeded: the read fails after
+//exactly the max bytes
+type limitedBody struct {
+	io.ReadCloser
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && maxRequestBytes > 0 && b.read >= maxRequestBytes {
+		b.exceeded = true
+	}
+	return n, err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//List of the pinned input objects of a run, for predicting on exactly the same versions of the inputs
+type inputManifest struct {
+	Inputs []inputManifestEntry `json:"inputs"`
+}
+
+//Input object, relative to the input path, and its generation
+type inputManifestEntry struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+}
+
+//Read and validate the input manifest. The inputs are returned in the listing order, relative to the input path
+func readInputManifest(ctx context.Context, store ObjectStore, path string) ([]filePath, error) {
+	r, err := store.Download(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := inputManifest{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&manifest); err != nil {
+		return nil, errors.New(fmt.Sprintf("input manifest bad formatted: %s", err))
+	}
+	if len(manifest.Inputs) == 0 {
+		return nil, errors.New("input manifest bad formatted: 'inputs' is empty")
+	}
+
+	var ret []filePath
+	names := map[string]bool{}
+	for i, input := range manifest.Inputs {
+		if input.Name == "" || strings.HasPrefix(input.Name, "/") || strings.HasSuffix(input.Name, "/") {
+			return nil, errors.New(fmt.Sprintf("input manifest bad formatted: input %d must have a relative object 'name'", i))
+		}
+		// Like in the listings, a '..' segment would name an output outside of its destination directory
+		if hasParentSegment(input.Name) {
+			return nil, errors.New(fmt.Sprintf("input manifest bad formatted: input '%s' must not contain '..' segments", input.Name))
+		}
+		if input.Generation <= 0 {
+			return nil, errors.New(fmt.Sprintf("input manifest bad formatted: input '%s' must have a positive 'generation'", input.Name))
+		}
+		if names[input.Name] {
+			return nil, errors.New(fmt.Sprintf("input manifest bad formatted: input '%s' is duplicated", input.Name))
+		}
+		names[input.Name] = true
+		ret = append(ret, filePath{
+			RelativePath: input.Name[:strings.LastIndex(input.Name, "/")+1],
+			FileName:     input.Name[strings.LastIndex(input.Name, "/")+1:],
+			Generation:   input.Generation,
+		})
+	}
+
+	// Same order as the bucket listing, the inputs of the same output group are contiguous
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].RelativePath+ret[i].FileName < ret[j].RelativePath+ret[j].FileName
+	})
+	return ret, nil
+}
+
+//Get the input location of the input param, or the input objects of the inputs param with their common directory as
+//input location. The input objects are nil without the inputs param
+func getInputParams(r *http.Request) (storeLocation, []filePath, error) {
+	objects, inputs, err := getInputObjects(r)
+	if err != nil {
+		return storeLocation{}, nil, err
+	}
+	if objects == nil {
+		input, err := getParam(r, "input")
+		return input, nil, err
+	}
+	if getStringParam(r, "input", "") != "" || getStringParam(r, "manifest", "") != "" {
+		return storeLocation{}, nil, errors.New("'inputs' can't be used with 'input' or 'manifest'")
+	}
+	return *objects, inputs, nil
+}
+
+//Get the input objects of the inputs param, a comma separated list of object locations predicted instead of the
+//objects of a single input location. The objects must be in the same bucket. The returned input location is their
+//deepest common directory, and the inputs are relative to it, for naming the outputs after the objects. Nil without
+//the param
+func getInputObjects(r *http.Request) (*storeLocation, []filePath, error) {
+	list := getListParam(r, "inputs")
+	if len(list) == 0 {
+		return nil, nil, nil
+	}
+	var objects []storeLocation
+	names := map[string]bool{}
+	for _, location := range list {
+		l, err := extractLocation(location)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("'inputs' bad formatted: %s", err))
+		}
+		if l.Path == "" || strings.HasSuffix(l.Path, "/") {
+			return nil, nil, errors.New(fmt.Sprintf("'inputs' bad formatted: %s must be an object, not a directory", location))
+		}
+		if len(objects) > 0 && (l.Scheme != objects[0].Scheme || l.Bucket != objects[0].Bucket) {
+			return nil, nil, errors.New(fmt.Sprintf("'inputs' bad formatted: %s isn't in the bucket of the other inputs", location))
+		}
+		if names[l.Path] {
+			return nil, nil, errors.New(fmt.Sprintf("'inputs' bad formatted: %s is set twice", location))
+		}
+		names[l.Path] = true
+		objects = append(objects, l)
+	}
+
+	root := objects[0].Path[:strings.LastIndex(objects[0].Path, "/")+1]
+	for _, o := range objects[1:] {
+		for !strings.HasPrefix(o.Path, root) {
+			root = root[:strings.LastIndex(strings.TrimSuffix(root, "/"), "/")+1]
+		}
+	}
+	var inputs []filePath
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Path, root)
+		inputs = append(inputs, filePath{
+			RelativePath: name[:strings.LastIndex(name, "/")+1],
+			FileName:     name[strings.LastIndex(name, "/")+1:],
+		})
+	}
+	// Same order as the bucket listing, like the inputs of the input manifest
+	sort.SliceStable(inputs, func(i, j int) bool {
+		return inputs[i].RelativePath+inputs[i].FileName < inputs[j].RelativePath+inputs[j].FileName
+	})
+	input := objects[0]
+	input.Path = root
+	return &input, inputs, nil
+}
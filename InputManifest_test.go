@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadInputManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []filePath
+		err      string
+	}{
+		{
+			name:     "sorted inputs",
+			manifest: `{"inputs":[{"name":"b/2.jsonl","generation":2},{"name":"a.jsonl","generation":1}]}`,
+			want:     []filePath{{FileName: "a.jsonl", Generation: 1}, {RelativePath: "b/", FileName: "2.jsonl", Generation: 2}},
+		},
+		{name: "empty", manifest: `{"inputs":[]}`, err: "'inputs' is empty"},
+		{name: "unknown field", manifest: `{"inputs":[{"name":"a.jsonl","generation":1,"size":3}]}`, err: "bad formatted"},
+		{name: "absolute name", manifest: `{"inputs":[{"name":"/a.jsonl","generation":1}]}`, err: "relative object 'name'"},
+		{name: "directory name", manifest: `{"inputs":[{"name":"a/","generation":1}]}`, err: "relative object 'name'"},
+		{name: "parent segment", manifest: `{"inputs":[{"name":"../../etc/x","generation":1}]}`, err: "'..' segments"},
+		{name: "inner parent segment", manifest: `{"inputs":[{"name":"a/../../x.jsonl","generation":1}]}`, err: "'..' segments"},
+		{name: "missing generation", manifest: `{"inputs":[{"name":"a.jsonl"}]}`, err: "positive 'generation'"},
+		{name: "duplicated", manifest: `{"inputs":[{"name":"a.jsonl","generation":1},{"name":"a.jsonl","generation":2}]}`, err: "duplicated"},
+	}
+	for _, test := range tests {
+		store := newMemStore(SCHEME_GCS, "in")
+		store.put("manifest.json", []byte(test.manifest), "application/json")
+		got, err := readInputManifest(context.Background(), store, "manifest.json")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: %v, %v, error %q expected", test.name, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %+v, %v, %+v expected", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	//The job waits in the queue, or waits the previous runs, only one run at the time uses the model directory
+	JOB_PENDING = "pending"
+	//The model is loaded or the input files are predicted
+	JOB_RUNNING = "running"
+	//The run answered a 200
+	JOB_SUCCEEDED = "succeeded"
+	//The run answered an error, reported in the job
+	JOB_FAILED = "failed"
+
+	//Duration the completed jobs are kept for their status requests
+	JOB_RETENTION = time.Hour
+)
+
+var (
+	//Max size, in bytes, of the response body of a run kept in its job. The rest is dropped
+	jobMaxResponseBytes = getEnvInt("JOB_MAX_RESPONSE_BYTES", 1<<20)
+	//Number of workers of the jobs, the max number of jobs running at the same time
+	jobConcurrency = getEnvInt("JOB_CONCURRENCY", 1)
+	//Max number of jobs waiting a worker in the queue. Above, the new jobs are rejected
+	jobQueueSize = getEnvInt("JOB_QUEUE_SIZE", 100)
+	//Max size, in bytes, of the log entries kept per job. The oldest ones are dropped
+	jobLogBytes = getEnvInt("JOB_LOG_BYTES", 256*1024)
+)
+
+//Run of LoadAndPredict in the background, started by POST /jobs and polled by GET /jobs/{id}
+type job struct {
+	mu         sync.Mutex
+	ID         string     `json:"job_id"`
+	Status     string     `json:"status"`
+	FilesDone  int        `json:"files_done"`
+	FilesTotal int        `json:"files_total"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	//Status and body of the LoadAndPredict response, once completed. The body is truncated to JOB_MAX_RESPONSE_BYTES
+	ResponseStatus    int    `json:"response_status,omitempty"`
+	Response          string `json:"response,omitempty"`
+	ResponseTruncated bool   `json:"response_truncated,omitempty"`
+	//Log entries of the run, oldest first, within JOB_LOG_BYTES, and the number of dropped entries
+	logs        [][]byte
+	logsSize    int
+	logsDropped int
+}
+
+//Jobs of the server, kept in memory. The completed ones are dropped after JOB_RETENTION. The created jobs wait in the
+//queue, in their creation order, for one of the JOB_CONCURRENCY workers
+var jobs = struct {
+	sync.Mutex
+	byID    map[string]*job
+	running sync.WaitGroup
+	queue   chan *queuedJob
+	workers sync.Once
+}{byID: map[string]*job{}, queue: make(chan *queuedJob, jobQueueSize)}
+
+//Job waiting a worker, with the request of its run
+type queuedJob struct {
+	job *job
+	run *http.Request
+}
+
+type jobKey struct{}
+
+//Get the job of the run, nil if the run isn't a job
+func getJob(ctx context.Context) *job {
+	j, _ := ctx.Value(jobKey{}).(*job)
+	return j
+}
+
+//The run has the model lock
+func (j *job) start() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Status = JOB_RUNNING
+}
+
+//Record the number of input files to predict
+func (j *job) setTotal(total int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.FilesTotal = total
+}
+
+//Record an input file predicted or failed
+func (j *job) fileDone() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.FilesDone++
+}
+
+//Record the response of the run. The job is succeeded with a 200 response, else failed with the body as error
+func (j *job) finish(status int, body string, truncated bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.FinishedAt = &now
+	j.ResponseStatus = status
+	j.Response = body
+	j.ResponseTruncated = truncated
+	j.Status = JOB_SUCCEEDED
+	if status != http.StatusOK {
+		j.Status = JOB_FAILED
+		j.Error = strings.TrimSpace(body)
+	}
+}
+
+//Keep the log entry of the run. The oldest entries are dropped for keeping the logs within JOB_LOG_BYTES, an entry
+//larger than the limit isn't kept
+func (j *job) appendLog(entry []byte) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(entry) > jobLogBytes {
+		j.logsDropped++
+		return
+	}
+	for j.logsSize+len(entry) > jobLogBytes {
+		j.logsSize -= len(j.logs[0])
+		j.logs = j.logs[1:]
+		j.logsDropped++
+	}
+	j.logs = append(j.logs, append([]byte(nil), entry...))
+	j.logsSize += len(entry)
+}
+
+//Write the kept log entries, one JSON entry per line, and return the number of dropped ones
+func (j *job) writeLogs(w io.Writer) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, entry := range j.logs {
+		w.Write(entry)
+		w.Write([]byte{'\n'})
+	}
+	return j.logsDropped
+}
+
+func (j *job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Alias without the method, for not calling it again
+	type fields job
+	return json.Marshal((*fields)(j))
+}
+
+//Response of the run, recorded in memory for the job status. Only the first JOB_MAX_RESPONSE_BYTES of the body are
+//kept
+type jobResponse struct {
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *jobResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *jobResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	kept := b
+	if remaining := jobMaxResponseBytes - r.body.Len(); len(kept) > remaining {
+		kept = kept[:remaining]
+		r.truncated = true
+	}
+	r.body.Write(kept)
+	return len(b), nil
+}
+
+func (r *jobResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+//Start a LoadAndPredict run in the background, with the same params, and return its job id with a 202. The params
+//are checked before, an invalid one fails with a 400 like LoadAndPredict
+func CreateJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	r, err := withRunBody(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	ctx = r.Context()
+	if _, err := getModelParam(r); err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	input, _, err := getInputParams(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if _, err := getOutputLocations(r, input); err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if _, err := getPredictionOptions(r); err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating the job id")
+		return
+	}
+	j := &job{ID: hex.EncodeToString(b), Status: JOB_PENDING, CreatedAt: time.Now()}
+
+	// The run outlives the request, it keeps only its log fields and its forwarded headers
+	runCtx := context.WithValue(detachedContext(ctx), forwardedHeadersKey{}, ctx.Value(forwardedHeadersKey{}))
+	runCtx = context.WithValue(runCtx, jobKey{}, j)
+	queued := &queuedJob{job: j, run: r.Clone(runCtx)}
+
+	jobs.workers.Do(startJobWorkers)
+	jobs.Lock()
+	for id, old := range jobs.byID {
+		old.mu.Lock()
+		expired := old.FinishedAt != nil && time.Since(*old.FinishedAt) > JOB_RETENTION
+		old.mu.Unlock()
+		if expired {
+			delete(jobs.byID, id)
+		}
+	}
+	select {
+	case jobs.queue <- queued:
+		jobs.byID[j.ID] = j
+		jobs.running.Add(1)
+		jobsQueued.Inc()
+	default:
+		jobs.Unlock()
+		logWarningf(ctx, "%d jobs in the queue, limit set by JOB_QUEUE_SIZE, job rejected", jobQueueSize)
+		w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_SECONDS))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, "too many jobs in the queue, retry later")
+		return
+	}
+	jobs.Unlock()
+
+	logInfof(ctx, "job %s created", j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j)
+}
+
+//Start the JOB_CONCURRENCY workers, which run the queued jobs one after the other
+func startJobWorkers() {
+	for i := 0; i < jobConcurrency; i++ {
+		go func() {
+			for queued := range jobs.queue {
+				jobsQueued.Dec()
+				runJob(queued.job, queued.run)
+			}
+		}()
+	}
+}
+
+//Run the job. Its run holds a request slot, the requests and the running jobs are limited together by
+//MAX_CONCURRENT_REQUESTS
+func runJob(j *job, run *http.Request) {
+	defer jobs.running.Done()
+	ctx := run.Context()
+	waitRequestSlot()
+	defer releaseRequestSlot()
+	jobsRunning.Inc()
+	defer jobsRunning.Dec()
+
+	response := &jobResponse{header: http.Header{}}
+	// The panic of a run fails its job, instead of the server
+	recoverHandler(http.HandlerFunc(LoadAndPredict)).ServeHTTP(response, run)
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	j.finish(response.status, response.body.String(), response.truncated)
+	logInfof(ctx, "job %s %s", j.ID, j.Status)
+}
+
+//Return the status of the job: its state, the number of input files predicted on the total, and the error or the
+//response of the run once completed
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobs.Lock()
+	j, ok := jobs.byID[id]
+	jobs.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "job %s not found\n", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(j)
+}
+
+//Return the log entries of the job run kept in memory, the last JOB_LOG_BYTES, as JSON lines. The number of dropped
+//older entries is returned in the X-Dropped-Entries header
+func GetJobLogs(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobs.Lock()
+	j, ok := jobs.byID[id]
+	jobs.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "job %s not found\n", id)
+		return
+	}
+	logs := &bytes.Buffer{}
+	dropped := j.writeLogs(logs)
+	w.Header().Set("Content-Type", NDJSON_CONTENT_TYPE)
+	w.Header().Set("X-Dropped-Entries", strconv.Itoa(dropped))
+	w.WriteHeader(http.StatusOK)
+	logs.WriteTo(w)
+}
+
+//Wait the running jobs, until the context is done
+func waitJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jobs.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	//Suffix of the temporary files of the uploads in progress, skipped by the listings
+	LOCAL_TEMP_SUFFIX = ".uploading"
+)
+
+var (
+	//Accept the local filesystem locations, for the local development and the air-gapped deployments. Disabled by
+	//default, the requests could read and write any file of the container
+	localStorage = getEnvBool("LOCAL_STORAGE", false)
+)
+
+//Local filesystem, for the file:// locations. The object names are the absolute file paths without the leading "/".
+//The object generations aren't supported
+type localStore struct{}
+
+func (s *localStore) Location(name string) string {
+	return SCHEME_FILE + ":///" + name
+}
+
+//The files under the directory of the prefix are walked. A missing directory is an empty listing, like a bucket.
+//Only the subdirectories which can contain names with the prefix are walked, not the whole filesystem for a prefix
+//at the root
+func (s *localStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var ret []objectInfo
+	root := "/" + prefix[:strings.LastIndex(prefix, "/")+1]
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name := strings.TrimPrefix(path, "/")
+		if info.IsDir() && path != root && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && strings.HasPrefix(name, prefix) && !isLocalTempFile(info.Name()) {
+			ret = append(ret, objectInfo{Name: name, Size: info.Size(), Version: strconv.FormatInt(info.ModTime().UnixNano(), 10)})
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *localStore) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir("/" + prefix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []string
+	for _, info := range infos {
+		if info.IsDir() {
+			ret = append(ret, prefix+info.Name()+"/")
+		}
+	}
+	return ret, nil
+}
+
+func (s *localStore) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	if generation != 0 {
+		return nil, errors.New("object generations are only supported on GCS")
+	}
+	f, err := os.Open("/" + name)
+	if os.IsNotExist(err) {
+		return nil, &notFoundError{message: fmt.Sprintf("object %s not found", s.Location(name))}
+	}
+	return f, err
+}
+
+//The content is written in a temporary file of the same directory, renamed to the file name on close. The files have
+//no content type or encoding, they are ignored
+func (s *localStore) Upload(ctx context.Context, name string, contentType string, contentEncoding string, metadata map[string]string) io.WriteCloser {
+	w := &localWriter{ctx: ctx, name: "/" + name}
+	dir := filepath.Dir(w.name)
+	if w.err = os.MkdirAll(dir, 0755); w.err == nil {
+		w.file, w.err = ioutil.TempFile(dir, "."+filepath.Base(w.name)+LOCAL_TEMP_SUFFIX)
+	}
+	return w
+}
+
+func (s *localStore) Delete(ctx context.Context, name string) error {
+	if err := os.Remove("/" + name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//Temporary file of an upload in progress
+func isLocalTempFile(fileName string) bool {
+	return strings.HasPrefix(fileName, ".") && strings.Contains(fileName, LOCAL_TEMP_SUFFIX)
+}
+
+//Writer of a local file. The file only exists once the writer is closed without error
+type localWriter struct {
+	ctx  context.Context
+	name string
+	file *os.File
+	//Error of the temporary file creation, returned by the writes and the close
+	err error
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.file.Write(p)
+}
+
+//The file is renamed only if the context isn't canceled, else the upload is aborted
+func (w *localWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.file.Close()
+	if err == nil {
+		err = w.ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.name)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+	}
+	return err
+}
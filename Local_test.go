@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalStoreList(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "embedded-tf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scratch)
+	for _, name := range []string{"a.jsonl", "a.jsonl.gz", "ab/x.jsonl", "b/y.jsonl", "b/a.jsonl", ".a.jsonl-1" + LOCAL_TEMP_SUFFIX} {
+		if err = os.MkdirAll(filepath.Dir(filepath.Join(scratch, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(scratch, name), []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := strings.TrimPrefix(scratch, "/") + "/"
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: root + "a", want: []string{"a.jsonl", "a.jsonl.gz", "ab/x.jsonl"}},
+		{prefix: root + "a.jsonl", want: []string{"a.jsonl", "a.jsonl.gz"}},
+		{prefix: root + "b/", want: []string{"b/a.jsonl", "b/y.jsonl"}},
+		{prefix: root, want: []string{"a.jsonl", "a.jsonl.gz", "ab/x.jsonl", "b/a.jsonl", "b/y.jsonl"}},
+		{prefix: root + "c/"},
+		// At the root of the filesystem, only the matching entries are walked
+		{prefix: "embedded-tf-missing"},
+	}
+	for _, test := range tests {
+		list, err := (&localStore{}).List(context.Background(), test.prefix)
+		if err != nil {
+			t.Errorf("%s: %s", test.prefix, err)
+			continue
+		}
+		var got []string
+		for _, info := range list {
+			got = append(got, strings.TrimPrefix(info.Name, root))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %v, %v expected", test.prefix, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Severities of the log entries, as named by Cloud Logging, from the most verbose
+const (
+	LOG_DEBUG   = "DEBUG"
+	LOG_INFO    = "INFO"
+	LOG_WARNING = "WARNING"
+	LOG_ERROR   = "ERROR"
+)
+
+//Header of the request id, read from the request and set in the response
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+//Rank of the severities, for filtering the entries below LOG_LEVEL
+var logSeverities = map[string]int{LOG_DEBUG: 0, LOG_INFO: 1, LOG_WARNING: 2, LOG_ERROR: 3}
+
+//Min severity of the written log entries. INFO by default, set by the LOG_LEVEL environment variable
+var logLevel = getLogLevel(getEnvString("LOG_LEVEL", LOG_INFO))
+
+func getLogLevel(value string) string {
+	level := strings.ToUpper(value)
+	if _, ok := logSeverities[level]; !ok {
+		recordEnv("LOG_LEVEL", value, errors.New(fmt.Sprintf("must be %s, %s, %s or %s", LOG_DEBUG, LOG_INFO, LOG_WARNING, LOG_ERROR)))
+		return LOG_INFO
+	}
+	return level
+}
+
+//Log entry, one JSON object per line, with the fields recognized by Cloud Logging. The request fields are empty
+//outside of a request
+type logEntry struct {
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+	Time      string `json:"time"`
+	RequestID string `json:"request_id,omitempty"`
+	Model     string `json:"model,omitempty"`
+	Input     string `json:"input,omitempty"`
+}
+
+//Fields of the request added to its log entries
+type logFields struct {
+	RequestID string
+	Model     string
+	Input     string
+}
+
+type logFieldsKey struct{}
+
+//Entries written by line, the concurrent requests don't mix their entries
+var logMutex sync.Mutex
+
+//Wrap the handler for adding the request fields to the log entries: the request id, from the X-Request-Id or the
+//Cloud Run trace header, else a random one, and the model and input params. The request id is returned in the
+//X-Request-Id header of the response
+func logHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := logFields{
+			RequestID: getRequestID(r),
+			Model:     r.URL.Query().Get("model"),
+			Input:     r.URL.Query().Get("input"),
+		}
+		w.Header().Set(REQUEST_ID_HEADER, fields.RequestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logFieldsKey{}, fields)))
+	})
+}
+
+//Context of a work which outlives the request, without its cancellation nor its deadline. Only the log fields are
+//kept
+func detachedContext(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), logFieldsKey{}, ctx.Value(logFieldsKey{}))
+}
+
+func getRequestID(r *http.Request) string {
+	if id := r.Header.Get(REQUEST_ID_HEADER); id != "" {
+		return id
+	}
+	// TRACE_ID/SPAN_ID;o=TRACE_TRUE
+	if trace := r.Header.Get("X-Cloud-Trace-Context"); trace != "" {
+		return strings.SplitN(trace, "/", 2)[0]
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//Write the log entry if its severity reaches LOG_LEVEL. The request fields are taken from the context
+func logf(ctx context.Context, severity string, format string, args ...interface{}) {
+	if logSeverities[severity] < logSeverities[logLevel] {
+		return
+	}
+	entry := logEntry{
+		Severity: severity,
+		Message:  strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"),
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if fields, ok := ctx.Value(logFieldsKey{}).(logFields); ok {
+		entry.RequestID = fields.RequestID
+		entry.Model = fields.Model
+		entry.Input = fields.Input
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"severity":"%s","message":"unloggable entry: %s"}`, LOG_ERROR, err))
+	}
+
+	// The entries of a job run are also kept for GET /jobs/{id}/logs
+	getJob(ctx).appendLog(b)
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	os.Stderr.Write(append(b, '\n'))
+}
+
+func logDebugf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LOG_DEBUG, format, args...)
+}
+
+func logInfof(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LOG_INFO, format, args...)
+}
+
+func logWarningf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LOG_WARNING, format, args...)
+}
+
+func logErrorf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LOG_ERROR, format, args...)
+}
+
+//Log the error of the request, at the ERROR severity
+func logError(ctx context.Context, err error) {
+	logf(ctx, LOG_ERROR, "%s", err)
+}
+
+//Log the error and exit, for the startup failures
+func logFatal(err error) {
+	logf(context.Background(), LOG_ERROR, "%s", err)
+	os.Exit(1)
+}
+
+//Writer of the standard logger, used by the libraries like net/http, for writing their messages as INFO entries
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logf(context.Background(), LOG_INFO, "%s", p)
+	return len(p), nil
+}
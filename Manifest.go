@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	//Name of the manifest object written in the output path
+	MANIFEST_NAME = "_manifest.json"
+	//Name of the errors report written in the output path when the run continues on error
+	ERRORS_NAME = "_errors.json"
+)
+
+//Record of a prediction run, for tracking the lineage of the predictions
+type runManifest struct {
+	Model     string            `json:"model"`
+	Input     string            `json:"input"`
+	Output    string            `json:"output"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	StartTime time.Time         `json:"start_time"`
+	EndTime   time.Time         `json:"end_time"`
+	//Number of predicted instances and size of the processed input files
+	Instances  int64          `json:"instances"`
+	InputBytes int64          `json:"input_bytes"`
+	Files      []manifestFile `json:"files"`
+	//Input files skipped on error, with continue_on_error
+	Failed []failedInput `json:"failed,omitempty"`
+	//Input files skipped because their output already exists, with skip_existing
+	Skipped []string `json:"skipped,omitempty"`
+	//Cumulated time of the output commits, not written in the manifest
+	uploadTime time.Duration
+}
+
+//Input file which failed during a run continued on error. Its predictions aren't in the outputs
+type failedInput struct {
+	Input      string `json:"input"`
+	Generation int64  `json:"generation,omitempty"`
+	Error      string `json:"error"`
+}
+
+//Input file processed during the run and the output object which contains its predictions
+type manifestFile struct {
+	Input string `json:"input"`
+	//Generation of the input object, when pinned by an input manifest
+	Generation int64  `json:"generation,omitempty"`
+	Output     string `json:"output"`
+	//Prediction requests sent for the input file, recorded with manifest_details
+	Requests []manifestRequest `json:"requests,omitempty"`
+	//Instances rejected by the serving backend, recorded with error_records. Written in the error records, not in
+	//the manifest
+	rejected []rejectedInstance
+}
+
+//Prediction request sent to the serving backend
+type manifestRequest struct {
+	URL string `json:"url"`
+	//HTTP status of the response, 200 for a successful gRPC call. 0 if there is no response
+	Status       int `json:"status"`
+	RequestBytes int `json:"request_bytes"`
+	//Number of predictions received. 0 if the response is in error
+	Predictions int `json:"predictions"`
+	//Attempts of the request, the retries of the transient failures included, in their order
+	Attempts []manifestAttempt `json:"attempts,omitempty"`
+	//Successful serving response, compacted on one line. Only kept for the raw output format
+	response []byte
+}
+
+//Attempt of a prediction request and its outcome
+type manifestAttempt struct {
+	//HTTP status of the response, 200 for a successful gRPC call. 0 if there is no response
+	Status int `json:"status"`
+	//Error of the failed attempt, empty for a 200
+	Error string `json:"error,omitempty"`
+}
+
+//Record the attempt in the list, if not nil. An attempt without error but with another status than 200 is failed
+func recordAttempt(attempts *[]manifestAttempt, status int, err error) {
+	if attempts == nil {
+		return
+	}
+	attempt := manifestAttempt{Status: status}
+	if err != nil {
+		attempt.Error = err.Error()
+	} else if status != http.StatusOK {
+		attempt.Error = fmt.Sprintf("serving response status %d", status)
+	}
+	*attempts = append(*attempts, attempt)
+}
+
+//Get the trace which records the prediction requests of the file. Nil without manifest_details
+func (f *manifestFile) trace(opts *predictionOptions) *[]manifestRequest {
+	if !opts.ManifestDetails {
+		return nil
+	}
+	return &f.Requests
+}
+
+//Get the list which records the rejected instances of the file. Nil without error_records
+func (f *manifestFile) errorRecords(opts *predictionOptions) *[]rejectedInstance {
+	if !opts.ErrorRecords {
+		return nil
+	}
+	return &f.rejected
+}
+
+//Write the manifest in the output path. The custom metadata of the outputs is also set on the manifest object
+func writeManifest(ctx context.Context, store ObjectStore, outputPath string, manifest *runManifest, opts *predictionOptions) error {
+	return writeJSON(ctx, store, outputPath, MANIFEST_NAME, manifest, opts)
+}
+
+//Write the errors report, with the list of the failed input files, in the output path. The list is empty if no input
+//file failed
+func writeErrors(ctx context.Context, store ObjectStore, outputPath string, failed []failedInput, opts *predictionOptions) error {
+	report := struct {
+		Errors []failedInput `json:"errors"`
+	}{Errors: failed}
+	if report.Errors == nil {
+		report.Errors = []failedInput{}
+	}
+	return writeJSON(ctx, store, outputPath, ERRORS_NAME, report, opts)
+}
+
+//Write the value as an indented JSON object of the output path, with the custom metadata of the outputs
+func writeJSON(ctx context.Context, store ObjectStore, outputPath string, name string, v interface{}, opts *predictionOptions) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(outputPath, "/") {
+		outputPath += "/"
+	}
+
+	w := store.Upload(ctx, outputPath+name, "application/json", "", objectMetadata(opts))
+	if _, err = w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
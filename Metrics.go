@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Timeout of the POST of the run metrics to the webhook
+const METRICS_WEBHOOK_TIMEOUT = 5 * time.Second
+
+//URL which receives the metrics of each run. None if empty
+var metricsWebhook = getEnvString("METRICS_WEBHOOK", "")
+
+//Posts of the metrics in progress, waited on shutdown
+var pendingMetrics sync.WaitGroup
+
+//Summary of a run, posted in JSON to the metrics webhook
+type runMetrics struct {
+	Model  string `json:"model"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	//HTTP status of the response, and true if the run succeeded
+	Status  int  `json:"status"`
+	Success bool `json:"success"`
+	//Number of processed input files, of predicted instances and of uploaded output objects
+	Files     int   `json:"files"`
+	Instances int64 `json:"instances"`
+	Outputs   int   `json:"outputs"`
+	//Size of the processed input files
+	InputBytes int64 `json:"input_bytes"`
+	//Duration of the model download and the Tensorflow start, of the predictions and of the whole run
+	ModelLoadSeconds  float64 `json:"model_load_seconds"`
+	PredictionSeconds float64 `json:"prediction_seconds"`
+	TotalSeconds      float64 `json:"total_seconds"`
+	//Breakdown of the model load, both 0 when the loaded model is reused, and time spent in the output uploads,
+	//included in the predictions
+	ModelDownloadSeconds float64 `json:"model_download_seconds"`
+	TFStartupSeconds     float64 `json:"tf_startup_seconds"`
+	UploadSeconds        float64 `json:"upload_seconds"`
+	//The model was restored from the model cache instead of being downloaded
+	ModelCacheHit bool `json:"model_cache_hit"`
+}
+
+//JSON response of a successful run, with the latency breakdown of the run
+type runSummary struct {
+	ModelDownloadSeconds float64 `json:"model_download_seconds"`
+	TFStartupSeconds     float64 `json:"tf_startup_seconds"`
+	PredictionSeconds    float64 `json:"prediction_seconds"`
+	UploadSeconds        float64 `json:"upload_seconds"`
+	TotalSeconds         float64 `json:"total_seconds"`
+	Files                int     `json:"files"`
+	Instances            int64   `json:"instances"`
+	//Input files failed with continue_on_error, listed in the errors report, and skipped with skip_existing
+	FailedFiles  int `json:"failed_files,omitempty"`
+	SkippedFiles int `json:"skipped_files,omitempty"`
+	//Number of outputs uploaded, per output location
+	Outputs map[string]int `json:"outputs"`
+	//Local directory of the model files, with keep_scratch
+	ScratchPath string `json:"scratch_path,omitempty"`
+}
+
+//Response writer which records the HTTP status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+//Post the metrics to the webhook in the background, the response of the run doesn't wait it. The post isn't
+//cancelled with the request, it has its own timeout
+func sendMetricsAsync(ctx context.Context, metrics runMetrics) {
+	if metricsWebhook == "" {
+		return
+	}
+	ctx = detachedContext(ctx)
+	pendingMetrics.Add(1)
+	go func() {
+		defer pendingMetrics.Done()
+		sendMetrics(ctx, &metrics)
+	}()
+}
+
+//Wait the posts of the metrics in progress, until the context is done
+func waitMetrics(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pendingMetrics.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Post the metrics to the webhook, up to METRICS_WEBHOOK_TIMEOUT. Best effort, the errors are only logged
+func sendMetrics(ctx context.Context, metrics *runMetrics) {
+	if metricsWebhook == "" {
+		return
+	}
+	b, err := json.Marshal(metrics)
+	if err != nil {
+		logWarningf(ctx, "metrics not sent: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, METRICS_WEBHOOK_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metricsWebhook, bytes.NewReader(b))
+	if err != nil {
+		logWarningf(ctx, "metrics not sent: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = errors.New(fmt.Sprintf("webhook returned %s", resp.Status))
+		}
+	}
+	if err != nil {
+		logWarningf(ctx, "metrics not sent: %s", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Keep the model loaded and the Tensorflow server running between the requests. Enabled with PERSISTENT_MODEL=true
+var persistentModel = getEnvBool("PERSISTENT_MODEL", false)
+
+//Model downloaded on the local disk and served by the Tensorflow server. The mutex is held during the whole request
+//for not changing the model directory and the server while they are used
+type loadedModel struct {
+	mu sync.Mutex
+	//Guard of the fields, read by the readiness checks while a request holds mu
+	state sync.Mutex
+	//Storage location of the loaded model
+	key string
+	tf  *tfServer
+}
+
+//Model kept between the requests in persistent mode
+var currentModel = &loadedModel{}
+
+//Return true if the model of the storage location is loaded and its server is still running
+func (m *loadedModel) isLoaded(key string) bool {
+	tf, loadedKey := m.get()
+	return tf != nil && loadedKey == key && tf.isRunning()
+}
+
+//Get the server and the storage location of the loaded model. Nil if no model is loaded
+func (m *loadedModel) get() (*tfServer, string) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	return m.tf, m.key
+}
+
+//Keep the started server of the model for the next requests
+func (m *loadedModel) set(key string, tf *tfServer) {
+	m.state.Lock()
+	defer m.state.Unlock()
+	m.key = key
+	m.tf = tf
+}
+
+//Stop the server of the loaded model, if any. The local model files are deleted by the caller
+func (m *loadedModel) unload() {
+	tf, _ := m.get()
+	if tf != nil {
+		tf.stop()
+	}
+	m.set("", nil)
+}
+
+var (
+	//Budget, in bytes, of the downloaded models kept on the local disk for the next requests on the same model. 0
+	//disables the model cache
+	modelCacheBytes = int64(getEnvInt("MODEL_CACHE_BYTES", 0))
+	//Directory of the cached models
+	modelCacheDir = scratchDir + "/model-cache/"
+)
+
+//Downloaded model kept in the model cache
+type cachedModel struct {
+	//Storage location of the model, and the fingerprint of its objects at the download
+	key         string
+	fingerprint string
+	//Directory of the model in the cache, and its size
+	dir  string
+	size int64
+	//Served path of the model, relative to the local model directory
+	servedPath string
+}
+
+//Downloaded models kept on the local disk, least recently used first, within MODEL_CACHE_BYTES. The complete model of
+//the local model directory is moved in the cache when it's replaced, and moved back on a hit, without copy
+type modelDiskCache struct {
+	mu      sync.Mutex
+	entries []*cachedModel
+	size    int64
+	//Storage location, fingerprint and served path of the complete model of the local model directory. Empty if none
+	localKey         string
+	localFingerprint string
+	localServedPath  string
+	//Sequence of the cache directories
+	seq int
+}
+
+//Model cache of the requests
+var modelCache = &modelDiskCache{}
+
+//Record the model of the local model directory, downloaded and started, for caching it when it's replaced. The
+//fingerprint is the one of the model objects listed before the download
+func (c *modelDiskCache) setLocal(key string, fingerprint string, servedPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.localKey = key
+	c.localFingerprint = fingerprint
+	c.localServedPath = servedPath
+}
+
+//Clear the local model directory. Its complete model is moved in the cache, and the least recently used models are
+//evicted for keeping the cache within the budget. A model larger than the budget, or a partial one, is deleted
+func (c *modelDiskCache) clearLocal(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, fingerprint, servedPath := c.localKey, c.localFingerprint, c.localServedPath
+	c.localKey, c.localFingerprint, c.localServedPath = "", "", ""
+	if modelCacheBytes <= 0 || key == "" || fingerprint == "" {
+		os.RemoveAll(localModelPath)
+		return
+	}
+	size, err := dirSize(localModelPath)
+	if err != nil || size > modelCacheBytes {
+		logInfof(ctx, "model %s not cached, larger than the %d bytes of MODEL_CACHE_BYTES or unreadable", key, modelCacheBytes)
+		os.RemoveAll(localModelPath)
+		return
+	}
+	for c.size+size > modelCacheBytes && len(c.entries) > 0 {
+		evicted := c.entries[0]
+		c.entries = c.entries[1:]
+		c.size -= evicted.size
+		os.RemoveAll(evicted.dir)
+		logInfof(ctx, "model %s evicted from the model cache", evicted.key)
+	}
+	if c.seq == 0 {
+		// Left by a previous process of the container
+		os.RemoveAll(modelCacheDir)
+	}
+	c.seq++
+	dir := fmt.Sprintf("%s%d/", modelCacheDir, c.seq)
+	if err = os.MkdirAll(modelCacheDir, 0755); err == nil {
+		err = os.Rename(strings.TrimSuffix(localModelPath, "/"), strings.TrimSuffix(dir, "/"))
+	}
+	if err != nil {
+		logWarningf(ctx, "model %s not cached: %s", key, err)
+		os.RemoveAll(localModelPath)
+		return
+	}
+	c.entries = append(c.entries, &cachedModel{key: key, fingerprint: fingerprint, dir: dir, size: size, servedPath: servedPath})
+	c.size += size
+	logInfof(ctx, "model %s kept in the model cache, %d model(s) and %d bytes cached", key, len(c.entries), c.size)
+}
+
+//Move the cached model of the storage location back in the local model directory, which must be cleared. The served
+//path of the model is returned, and false if the model isn't cached. A cached model with another fingerprint, the
+//model objects written again since its download, is deleted and is a miss
+func (c *modelDiskCache) restore(ctx context.Context, key string, fingerprint string) (string, bool) {
+	if modelCacheBytes <= 0 {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.entries {
+		if e.key != key {
+			continue
+		}
+		c.entries = append(c.entries[:i], c.entries[i+1:]...)
+		c.size -= e.size
+		if e.fingerprint != fingerprint {
+			logInfof(ctx, "model %s changed in the storage since it was cached, downloaded again", key)
+			os.RemoveAll(e.dir)
+			break
+		}
+		os.RemoveAll(localModelPath)
+		if err := os.Rename(strings.TrimSuffix(e.dir, "/"), strings.TrimSuffix(localModelPath, "/")); err != nil {
+			logWarningf(ctx, "model %s not restored from the model cache, downloaded again: %s", key, err)
+			os.RemoveAll(e.dir)
+			break
+		}
+		modelCacheHits.Inc()
+		return e.servedPath, true
+	}
+	modelCacheMisses.Inc()
+	return "", false
+}
+
+//Fingerprint of the model objects of the storage path, from their names, sizes, versions and checksums. The model
+//written again at the same path has another fingerprint. Empty without object
+func modelFingerprint(ctx context.Context, store ObjectStore, path string) (string, error) {
+	objects, err := store.List(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if len(objects) == 0 {
+		return "", nil
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	h := sha256.New()
+	for _, o := range objects {
+		fmt.Fprintf(h, "%s\x00%d\x00%s\x00%t%08x\x00%x\n", o.Name, o.Size, o.Version, o.Checksums.HasCRC32C, o.Checksums.CRC32C, o.Checksums.MD5)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//Size of the regular files of the local directory. The links, like the linked versions, aren't followed
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
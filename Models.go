@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//List the SavedModels directly under the prefix of the bucket param, as a JSON array of their locations. A
+//subdirectory is a SavedModel if it contains a saved_model.pb object. The versioned layouts aren't detected
+func ListModels(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	location, err := getParam(r, "bucket")
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if location.Path != "" && !strings.HasSuffix(location.Path, "/") {
+		location.Path += "/"
+	}
+
+	store, err := newStoreProvider().Store(ctx, location, modelProject)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+	dirs, err := store.ListDirs(ctx, location.Path)
+	if err != nil {
+		logError(ctx, err)
+		if writeCancelled(ctx, w) {
+			return
+		}
+		if _, ok := err.(*notFoundError); ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when listing the model directories")
+		return
+	}
+
+	models := []string{}
+	for _, dir := range dirs {
+		objects, err := store.List(ctx, dir+SAVED_MODEL_FILE)
+		if err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error when listing the model directory %s\n", store.Location(dir))
+			return
+		}
+		for _, o := range objects {
+			if o.Name == dir+SAVED_MODEL_FILE {
+				models = append(models, store.Location(dir))
+				break
+			}
+		}
+	}
+
+	logInfof(ctx, "%d model(s) found in %s", len(models), store.Location(location.Path))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models)
+}
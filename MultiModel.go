@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+var (
+	//Models served together by one Tensorflow server, started at startup: a comma separated list of name=location
+	modelConfig = getEnvString("MODEL_CONFIG", "")
+	//Storage location of a JSON object of the served model names and their location, instead of MODEL_CONFIG
+	modelConfigFile = getEnvString("MODEL_CONFIG_FILE", "")
+)
+
+//Storage locations of the served models, by name. Empty without model config, each request loads its model
+var servedModels = map[string]string{}
+
+//Server of the served models, started at startup and running until the shutdown
+var servedServer *tfServer
+
+//Read the served models from MODEL_CONFIG or MODEL_CONFIG_FILE. None if both are empty
+func readModelConfig(ctx context.Context) (map[string]storeLocation, error) {
+	locations := map[string]string{}
+	switch {
+	case modelConfig != "" && modelConfigFile != "":
+		return nil, errors.New("MODEL_CONFIG and MODEL_CONFIG_FILE can't be both set")
+	case modelConfig != "":
+		for _, kv := range strings.Split(modelConfig, ",") {
+			if strings.TrimSpace(kv) == "" {
+				continue
+			}
+			s := strings.SplitN(kv, "=", 2)
+			if len(s) != 2 {
+				return nil, errors.New(fmt.Sprintf("invalid MODEL_CONFIG entry '%s', must be name=location", kv))
+			}
+			locations[strings.TrimSpace(s[0])] = strings.TrimSpace(s[1])
+		}
+	case modelConfigFile != "":
+		location, err := extractLocation(modelConfigFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("MODEL_CONFIG_FILE bad formatted: %s", err))
+		}
+		store, err := newStoreProvider().Store(ctx, location, modelProject)
+		if err != nil {
+			return nil, err
+		}
+		r, err := store.Download(ctx, location.Path, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, &locations); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid MODEL_CONFIG_FILE %s, must be a JSON object of the model names and locations: %s", modelConfigFile, err))
+		}
+	}
+
+	models := map[string]storeLocation{}
+	for name, l := range locations {
+		if !validModelName.MatchString(name) {
+			return nil, errors.New(fmt.Sprintf("invalid served model name '%s', only letters, digits, '_', '-' and '.' are allowed", name))
+		}
+		location, err := extractLocation(l)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("location of the served model %s bad formatted: %s", name, err))
+		}
+		if !strings.HasSuffix(location.Path, "/") && !isModelArchive(location.Path) {
+			location.Path += "/"
+		}
+		models[name] = location
+	}
+	return models, nil
+}
+
+//Download the served models, each one under its name in the local model directory, write their config and start the
+//Tensorflow server on all of them
+func startServedModels(ctx context.Context, models map[string]storeLocation) error {
+	tf, ok := predictor.(*tfPredictor)
+	if !ok || tf.layout != MODEL_LAYOUT_FLAT {
+		return errors.New(fmt.Sprintf("the served models require the '%s' backend and the '%s' model layout", BACKEND_TENSORFLOW, MODEL_LAYOUT_FLAT))
+	}
+	clients := newStoreProvider()
+	served := map[string]string{}
+	config := "model_config_list {\n"
+	for _, name := range sortedNames(models) {
+		store, err := clients.Store(ctx, models[name], modelProject)
+		if err != nil {
+			return err
+		}
+		path := localModelPath + name + "/" + MODEL_DUMMY_VERSION
+		if err = downloadModel(ctx, store, models[name].Path, path); err != nil {
+			return errors.New(fmt.Sprintf("served model %s: %s", name, err))
+		}
+		versioned, err := arrangeVersions(path)
+		if err != nil {
+			return errors.New(fmt.Sprintf("served model %s: %s", name, err))
+		}
+		if versioned {
+			err = validateVersions(localModelPath + name + "/")
+		} else {
+			err = predictor.ValidateModel(path)
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("served model %s invalid: %s", name, err))
+		}
+		config += fmt.Sprintf("  config {\n    name: \"%s\"\n    base_path: \"%s\"\n    model_platform: \"tensorflow\"\n  }\n", name, localModelPath+name)
+		served[name] = store.Location(models[name].Path)
+		logInfof(ctx, "served model %s loaded from %s", name, served[name])
+	}
+	config += "}\n"
+	if err := ioutil.WriteFile(modelConfigPath, []byte(config), 0644); err != nil {
+		return err
+	}
+
+	servedModels = served
+	server, err := startTFServer(ctx)
+	servedServer = server
+	if err != nil {
+		servedServer.stop()
+		return errors.New("error when starting tensorflow: " + err.Error())
+	}
+	logInfof(ctx, "models %s served", strings.Join(tfModelNames(), ", "))
+	return nil
+}
+
+//Names of the models served by the Tensorflow server: the served models, else the model of the requests
+func tfModelNames() []string {
+	if len(servedModels) == 0 {
+		return []string{modelName}
+	}
+	var names []string
+	for name := range servedModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedNames(models map[string]storeLocation) []string {
+	var names []string
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
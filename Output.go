@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	//Pause before the second attempt of an output upload, doubled on each attempt
+	UPLOAD_BACKOFF = 500 * time.Millisecond
+	//Compression of the output objects with gzip, also their content encoding
+	OUTPUT_COMPRESSION_GZIP = "gzip"
+)
+
+//Returned by the commits once an upload failed, the run stops
+var errUploadFailed = errors.New("upload failed")
+
+//Destination of the output objects
+type outputDestination struct {
+	store ObjectStore
+	//Directory of the output objects in the bucket, ending by "/"
+	path string
+}
+
+//Storage location of the output object, or of the destination directory if the name is empty
+func (d *outputDestination) location(name string) string {
+	return d.store.Location(d.path + name)
+}
+
+//Output object committed in a destination
+type uploadedOutput struct {
+	destination *outputDestination
+	//Name relative to the destination directory
+	name string
+}
+
+//Output object being written. Nothing is created in the bucket until the commit
+type outputWriter interface {
+	io.Writer
+	//Upload the written content. The object exists only if the commit succeeds
+	commit() error
+	//Discard the written content. The object isn't created
+	abort()
+}
+
+//Open the output object. In streaming, the content is uploaded while it's written, else it's buffered in memory and
+//uploaded on commit
+func openOutput(ctx context.Context, store ObjectStore, name string, opts *predictionOptions) outputWriter {
+	if opts.StreamOutput {
+		return newStreamedOutput(ctx, store, name, opts)
+	}
+	return &bufferedOutput{ctx: ctx, store: store, name: name, opts: opts}
+}
+
+//Output object written in all the destinations at the same time, and in the inline writer if any. A failure in one
+//destination fails the output in all of them: the write stops, and the outputs not committed are aborted
+type multiOutput struct {
+	name         string
+	destinations []*outputDestination
+	outputs      []outputWriter
+	//Also returned in the response, nil if not
+	inline io.Writer
+	//Outputs committed, in the destinations order
+	committed []uploadedOutput
+}
+
+//Open the output object of the name, relative to the destination directories, in each destination
+func openOutputs(ctx context.Context, destinations []*outputDestination, name string, opts *predictionOptions, inline io.Writer) *multiOutput {
+	o := &multiOutput{name: name, destinations: destinations, inline: inline}
+	for _, d := range destinations {
+		o.outputs = append(o.outputs, openOutput(ctx, d.store, d.path+name, opts))
+	}
+	return o
+}
+
+//Write the content in each destination, then in the inline writer. The error names the failed destination
+func (o *multiOutput) Write(p []byte) (int, error) {
+	for i, output := range o.outputs {
+		if _, err := output.Write(p); err != nil {
+			return 0, errors.New(fmt.Sprintf("write of %s failed: %s", o.destinations[i].location(o.name), err))
+		}
+	}
+	if o.inline != nil {
+		if _, err := o.inline.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//Commit the output in each destination. On the first failure, the outputs not committed yet are aborted
+func (o *multiOutput) commit() error {
+	for i, output := range o.outputs {
+		if err := output.commit(); err != nil {
+			for _, other := range o.outputs[i+1:] {
+				other.abort()
+			}
+			return errors.New(fmt.Sprintf("upload of %s failed: %s", o.destinations[i].location(o.name), err))
+		}
+		o.committed = append(o.committed, uploadedOutput{destination: o.destinations[i], name: o.name})
+	}
+	return nil
+}
+
+func (o *multiOutput) abort() {
+	for _, output := range o.outputs {
+		output.abort()
+	}
+}
+
+//Custom metadata set on all the uploaded objects, a comma separated list of key=value pairs. None by default
+var outputMetadata = getEnvKeyValues("OUTPUT_METADATA")
+
+//Get the custom metadata of the uploaded objects: the OUTPUT_METADATA pairs and the labels of the run, which take
+//precedence on the same key. Nil if none
+func objectMetadata(opts *predictionOptions) map[string]string {
+	if len(outputMetadata) == 0 {
+		return opts.Labels
+	}
+	ret := map[string]string{}
+	for k, v := range outputMetadata {
+		ret[k] = v
+	}
+	for k, v := range opts.Labels {
+		ret[k] = v
+	}
+	return ret
+}
+
+//Create the writer of an output object, with the custom metadata and the content type of the output format. With
+//the gzip compression, the content is compressed while written and the object has the gzip content encoding
+func newObjectWriter(ctx context.Context, store ObjectStore, name string, opts *predictionOptions) io.WriteCloser {
+	contentType := getEncoder(opts.OutputFormat).ContentType()
+	if opts.OutputCompression != OUTPUT_COMPRESSION_GZIP {
+		return store.Upload(ctx, name, contentType, "", objectMetadata(opts))
+	}
+	w := store.Upload(ctx, name, contentType, OUTPUT_COMPRESSION_GZIP, objectMetadata(opts))
+	return &gzipObjectWriter{Writer: gzip.NewWriter(w), object: w}
+}
+
+//Object writer which compresses the content. The compressed stream is completed on close, before the object
+type gzipObjectWriter struct {
+	*gzip.Writer
+	object io.WriteCloser
+}
+
+func (w *gzipObjectWriter) Close() error {
+	err := w.Writer.Close()
+	if closeErr := w.object.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//Output fully kept in memory before the upload
+type bufferedOutput struct {
+	bytes.Buffer
+	ctx   context.Context
+	store ObjectStore
+	name  string
+	opts  *predictionOptions
+}
+
+//The upload is attempted up to UPLOAD_ATTEMPTS times, with an exponential backoff, the content being kept in memory
+func (o *bufferedOutput) commit() error {
+	backoff := UPLOAD_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := o.upload()
+		if err == nil || attempt >= uploadAttempts || o.ctx.Err() != nil {
+			return err
+		}
+		logWarningf(o.ctx, "upload of %s failed, attempt %d/%d: %s", o.name, attempt, uploadAttempts, err)
+		if err = sleepContext(o.ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+//The writer is always closed, for not leaking its connection or file. On a failed copy, the upload is canceled before
+//the close for not committing a partial output
+func (o *bufferedOutput) upload() (err error) {
+	ctx, span := startSpan(o.ctx, "output upload")
+	span.set("storage.location", o.store.Location(o.name))
+	span.set("bytes", o.Len())
+	defer func() {
+		span.fail(err)
+		span.end(ctx)
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := newObjectWriter(ctx, o.store, o.name, o.opts)
+	if _, err := io.Copy(w, bytes.NewReader(o.Bytes())); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (o *bufferedOutput) abort() {
+	o.Reset()
+}
+
+//Output uploaded at the same time it's written, through a pipe. The content isn't kept in memory.
+//The storage commits the object on the writer close: in case of abort, the upload is canceled before the close for not
+//committing a partial output
+type streamedOutput struct {
+	pw       *io.PipeWriter
+	cancel   context.CancelFunc
+	uploaded chan error
+}
+
+func newStreamedOutput(ctx context.Context, store ObjectStore, name string, opts *predictionOptions) *streamedOutput {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	o := &streamedOutput{pw: pw, cancel: cancel, uploaded: make(chan error, 1)}
+	go func() {
+		w := newObjectWriter(ctx, store, name, opts)
+		if _, err := io.Copy(w, pr); err != nil {
+			// Stop the writes and abort the upload
+			pr.CloseWithError(err)
+			cancel()
+			w.Close()
+			o.uploaded <- err
+			return
+		}
+		// The object is only committed here. Close error means no output object
+		o.uploaded <- w.Close()
+	}()
+	return o
+}
+
+func (o *streamedOutput) Write(p []byte) (int, error) {
+	return o.pw.Write(p)
+}
+
+func (o *streamedOutput) commit() error {
+	defer o.cancel()
+	o.pw.Close()
+	return <-o.uploaded
+}
+
+func (o *streamedOutput) abort() {
+	o.cancel()
+	o.pw.CloseWithError(context.Canceled)
+	<-o.uploaded
+}
+
+//Commits of the outputs in the background, at most size at the same time. A commit waits a free slot
+type uploadPool struct {
+	window  chan struct{}
+	running sync.WaitGroup
+	mu      sync.Mutex
+	uploads []*pendingUpload
+	//Cumulated duration of the commits
+	duration time.Duration
+}
+
+//Output committed by the pool, with the range [from, to) of the manifest files of its predictions
+type pendingUpload struct {
+	output   *multiOutput
+	from, to int
+	err      error
+}
+
+func newUploadPool(size int) *uploadPool {
+	if size < 1 {
+		size = 1
+	}
+	return &uploadPool{window: make(chan struct{}, size)}
+}
+
+func (p *uploadPool) commit(output *multiOutput, from int, to int) {
+	p.window <- struct{}{}
+	p.running.Add(1)
+	u := &pendingUpload{output: output, from: from, to: to}
+	go func() {
+		defer p.running.Done()
+		start := time.Now()
+		err := output.commit()
+		<-p.window
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		u.err = err
+		p.duration += time.Since(start)
+		p.uploads = append(p.uploads, u)
+	}()
+}
+
+//Return true if a completed commit failed
+func (p *uploadPool) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.uploads {
+		if u.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//Wait the commits in progress and return all the commits, in their completion order
+func (p *uploadPool) wait() []*pendingUpload {
+	p.running.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.uploads
+}
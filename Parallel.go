@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+//Predictions of the input files computed in parallel and written in the input order. The predictions completed out
+//of order are buffered until the previous ones are written. At most window files are predicted or buffered at the
+//same time
+type orderedPredictions struct {
+	results []chan *fileResult
+	window  chan struct{}
+	cancel  context.CancelFunc
+}
+
+//Encoded predictions of an input file
+type fileResult struct {
+	bytes.Buffer
+	//Number of predicted instances
+	instances int
+	err       error
+}
+
+//Start the predictions of the n input files. The predict function writes the encoded predictions of the input i and
+//returns the number of predicted instances. The delay paces the start of 2 predictions
+func newOrderedPredictions(ctx context.Context, n int, window int, delay time.Duration, predict func(ctx context.Context, i int, w io.Writer) (int, error)) *orderedPredictions {
+	ctx, cancel := context.WithCancel(ctx)
+	o := &orderedPredictions{
+		results: make([]chan *fileResult, n),
+		window:  make(chan struct{}, window),
+		cancel:  cancel,
+	}
+	for i := range o.results {
+		o.results[i] = make(chan *fileResult, 1)
+	}
+
+	go func() {
+		for i := 0; i < n; i++ {
+			err := ctx.Err()
+			if err == nil && i > 0 {
+				err = sleepContext(ctx, delay)
+			}
+			if err == nil {
+				select {
+				case o.window <- struct{}{}:
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
+			}
+			if err != nil {
+				// Stopped, the remaining inputs aren't predicted
+				for ; i < n; i++ {
+					o.results[i] <- &fileResult{err: err}
+				}
+				return
+			}
+			go func(i int) {
+				r := &fileResult{}
+				r.instances, r.err = predict(ctx, i, r)
+				if r.err != nil {
+					// Nothing to write, free the slot of the window
+					<-o.window
+				}
+				o.results[i] <- r
+			}(i)
+		}
+	}()
+	return o
+}
+
+//Wait the predictions of the input i and write them. Must be called in the input order. The number of predicted
+//instances is returned. Nothing is written on error
+func (o *orderedPredictions) writeNext(i int, w io.Writer) (int, error) {
+	r := <-o.results[i]
+	if r.err != nil {
+		return 0, r.err
+	}
+	// Free the slot of the window once written
+	defer func() { <-o.window }()
+	if _, err := io.Copy(w, r); err != nil {
+		return 0, err
+	}
+	return r.instances, nil
+}
+
+//Add to the error of the input i the errors of the next inputs already failed, for reporting all the failed files
+//of the window. The predictions in progress aren't waited
+func (o *orderedPredictions) aggregate(i int, inputs []filePath, err error) error {
+	failed := []string{fmt.Sprintf("%s%s: %s", inputs[i].RelativePath, inputs[i].FileName, err)}
+	for j := i + 1; j < len(o.results); j++ {
+		select {
+		case r := <-o.results[j]:
+			if r.err != nil && r.err != context.Canceled {
+				failed = append(failed, fmt.Sprintf("%s%s: %s", inputs[j].RelativePath, inputs[j].FileName, r.err))
+			}
+		default:
+		}
+	}
+	if len(failed) == 1 {
+		return err
+	}
+	return errors.New(fmt.Sprintf("%d input files failed:\n%s", len(failed), strings.Join(failed, "\n")))
+}
+
+//Stop starting new predictions. The predictions in progress are canceled
+func (o *orderedPredictions) stop() {
+	o.cancel()
+}
+
+//Sleep during the delay, or less if the context is done
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Number of predictions in progress, and the max reached
+type concurrencyCounter struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (c *concurrencyCounter) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+}
+
+func (c *concurrencyCounter) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current--
+}
+
+//The predictions which complete in the reverse order are written in the input order, at most window at the same time
+func TestOrderedPredictionsOrder(t *testing.T) {
+	const n, window = 16, 4
+	counter := &concurrencyCounter{}
+	ordered := newOrderedPredictions(context.Background(), n, window, 0, func(ctx context.Context, i int, w io.Writer) (int, error) {
+		counter.enter()
+		defer counter.leave()
+		// The first files of each window are the slowest
+		time.Sleep(time.Duration(window-i%window) * 5 * time.Millisecond)
+		fmt.Fprintf(w, "%d\n", i)
+		return i, nil
+	})
+	defer ordered.stop()
+
+	out := &bytes.Buffer{}
+	for i := 0; i < n; i++ {
+		instances, err := ordered.writeNext(i, out)
+		if err != nil || instances != i {
+			t.Fatalf("file %d: %d instances, %v", i, instances, err)
+		}
+	}
+	want := ""
+	for i := 0; i < n; i++ {
+		want += fmt.Sprintf("%d\n", i)
+	}
+	if out.String() != want {
+		t.Errorf("output %q, %q expected", out, want)
+	}
+	if counter.max > window || counter.max < 2 {
+		t.Errorf("%d predictions at the same time, between 2 and %d expected", counter.max, window)
+	}
+}
+
+//The completed predictions buffered behind a slow one count in the window, no new prediction starts until it's written
+func TestOrderedPredictionsWindow(t *testing.T) {
+	const n, window = 6, 2
+	release := make(chan struct{})
+	started := make(chan int, n)
+	ordered := newOrderedPredictions(context.Background(), n, window, 0, func(ctx context.Context, i int, w io.Writer) (int, error) {
+		started <- i
+		if i == 0 {
+			<-release
+		}
+		fmt.Fprintf(w, "%d\n", i)
+		return 1, nil
+	})
+	defer ordered.stop()
+
+	for i := 0; i < window; i++ {
+		<-started
+	}
+	select {
+	case i := <-started:
+		t.Fatalf("file %d started while the window is full", i)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	out := &bytes.Buffer{}
+	for i := 0; i < n; i++ {
+		if _, err := ordered.writeNext(i, out); err != nil {
+			t.Fatalf("file %d: %s", i, err)
+		}
+	}
+	if want := "0\n1\n2\n3\n4\n5\n"; out.String() != want {
+		t.Errorf("output %q, %q expected", out, want)
+	}
+}
+
+//A failed file writes nothing, the next failed files of the window are aggregated in its error, and the stop cancels
+//the remaining predictions
+func TestOrderedPredictionsErrors(t *testing.T) {
+	const n = 6
+	inputs := make([]filePath, n)
+	for i := range inputs {
+		inputs[i] = filePath{FileName: fmt.Sprintf("%d.jsonl", i)}
+	}
+	done := make(chan struct{}, n)
+	ordered := newOrderedPredictions(context.Background(), n, n, 0, func(ctx context.Context, i int, w io.Writer) (int, error) {
+		defer func() { done <- struct{}{} }()
+		if i == 1 || i == 3 {
+			fmt.Fprint(w, "partial")
+			return 0, errors.New(fmt.Sprintf("file %d failed", i))
+		}
+		fmt.Fprintf(w, "%d\n", i)
+		return 1, nil
+	})
+	defer ordered.stop()
+	for i := 0; i < n; i++ {
+		<-done
+	}
+
+	out := &bytes.Buffer{}
+	if _, err := ordered.writeNext(0, out); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ordered.writeNext(1, out)
+	if err == nil {
+		t.Fatalf("no error of the failed file")
+	}
+	if out.String() != "0\n" {
+		t.Errorf("output %q of the failed file", out)
+	}
+	err = ordered.aggregate(1, inputs, err)
+	if err == nil || !strings.Contains(err.Error(), "2 input files failed") || !strings.Contains(err.Error(), "1.jsonl: file 1 failed") ||
+		!strings.Contains(err.Error(), "3.jsonl: file 3 failed") {
+		t.Errorf("aggregated error %v", err)
+	}
+
+	// The stop cancels the predictions not yet started
+	blocked := make(chan struct{})
+	ordered = newOrderedPredictions(context.Background(), n, 1, 0, func(ctx context.Context, i int, w io.Writer) (int, error) {
+		if i == 0 {
+			close(blocked)
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+		return 1, nil
+	})
+	<-blocked
+	ordered.stop()
+	for i := 0; i < n; i++ {
+		if _, err := ordered.writeNext(i, out); err != context.Canceled {
+			t.Errorf("file %d after the stop: %v, canceled expected", i, err)
+		}
+	}
+}
+
+//The files predicted in parallel, completed out of order, are streamed in the input order in the aggregated output
+func TestLoadAndPredictConcurrencyOrder(t *testing.T) {
+	const n = 8
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	counter := &concurrencyCounter{}
+	_, restore := useStubTF(func(w http.ResponseWriter, r *http.Request) {
+		counter.enter()
+		defer counter.leave()
+		var request inputPredictions
+		json.NewDecoder(r.Body).Decode(&request)
+		x := request.Instances[0].(map[string]interface{})["x"].(float64)
+		// The first files are the slowest
+		time.Sleep(time.Duration(n-x) * 5 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{PREDICTIONS_KEY: []interface{}{x}})
+	})
+	defer restore()
+	input := stores.bucket(SCHEME_GCS, "in")
+	want := ""
+	for i := 0; i < n; i++ {
+		input.put(fmt.Sprintf("data/%d.jsonl", i), []byte(fmt.Sprintf("{\"x\":%d}\n", i)), "application/json")
+		want += fmt.Sprintf("%d\n", i)
+	}
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/&aggregate=true&stream_output=true&concurrency=4", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := string(stores.bucket(SCHEME_GCS, "out").get("p/" + DEFAULT_AGGREGATE_NAME + ".jsonl").data); got != want {
+		t.Errorf("aggregated output %q, %q expected", got, want)
+	}
+	if counter.max < 2 || counter.max > 4 {
+		t.Errorf("%d predictions at the same time, between 2 and 4 expected", counter.max)
+	}
+}
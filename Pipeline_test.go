@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Environment variable of the test binary started as a fake Tensorflow server: the URL of the stub which answers its
+//requests
+const FAKE_SERVING_ENV = "EMBEDDED_TF_FAKE_SERVING"
+
+//Request header set by the fake Tensorflow server with the versions it serves, as version=content of the graph file
+const SERVED_VERSIONS_HEADER = "X-Served-Versions"
+
+func TestMain(m *testing.M) {
+	if upstream := os.Getenv(FAKE_SERVING_ENV); upstream != "" {
+		os.Exit(runFakeServing(upstream, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+//Fake Tensorflow server process, started by the handlers with the Tensorflow flags. It checks the downloaded model,
+//like Tensorflow would, prints the start marker and forwards the REST API requests to the stub
+func runFakeServing(upstream string, args []string) int {
+	flags := flag.NewFlagSet("tensorflow_model_server", flag.ContinueOnError)
+	port := flags.String("rest_api_port", "", "")
+	basePath := flags.String("model_base_path", "", "")
+	// The other Tensorflow flags are ignored
+	flags.String("port", "", "")
+	flags.String("model_name", "", "")
+	flags.String("tensorflow_intra_op_parallelism", "", "")
+	flags.String("tensorflow_inter_op_parallelism", "", "")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	versions, err := servedVersions(*basePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	target, err := url.Parse(upstream)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	listener, err := net.Listen("tcp", "localhost:"+*port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "Exporting HTTP/REST API at:localhost:"+*port)
+	http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(SERVED_VERSIONS_HEADER, versions)
+		proxy.ServeHTTP(w, r)
+	}))
+	return 0
+}
+
+//Numeric version directories of the base path, each one a SavedModel, as version=content of the graph file
+func servedVersions(basePath string) (string, error) {
+	entries, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return "", err
+	}
+	var versions []string
+	for _, e := range entries {
+		if _, err := strconv.ParseInt(e.Name(), 10, 64); err != nil {
+			continue
+		}
+		graph, err := ioutil.ReadFile(filepath.Join(basePath, e.Name(), SAVED_MODEL_FILE))
+		if err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(filepath.Join(basePath, e.Name(), SAVED_MODEL_VARIABLES)); err != nil || !info.IsDir() {
+			return "", errors.New(fmt.Sprintf("no variables in the version %s", e.Name()))
+		}
+		versions = append(versions, e.Name()+"="+string(graph))
+	}
+	if len(versions) == 0 {
+		return "", errors.New(fmt.Sprintf("no servable version in %s", basePath))
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ","), nil
+}
+
+//Serve the predictions from a fake local Tensorflow server, the test binary, started on the downloaded model of each
+//run. It forwards the predictions to the stub. The returned function restores the backend and removes the model
+func useFakeServing(t *testing.T, stub *httptest.Server, layout string) func() {
+	t.Helper()
+	scratch, err := ioutil.TempDir("", "embedded-tf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	previousURL, previousPredictor, previousBinary, previousPort, previousPath := tfRemoteURL, predictor, tfServingBinary, tfPort, localModelPath
+	tfRemoteURL, predictor, tfServingBinary, tfPort, localModelPath = "", &tfPredictor{layout: layout}, os.Args[0], port, scratch+"/model/"
+	os.Setenv(FAKE_SERVING_ENV, stub.URL)
+	return func() {
+		os.Unsetenv(FAKE_SERVING_ENV)
+		tfRemoteURL, predictor, tfServingBinary, tfPort, localModelPath = previousURL, previousPredictor, previousBinary, previousPort, previousPath
+		os.RemoveAll(scratch)
+	}
+}
+
+//Seed the store with a SavedModel directory, its graph file containing the content
+func putSavedModel(store *memStore, path string, content string) {
+	store.put(path+SAVED_MODEL_FILE, []byte(content), "application/octet-stream")
+	store.put(path+SAVED_MODEL_VARIABLES+"/variables.index", []byte("index"), "application/octet-stream")
+}
+
+//Predict handler of the stub which mimics the Tensorflow responses: an instance {"x":13} is answered with a 200 and
+//the error field, an instance {"x":400} with a 400 and the error field, the first request of an instance {"x":503}
+//with a 503. The other instances are echoed with the model versions which served them
+type pipelineTF struct {
+	mu       sync.Mutex
+	requests map[float64]int
+}
+
+func (s *pipelineTF) predict(w http.ResponseWriter, r *http.Request) {
+	var request inputPredictions
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":%q}`, err.Error())
+		return
+	}
+	predictions := []interface{}{}
+	for _, instance := range request.Instances {
+		x, _ := instance.(map[string]interface{})["x"].(float64)
+		s.mu.Lock()
+		s.requests[x]++
+		count := s.requests[x]
+		s.mu.Unlock()
+		switch {
+		case x == 13:
+			fmt.Fprint(w, `{"error":"unlucky instance"}`)
+			return
+		case x == 400:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid instance"}`)
+			return
+		case x == 503 && count == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":"overloaded"}`)
+			return
+		}
+		predictions = append(predictions, map[string]interface{}{"x": x, "model": r.Header.Get(SERVED_VERSIONS_HEADER)})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{PREDICTIONS_KEY: predictions})
+}
+
+//Full pipeline: the model and the inputs are read from the fake store, the model is downloaded and served by a fake
+//Tensorflow server, and the predictions are uploaded in the fake store. The failed input files are reported
+func TestPipeline(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	tf := &pipelineTF{requests: map[float64]int{}}
+	stub := newStubTF(tf.predict)
+	defer stub.Close()
+	defer useFakeServing(t, stub, MODEL_LAYOUT_FLAT)()
+	previousBackoff := tfPostBackoffMs
+	tfPostBackoffMs = 1
+	defer func() { tfPostBackoffMs = previousBackoff }()
+
+	putSavedModel(stores.bucket(SCHEME_GCS, "models"), "model/", "graph")
+	input := stores.bucket(SCHEME_GCS, "in")
+	input.put("data/ok.jsonl", []byte("{\"x\":1}\n{\"x\":2}\n"), "application/json")
+	input.put("data/retried.jsonl", []byte("{\"x\":503}\n"), "application/json")
+	input.put("data/error.jsonl", []byte("{\"x\":13}\n"), "application/json")
+	input.put("data/rejected.jsonl", []byte("{\"x\":400}\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?model=gs://models/model&input=gs://in/data/&output=gs://out/predictions/&continue_on_error=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	output := stores.bucket(SCHEME_GCS, "out")
+	want := []string{"predictions/" + ERRORS_NAME, "predictions/ok.jsonl", "predictions/retried.jsonl"}
+	if names := output.names(); !reflect.DeepEqual(names, want) {
+		t.Fatalf("outputs %v, %v expected", names, want)
+	}
+	predictions := map[string]string{
+		"predictions/ok.jsonl":      "{\"model\":\"000000=graph\",\"x\":1}\n{\"model\":\"000000=graph\",\"x\":2}\n",
+		"predictions/retried.jsonl": "{\"model\":\"000000=graph\",\"x\":503}\n",
+	}
+	for name, content := range predictions {
+		if got := string(output.get(name).data); got != content {
+			t.Errorf("output %s: %q, %q expected", name, got, content)
+		}
+	}
+	if tf.requests[503] != 2 {
+		t.Errorf("%d requests of the 503 instance, 1 retry expected", tf.requests[503])
+	}
+
+	report := struct {
+		Errors []failedInput `json:"errors"`
+	}{}
+	if err := json.Unmarshal(output.get("predictions/"+ERRORS_NAME).data, &report); err != nil {
+		t.Fatal(err)
+	}
+	failed := map[string]string{}
+	for _, f := range report.Errors {
+		failed[f.Input] = f.Error
+	}
+	if len(failed) != 2 || !strings.Contains(failed["data/error.jsonl"], "unlucky instance") ||
+		!strings.Contains(failed["data/rejected.jsonl"], "status 400") || !strings.Contains(failed["data/rejected.jsonl"], "invalid instance") {
+		t.Errorf("errors report %+v", report.Errors)
+	}
+}
+
+//Without continue_on_error, an error field in a serving response fails the run and nothing is uploaded
+func TestPipelineError(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	tf := &pipelineTF{requests: map[float64]int{}}
+	stub := newStubTF(tf.predict)
+	defer stub.Close()
+	defer useFakeServing(t, stub, MODEL_LAYOUT_FLAT)()
+
+	putSavedModel(stores.bucket(SCHEME_GCS, "models"), "model/", "graph")
+	stores.bucket(SCHEME_GCS, "in").put("data/error.jsonl", []byte("{\"x\":1}\n{\"x\":13}\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?model=gs://models/model/&input=gs://in/data/&output=gs://out/predictions/", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "error when making predictions") {
+		t.Errorf("status %d: %s, 500 expected", w.Code, w.Body)
+	}
+	if names := stores.bucket(SCHEME_GCS, "out").names(); len(names) > 0 {
+		t.Errorf("outputs %v of the failed run", names)
+	}
+}
+
+//A model path which isn't a SavedModel is rejected before starting the Tensorflow server
+func TestPipelineInvalidModel(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	stub := newStubTF(echoPredictions)
+	defer stub.Close()
+	defer useFakeServing(t, stub, MODEL_LAYOUT_FLAT)()
+
+	stores.bucket(SCHEME_GCS, "models").put("model/README.md", []byte("not a model"), "text/plain")
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?model=gs://models/model/&input=gs://in/data/&output=gs://out/predictions/", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid model") {
+		t.Errorf("status %d: %s, 400 expected", w.Code, w.Body)
+	}
+}
+
+//The flat model is served under the dummy version, the versioned model with its own versions
+func TestPipelineModelLayout(t *testing.T) {
+	tests := []struct {
+		layout string
+		model  map[string]string
+		served string
+	}{
+		{layout: MODEL_LAYOUT_FLAT, model: map[string]string{"model/": "flat"}, served: "000000=flat"},
+		{layout: MODEL_LAYOUT_VERSIONED, model: map[string]string{"model/1/": "v1", "model/2/": "v2"}, served: "1=v1,2=v2"},
+	}
+	for _, test := range tests {
+		stores := newMemStores()
+		restoreStores := useMemStores(stores)
+		stub := newStubTF((&pipelineTF{requests: map[float64]int{}}).predict)
+		restoreServing := useFakeServing(t, stub, test.layout)
+
+		for path, content := range test.model {
+			putSavedModel(stores.bucket(SCHEME_GCS, "models"), path, content)
+		}
+		stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+		w := serve(httptest.NewRequest("GET", "/?model=gs://models/model/&input=gs://in/data/&output=gs://out/p/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s layout: status %d: %s", test.layout, w.Code, w.Body)
+		} else if got, want := string(stores.bucket(SCHEME_GCS, "out").get("p/a.jsonl").data), "{\"model\":\""+test.served+"\",\"x\":1}\n"; got != want {
+			t.Errorf("%s layout: output %q, %q expected", test.layout, got, want)
+		}
+
+		restoreServing()
+		stub.Close()
+		restoreStores()
+	}
+
+	// A SavedModel isn't a base directory of versions
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	stub := newStubTF(echoPredictions)
+	defer stub.Close()
+	defer useFakeServing(t, stub, MODEL_LAYOUT_VERSIONED)()
+	putSavedModel(stores.bucket(SCHEME_GCS, "models"), "model/", "flat")
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+	w := serve(httptest.NewRequest("GET", "/?model=gs://models/model/&input=gs://in/data/&output=gs://out/p/", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "no numeric version directory") {
+		t.Errorf("flat model in the versioned layout: status %d: %s, 400 expected", w.Code, w.Body)
+	}
+}
+
+func TestGetLatestVersion(t *testing.T) {
+	store := newMemStore(SCHEME_GCS, "models")
+	ctx := context.Background()
+	if _, err := getLatestVersion(ctx, store, "model/"); err == nil {
+		t.Errorf("latest version of a missing model")
+	}
+	for _, path := range []string{"model/1/", "model/9/", "model/10/", "model/latest/", "model/11.old/", "other/20/"} {
+		putSavedModel(store, path, path)
+	}
+	// The versions are compared as numbers, the other directories are ignored
+	if version, err := getLatestVersion(ctx, store, "model/"); err != nil || version != "10" {
+		t.Errorf("latest version %q, %v, 10 expected", version, err)
+	}
+	if _, err := getLatestVersion(ctx, store, "model/latest/"); err == nil {
+		t.Errorf("latest version of a model without version")
+	}
+}
+
+//With serve_latest, only the highest version is downloaded and served as itself, with version the requested one
+func TestPipelineServeLatest(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	stub := newStubTF((&pipelineTF{requests: map[float64]int{}}).predict)
+	defer stub.Close()
+	defer useFakeServing(t, stub, MODEL_LAYOUT_FLAT)()
+
+	for _, version := range []string{"1", "2", "10"} {
+		putSavedModel(stores.bucket(SCHEME_GCS, "models"), "model/"+version+"/", "v"+version)
+	}
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+
+	tests := []struct {
+		query  string
+		served string
+		status int
+	}{
+		{query: "serve_latest=true", served: "10=v10", status: http.StatusOK},
+		{query: "version=2", served: "2=v2", status: http.StatusOK},
+		{query: "version=3", status: http.StatusNotFound},
+		{query: "version=2&serve_latest=true", status: http.StatusBadRequest},
+	}
+	for i, test := range tests {
+		output := fmt.Sprintf("gs://out/%d/", i)
+		w := serve(httptest.NewRequest("GET", "/?model=gs://models/model/&input=gs://in/data/&output="+output+"&"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: status %d: %s, %d expected", test.query, w.Code, w.Body, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		got := string(stores.bucket(SCHEME_GCS, "out").get(fmt.Sprintf("%d/a.jsonl", i)).data)
+		if want := "{\"model\":\"" + test.served + "\",\"x\":1}\n"; got != want {
+			t.Errorf("%s: output %q, %q expected", test.query, got, want)
+		}
+	}
+
+	// A model without version directory can't select its latest version
+	putSavedModel(stores.bucket(SCHEME_GCS, "models"), "flat/", "flat")
+	w := serve(httptest.NewRequest("GET", "/?model=gs://models/flat/&input=gs://in/data/&output=gs://out/flat/&serve_latest=true", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "no numeric version subdirectory") {
+		t.Errorf("serve_latest without version: status %d: %s, 400 expected", w.Code, w.Body)
+	}
+}
+
+//The remote Tensorflow server already serves its model versions
+func TestServeLatestRemote(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(echoPredictions)
+	defer restore()
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/&serve_latest=true", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "TF_REMOTE_URL") {
+		t.Errorf("status %d: %s, 400 expected", w.Code, w.Body)
+	}
+}
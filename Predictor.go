@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	//Tensorflow Serving backend, the default one
+	BACKEND_TENSORFLOW = "tensorflow"
+	//Triton Inference Server backend
+	BACKEND_TRITON = "triton"
+
+	//The model param references a SavedModel directory, downloaded under a dummy version directory. The default layout
+	MODEL_LAYOUT_FLAT = "flat"
+	//The model param references a base directory with the numeric version subdirectories, downloaded as is
+	MODEL_LAYOUT_VERSIONED = "versioned"
+
+	//JSON field of the Tensorflow server response which contains the predictions
+	PREDICTIONS_KEY = "predictions"
+	//JSON field of the Tensorflow server response which contains the predictions in the columnar format
+	OUTPUTS_KEY = "outputs"
+	//JSON field of the Tensorflow classify and regress responses which contains the results
+	RESULT_KEY = "result"
+
+	//Tensorflow Serving API of the prediction requests. Predict is the default one, classify and regress require a
+	//signature of the same method and take the instances as examples
+	METHOD_PREDICT  = "predict"
+	METHOD_CLASSIFY = "classify"
+	METHOD_REGRESS  = "regress"
+
+	//Instances sent in the "instances" list of the Tensorflow request, one item per instance. The default format
+	REQUEST_FORMAT_ROW = "row"
+	//Instances sent in the "inputs" of the Tensorflow request, one list of values per input name
+	REQUEST_FORMAT_COLUMNAR = "columnar"
+	//Signature of the model used by the Tensorflow server for the predictions
+	TF_DEFAULT_SIGNATURE = "serving_default"
+	//State of a model version loaded and servable by the Tensorflow server
+	TF_MODEL_AVAILABLE = "AVAILABLE"
+	//Graph file of a SavedModel directory
+	SAVED_MODEL_FILE = "saved_model.pb"
+	//Variables directory of a SavedModel directory
+	SAVED_MODEL_VARIABLES = "variables"
+)
+
+//Serving backend in charge of the predictions. It starts the local server on the downloaded model, builds the
+//prediction requests from the instances and parses the responses into predictions. The call itself is a JSON POST
+//on the prediction URL
+type Predictor interface {
+	//Name of the backend, as set in the BACKEND environment variable
+	Name() string
+	//Local directory where the model is downloaded
+	ModelPath() string
+	//Check the layout of the model downloaded in the local directory, before starting the server
+	ValidateModel(path string) error
+	//Command which starts the server on the downloaded model
+	Command() *exec.Cmd
+	//Log entry printed by the server when it's ready to serve
+	StartMarker() string
+	//URL which answers 200 when the model is ready to serve
+	StatusURL() string
+	//Check the model is loaded and servable. The error explains why it isn't
+	ModelAvailable() error
+	//URL of the prediction requests of the model of the options
+	PredictURL(opts *predictionOptions) string
+	//Shape of each model input for one instance, from the model metadata. -1 for a dimension of any size
+	InputShapes(opts *predictionOptions) (map[string][]int, error)
+	//Build the body of the prediction request from the instances
+	FormatInput(instances []interface{}, opts *predictionOptions) ([]byte, error)
+	//Extract the predictions, one per instance, from the body of the prediction response
+	FormatOutput(body []byte, opts *predictionOptions) ([]interface{}, error)
+}
+
+//Serving backend of the server. Tensorflow by default, set at startup from the BACKEND environment variable
+var predictor Predictor = &tfPredictor{}
+
+var (
+	//Serving backend and model layout, read from the environment variables. An unknown value fails the startup
+	backend     = getEnvEnum("BACKEND", BACKEND_TENSORFLOW, BACKEND_TENSORFLOW, BACKEND_TRITON)
+	modelLayout = getEnvEnum("MODEL_LAYOUT", MODEL_LAYOUT_FLAT, MODEL_LAYOUT_FLAT, MODEL_LAYOUT_VERSIONED)
+)
+
+//Create the predictor of the backend. Tensorflow if no backend is set. The model layout applies only to Tensorflow
+func newPredictor(backend string, modelLayout string) (Predictor, error) {
+	switch backend {
+	case "", BACKEND_TENSORFLOW:
+		if modelLayout == "" {
+			modelLayout = MODEL_LAYOUT_FLAT
+		}
+		if modelLayout != MODEL_LAYOUT_FLAT && modelLayout != MODEL_LAYOUT_VERSIONED {
+			return nil, errors.New(fmt.Sprintf("unknown MODEL_LAYOUT '%s', must be '%s' or '%s'", modelLayout, MODEL_LAYOUT_FLAT, MODEL_LAYOUT_VERSIONED))
+		}
+		return &tfPredictor{layout: modelLayout}, nil
+	case BACKEND_TRITON:
+		return &tritonPredictor{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown BACKEND '%s', must be '%s' or '%s'", backend, BACKEND_TENSORFLOW, BACKEND_TRITON))
+}
+
+//JSON representation of Instance for Prediction. The signature is omitted for the default one
+type inputPredictions struct {
+	SignatureName string        `json:"signature_name,omitempty"`
+	Instances     []interface{} `json:"instances,omitempty"`
+	Inputs        interface{}   `json:"inputs,omitempty"`
+	Examples      []interface{} `json:"examples,omitempty"`
+}
+
+//Tensorflow Serving REST API backend
+type tfPredictor struct {
+	//Layout of the model directory, flat or versioned
+	layout string
+}
+
+func (p *tfPredictor) Name() string {
+	return BACKEND_TENSORFLOW
+}
+
+//Tensorflow requires the model under a version directory of the base path. A flat model is stored under a dummy one,
+//a versioned model already contains its version directories
+func (p *tfPredictor) ModelPath() string {
+	if p.layout == MODEL_LAYOUT_VERSIONED {
+		return localModelPath
+	}
+	return localModelPath + MODEL_DUMMY_VERSION
+}
+
+//The model directory must be a SavedModel, with the graph file and the variables directory. In the versioned layout,
+//the base directory must contain at least one numeric version directory, each one a SavedModel
+func (p *tfPredictor) ValidateModel(path string) error {
+	if path != localModelPath {
+		return validateSavedModel(path, "the model path")
+	}
+	return validateVersions(path)
+}
+
+//Check the numeric version directories of the base directory, each one a SavedModel
+func validateVersions(path string) error {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	versions := 0
+	for _, e := range entries {
+		// The linked versions of a local model are directories too
+		if info, err := os.Stat(path + e.Name()); err != nil || !info.IsDir() {
+			continue
+		}
+		if _, err := strconv.ParseInt(e.Name(), 10, 64); err != nil {
+			continue
+		}
+		if err = validateSavedModel(path+e.Name()+"/", "the version directory "+e.Name()); err != nil {
+			return err
+		}
+		versions++
+	}
+	if versions == 0 {
+		return errors.New("no numeric version directory in the model path")
+	}
+	return nil
+}
+
+//Serve the numeric version directories of a model downloaded, or linked, under the dummy version directory as the
+//versions of the model, when the model param is a base directory of versions instead of a SavedModel. The versions
+//are moved, or linked, in the parent directory and the dummy version is removed. Return false, with nothing changed,
+//for a SavedModel or a directory without version
+func arrangeVersions(path string) (bool, error) {
+	if _, err := os.Stat(path + SAVED_MODEL_FILE); err == nil {
+		return false, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+	var versions []string
+	for _, e := range entries {
+		if _, err := strconv.ParseInt(e.Name(), 10, 64); err == nil && e.IsDir() && validateSavedModel(path+e.Name()+"/", e.Name()) == nil {
+			versions = append(versions, e.Name())
+		}
+	}
+	if len(versions) == 0 {
+		return false, nil
+	}
+
+	dir := strings.TrimSuffix(path, "/")
+	base := filepath.Dir(dir)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return false, err
+	}
+	// The linked local model isn't moved, its versions are linked instead
+	target := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err = filepath.EvalSymlinks(dir); err != nil {
+			return false, err
+		}
+	}
+	// Moved aside first, a version can have the name of the dummy version
+	aside := filepath.Join(base, ".versions-"+filepath.Base(dir))
+	if err = os.Rename(dir, aside); err != nil {
+		return false, err
+	}
+	for _, v := range versions {
+		if target != "" {
+			err = os.Symlink(filepath.Join(target, v), filepath.Join(base, v))
+		} else {
+			err = os.Rename(filepath.Join(aside, v), filepath.Join(base, v))
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, os.RemoveAll(aside)
+}
+
+//Check the SavedModel files of the local directory, described by dir in the errors
+func validateSavedModel(path string, dir string) error {
+	if info, err := os.Stat(path + SAVED_MODEL_FILE); err != nil || info.IsDir() {
+		return errors.New(fmt.Sprintf("no %s file in %s, it must be a SavedModel directory", SAVED_MODEL_FILE, dir))
+	}
+	if info, err := os.Stat(path + SAVED_MODEL_VARIABLES); err != nil || !info.IsDir() {
+		return errors.New(fmt.Sprintf("no %s/ directory in %s, it must be a SavedModel directory", SAVED_MODEL_VARIABLES, dir))
+	}
+	return nil
+}
+
+//With served models, the server serves all the models of the config file
+func (p *tfPredictor) Command() *exec.Cmd {
+	args := []string{"--port=" + tfGRPCPort, "--rest_api_port=" + tfPort}
+	if tfIntraOpThreads > 0 {
+		args = append(args, "--tensorflow_intra_op_parallelism="+strconv.Itoa(tfIntraOpThreads))
+	}
+	if tfInterOpThreads > 0 {
+		args = append(args, "--tensorflow_inter_op_parallelism="+strconv.Itoa(tfInterOpThreads))
+	}
+	args = append(append(args, tfServingFlags...), tfGPUFlags...)
+	if len(servedModels) > 0 {
+		return exec.Command(tfServingBinary, append(args, "--model_config_file="+modelConfigPath)...)
+	}
+	return exec.Command(tfServingBinary, append(args, "--model_name="+modelName, "--model_base_path="+localModelPath)...)
+}
+
+//Get the command on CPU: the same args without the GPU flags, and the GPUs hidden to the server
+func cpuCommand(cmd *exec.Cmd) *exec.Cmd {
+	gpuFlags := map[string]bool{}
+	for _, flag := range tfGPUFlags {
+		gpuFlags[flag] = true
+	}
+	var args []string
+	for _, arg := range cmd.Args[1:] {
+		if !gpuFlags[arg] {
+			args = append(args, arg)
+		}
+	}
+	cpu := exec.Command(cmd.Path, args...)
+	cpu.Env = append(os.Environ(), "CUDA_VISIBLE_DEVICES=-1")
+	return cpu
+}
+
+func (p *tfPredictor) StartMarker() string {
+	return "Exporting HTTP/REST API"
+}
+
+func (p *tfPredictor) StatusURL() string {
+	return p.modelURL(tfModelNames()[0])
+}
+
+func (p *tfPredictor) modelURL(name string) string {
+	if tfRemoteURL != "" {
+		return tfRemoteURL + "/v1/models/" + name
+	}
+	return "http://localhost:" + tfPort + "/v1/models/" + name
+}
+
+//Status of the versions of the Tensorflow model
+type tfModelStatus struct {
+	ModelVersionStatus []struct {
+		Version string `json:"version"`
+		State   string `json:"state"`
+		Status  struct {
+			ErrorCode    string `json:"error_code"`
+			ErrorMessage string `json:"error_message"`
+		} `json:"status"`
+	} `json:"model_version_status"`
+}
+
+//The Tensorflow server can export its API before the model is loaded. The model is servable once a version is
+//AVAILABLE in the model status. With served models, all of them must be available
+func (p *tfPredictor) ModelAvailable() error {
+	names := tfModelNames()
+	for _, name := range names {
+		if err := p.modelAvailable(name); err != nil {
+			if len(names) > 1 {
+				return errors.New(fmt.Sprintf("model %s: %s", name, err))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *tfPredictor) modelAvailable(name string) error {
+	resp, err := tfClient.Get(p.modelURL(name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("model status returned %s: %s", resp.Status, body))
+	}
+
+	status := tfModelStatus{}
+	if err = json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	var states []string
+	for _, v := range status.ModelVersionStatus {
+		if v.State == TF_MODEL_AVAILABLE {
+			return nil
+		}
+		state := fmt.Sprintf("version %s %s", v.Version, v.State)
+		if v.Status.ErrorMessage != "" {
+			state += ": " + v.Status.ErrorMessage
+		}
+		states = append(states, state)
+	}
+	if len(states) == 0 {
+		return errors.New("no model version in the model status")
+	}
+	return errors.New(strings.Join(states, ", "))
+}
+
+func (p *tfPredictor) PredictURL(opts *predictionOptions) string {
+	return p.modelURL(opts.ModelName) + ":" + opts.Method
+}
+
+//Decode the JSON body of the serving response. The body must contain only one JSON value
+func decodeResponse(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(v); err != nil {
+		return errors.New(fmt.Sprintf("invalid JSON serving response: %s", err))
+	}
+	// Only whitespaces can follow the JSON object. More() accepts a trailing ']' or '}'
+	var extra json.RawMessage
+	if err := decoder.Decode(&extra); err != io.EOF {
+		return errors.New("invalid JSON serving response: unexpected data after the JSON object")
+	}
+	return nil
+}
+
+//Metadata of the Tensorflow model, restricted to the signature inputs
+type tfModelMetadata struct {
+	Metadata struct {
+		SignatureDef struct {
+			SignatureDef map[string]struct {
+				Inputs map[string]tfTensorInfo `json:"inputs"`
+			} `json:"signature_def"`
+		} `json:"signature_def"`
+	} `json:"metadata"`
+}
+
+//Type and shape of a signature input
+type tfTensorInfo struct {
+	Dtype       string `json:"dtype"`
+	TensorShape struct {
+		Dim []struct {
+			Size string `json:"size"`
+		} `json:"dim"`
+		UnknownRank bool `json:"unknown_rank"`
+	} `json:"tensor_shape"`
+}
+
+//The first dimension of the signature inputs is the batch. The inputs of unknown rank aren't returned
+func (p *tfPredictor) InputShapes(opts *predictionOptions) (map[string][]int, error) {
+	inputs, err := p.signatureInputs(opts.ModelName, opts.Signature)
+	if err != nil {
+		return nil, err
+	}
+	shapes := map[string][]int{}
+	for name, input := range inputs {
+		if input.TensorShape.UnknownRank || len(input.TensorShape.Dim) == 0 {
+			continue
+		}
+		var shape []int
+		for _, d := range input.TensorShape.Dim[1:] {
+			size, err := strconv.Atoi(d.Size)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("input '%s' has an invalid dimension size '%s'", name, d.Size))
+			}
+			shape = append(shape, size)
+		}
+		shapes[name] = shape
+	}
+	return shapes, nil
+}
+
+//Get the inputs of the signature from the metadata of the model
+func (p *tfPredictor) signatureInputs(model string, name string) (map[string]tfTensorInfo, error) {
+	resp, err := tfClient.Get(p.modelURL(model) + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("model metadata returned %s: %s", resp.Status, body))
+	}
+
+	metadata := tfModelMetadata{}
+	if err = json.Unmarshal(body, &metadata); err != nil {
+		return nil, err
+	}
+	signature, ok := metadata.Metadata.SignatureDef.SignatureDef[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no '%s' signature in the model metadata", name))
+	}
+	return signature.Inputs, nil
+}
+
+//Encapsulate the instances into a "instances" JSON array, or into the "inputs" in the columnar format. The classify
+//and regress instances are the "examples", JSON objects of the features. The signature_name is only set for another
+//signature than the default one
+func (p *tfPredictor) FormatInput(instances []interface{}, opts *predictionOptions) ([]byte, error) {
+	request := inputPredictions{}
+	if opts.Signature != TF_DEFAULT_SIGNATURE {
+		request.SignatureName = opts.Signature
+	}
+	if opts.Method != METHOD_PREDICT {
+		for i, instance := range instances {
+			if _, ok := instance.(map[string]interface{}); !ok {
+				return nil, errors.New(fmt.Sprintf("instance %d: the '%s' method requires JSON object instances", i, opts.Method))
+			}
+		}
+		request.Examples = instances
+		return json.Marshal(request)
+	}
+	if opts.RequestFormat != REQUEST_FORMAT_COLUMNAR {
+		request.Instances = instances
+		return json.Marshal(request)
+	}
+	inputs, err := toColumnarInputs(instances)
+	if err != nil {
+		return nil, err
+	}
+	request.Inputs = inputs
+	return json.Marshal(request)
+}
+
+//Transpose the instances into the columnar inputs: one list of values per input name when the instances are JSON
+//objects, else the list of the instances for a model with only one input
+func toColumnarInputs(instances []interface{}) (interface{}, error) {
+	first, ok := instances[0].(map[string]interface{})
+	if !ok {
+		for i, instance := range instances {
+			if _, ok := instance.(map[string]interface{}); ok {
+				return nil, errors.New(fmt.Sprintf("instance %d: JSON object mixed with non object instances", i))
+			}
+		}
+		return instances, nil
+	}
+	inputs := make(map[string][]interface{}, len(first))
+	for i, instance := range instances {
+		o, ok := instance.(map[string]interface{})
+		if !ok || len(o) != len(first) {
+			return nil, errors.New(fmt.Sprintf("instance %d: the columnar format requires the same inputs in all the instances", i))
+		}
+		for name, value := range o {
+			if _, ok := first[name]; !ok {
+				return nil, errors.New(fmt.Sprintf("instance %d: the columnar format requires the same inputs in all the instances, unexpected input '%s'", i, name))
+			}
+			inputs[name] = append(inputs[name], value)
+		}
+	}
+	return inputs, nil
+}
+
+//Split the columnar outputs per instance: a JSON object with one field per output when the outputs are named, else
+//the value of the single output
+func fromColumnarOutputs(rawOutputs json.RawMessage) ([]interface{}, error) {
+	var outputs interface{}
+	if err := json.Unmarshal(rawOutputs, &outputs); err != nil {
+		return nil, err
+	}
+	switch o := outputs.(type) {
+	case []interface{}:
+		return o, nil
+	case map[string]interface{}:
+		var predictions []interface{}
+		for name, value := range o {
+			batch, ok := value.([]interface{})
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("output '%s' without batch dimension", name))
+			}
+			if predictions == nil {
+				predictions = make([]interface{}, len(batch))
+				for i := range predictions {
+					predictions[i] = map[string]interface{}{}
+				}
+			} else if len(batch) != len(predictions) {
+				return nil, errors.New(fmt.Sprintf("output '%s' batch size %d different from %d", name, len(batch), len(predictions)))
+			}
+			for i, v := range batch {
+				predictions[i].(map[string]interface{})[name] = v
+			}
+		}
+		return predictions, nil
+	}
+	return nil, errors.New(fmt.Sprintf("'%s' field of the serving response must be a JSON array or object", OUTPUTS_KEY))
+}
+
+//Remove the "predictions" JSON array encapsulation of the Tensorflow server response body, or the "result" one of the
+//classify and regress responses, or split the "outputs" in the columnar format.
+//The response is in error if the configured error field is present and not empty.
+func (p *tfPredictor) FormatOutput(output []byte, opts *predictionOptions) ([]interface{}, error) {
+	//Unmarshal the prediction JSON, as is. An invalid body is an error, it's never altered for being parsed
+	answer := map[string]json.RawMessage{}
+	if err := decodeResponse(output, &answer); err != nil {
+		logErrorf(context.Background(), "Error during answer unmarshal %s", output)
+		return nil, err
+	}
+	if predictionError := getResponseError(answer[opts.ErrorKey]); predictionError != "" {
+		// Prediction error
+		return nil, errors.New(predictionError)
+	}
+
+	if opts.RequestFormat == REQUEST_FORMAT_COLUMNAR {
+		rawOutputs, ok := answer[OUTPUTS_KEY]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no '%s' field in the serving response %s", OUTPUTS_KEY, output))
+		}
+		return fromColumnarOutputs(rawOutputs)
+	}
+	key := PREDICTIONS_KEY
+	if opts.Method != METHOD_PREDICT {
+		key = RESULT_KEY
+	}
+	rawPredictions, ok := answer[key]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no '%s' field in the serving response %s", key, output))
+	}
+	var predictions []interface{}
+	if err := json.Unmarshal(rawPredictions, &predictions); err != nil {
+		return nil, err
+	}
+	return predictions, nil
+}
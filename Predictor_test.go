@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPredictor(t *testing.T) {
+	tests := []struct {
+		backend string
+		layout  string
+		name    string
+		path    string
+		err     bool
+	}{
+		{backend: "", layout: "", name: BACKEND_TENSORFLOW, path: localModelPath + MODEL_DUMMY_VERSION},
+		{backend: BACKEND_TENSORFLOW, layout: MODEL_LAYOUT_FLAT, name: BACKEND_TENSORFLOW, path: localModelPath + MODEL_DUMMY_VERSION},
+		{backend: BACKEND_TENSORFLOW, layout: MODEL_LAYOUT_VERSIONED, name: BACKEND_TENSORFLOW, path: localModelPath},
+		{backend: BACKEND_TENSORFLOW, layout: "nested", err: true},
+		{backend: BACKEND_TRITON, name: BACKEND_TRITON},
+		{backend: "torchserve", err: true},
+	}
+	for _, test := range tests {
+		p, err := newPredictor(test.backend, test.layout)
+		if test.err {
+			if err == nil {
+				t.Errorf("newPredictor(%q, %q): error expected", test.backend, test.layout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newPredictor(%q, %q): %s", test.backend, test.layout, err)
+			continue
+		}
+		if p.Name() != test.name {
+			t.Errorf("newPredictor(%q, %q) is %s, %s expected", test.backend, test.layout, p.Name(), test.name)
+		}
+		if test.path != "" && p.ModelPath() != test.path {
+			t.Errorf("newPredictor(%q, %q) model path %s, %s expected", test.backend, test.layout, p.ModelPath(), test.path)
+		}
+	}
+}
+
+//Both layouts serve the base path, the flat model is under its dummy version directory
+func TestModelLayoutCommand(t *testing.T) {
+	for _, layout := range []string{MODEL_LAYOUT_FLAT, MODEL_LAYOUT_VERSIONED} {
+		args := strings.Join((&tfPredictor{layout: layout}).Command().Args, " ")
+		if !strings.Contains(args, "--model_base_path="+localModelPath) || !strings.Contains(args, "--model_name="+modelName) {
+			t.Errorf("%s layout command %s", layout, args)
+		}
+	}
+}
+
+//Create the SavedModel files of the directory
+func writeSavedModel(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, SAVED_MODEL_VARIABLES), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, SAVED_MODEL_FILE), []byte("graph"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateModelLayout(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "embedded-tf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scratch)
+	previous := localModelPath
+	localModelPath = scratch + "/model/"
+	defer func() { localModelPath = previous }()
+
+	flat, versioned := &tfPredictor{layout: MODEL_LAYOUT_FLAT}, &tfPredictor{layout: MODEL_LAYOUT_VERSIONED}
+	if err = versioned.ValidateModel(versioned.ModelPath()); err == nil {
+		t.Errorf("missing versioned model accepted")
+	}
+	if err = os.MkdirAll(localModelPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSavedModel(t, localModelPath+"not-a-version")
+	if err = versioned.ValidateModel(versioned.ModelPath()); err == nil || !strings.Contains(err.Error(), "no numeric version") {
+		t.Errorf("versioned model without version: %v", err)
+	}
+	writeSavedModel(t, localModelPath+"3")
+	if err = versioned.ValidateModel(versioned.ModelPath()); err != nil {
+		t.Errorf("versioned model: %s", err)
+	}
+	if err = os.MkdirAll(localModelPath+"4", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = versioned.ValidateModel(versioned.ModelPath()); err == nil || !strings.Contains(err.Error(), "version directory 4") {
+		t.Errorf("versioned model with an empty version: %v", err)
+	}
+
+	if err = flat.ValidateModel(flat.ModelPath()); err == nil {
+		t.Errorf("missing flat model accepted")
+	}
+	writeSavedModel(t, flat.ModelPath())
+	if err = flat.ValidateModel(flat.ModelPath()); err != nil {
+		t.Errorf("flat model: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+//Interval, in seconds, of the progress logs of the model downloads. 0 disables them
+var downloadProgressSeconds = getEnvInt("DOWNLOAD_PROGRESS_SECONDS", 10)
+
+//Progress of a model download, from the sizes of the listing. The bytes are counted while written, by the concurrent
+//downloads. The nil progress counts nothing
+type downloadProgress struct {
+	location   string
+	totalFiles int
+	totalBytes int64
+	start      time.Time
+	files      int64
+	bytes      int64
+}
+
+//Start logging the progress of the download every DOWNLOAD_PROGRESS_SECONDS, until the returned stop is called. Nil
+//if the progress logs are disabled
+func startDownloadProgress(ctx context.Context, location string, totalFiles int, totalBytes int64) (*downloadProgress, func()) {
+	if downloadProgressSeconds <= 0 {
+		return nil, func() {}
+	}
+	p := &downloadProgress{location: location, totalFiles: totalFiles, totalBytes: totalBytes, start: time.Now()}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(downloadProgressSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.log(ctx)
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p, func() { close(done) }
+}
+
+//Count the downloaded bytes
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, int64(len(b)))
+	}
+	return len(b), nil
+}
+
+//Count a completed file
+func (p *downloadProgress) fileDone() {
+	if p != nil {
+		atomic.AddInt64(&p.files, 1)
+	}
+}
+
+//Log the completed files, the downloaded bytes, the rate and the estimated remaining time
+func (p *downloadProgress) log(ctx context.Context) {
+	files := atomic.LoadInt64(&p.files)
+	bytes := atomic.LoadInt64(&p.bytes)
+	elapsed := time.Since(p.start).Seconds()
+	rate := float64(bytes) / elapsed
+	eta := "unknown"
+	if rate > 0 && p.totalBytes >= bytes {
+		eta = (time.Duration(float64(p.totalBytes-bytes)/rate) * time.Second).String()
+	}
+	percent := 100.0
+	if p.totalBytes > 0 {
+		percent = float64(bytes) * 100 / float64(p.totalBytes)
+	}
+	logInfof(ctx, "download of %s in progress: %d/%d file(s), %.1f/%.1f MB (%.0f%%), %.1f MB/s, remaining %s",
+		p.location, files, p.totalFiles, float64(bytes)/(1024*1024), float64(p.totalBytes)/(1024*1024), percent,
+		rate/(1024*1024), eta)
+}
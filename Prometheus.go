@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+//Prefix of the Prometheus metrics
+const METRICS_NAMESPACE = "embedded_tf"
+
+var (
+	predictionRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "requests_total",
+		Help:      "Number of prediction requests.",
+	})
+	failedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "failed_requests_total",
+		Help:      "Number of prediction requests which haven't answered 200.",
+	})
+	filesPredicted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "files_predicted_total",
+		Help:      "Number of input files predicted.",
+	})
+	modelDownloadSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "model_download_seconds",
+		Help:      "Duration of the model downloads.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	modelCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "model_cache_hits_total",
+		Help:      "Number of models restored from the model cache instead of being downloaded.",
+	})
+	modelCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "model_cache_misses_total",
+		Help:      "Number of models not in the model cache, downloaded.",
+	})
+	tfStartupSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "tf_startup_seconds",
+		Help:      "Duration of the serving backend startups, until ready.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	jobsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "jobs_queued",
+		Help:      "Number of jobs waiting a worker in the queue.",
+	})
+	jobsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "jobs_running",
+		Help:      "Number of jobs running, model loading included.",
+	})
+	filePredictionSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "file_prediction_seconds",
+		Help:      "Duration of the prediction of an input file, from its read to its formatted predictions.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+//Handler of the Prometheus metrics. The compression is done by the router, like the other responses
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{DisableCompression: true})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//Event type of the GCS notification of a new object. The other events are acknowledged without prediction
+const GCS_OBJECT_FINALIZE = "OBJECT_FINALIZE"
+
+var (
+	//Model and output of the predictions triggered by Pub/Sub, when the message attributes don't set them
+	pubsubModel  = getEnvString("PUBSUB_MODEL", "")
+	pubsubOutput = getEnvString("PUBSUB_OUTPUT", "")
+)
+
+//Body of a Pub/Sub push request
+type pubsubEnvelope struct {
+	Message struct {
+		//Base64 encoded. For a GCS notification, the JSON resource of the object
+		Data       string            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+//Object of a GCS notification, restricted to its location
+type gcsNotificationObject struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+//Predict the object of a GCS notification pushed by a Pub/Sub subscription. The object is the input, the model and
+//the output are the "model" and "output" attributes of the message, else PUBSUB_MODEL and PUBSUB_OUTPUT. The other
+//params are the query params of the push endpoint.
+//A 204 acknowledges the message. Only the retryable errors are answered like LoadAndPredict, for a retry by Pub/Sub.
+//The permanent errors, like an invalid input, would fail again on each retry: they're logged and acknowledged
+func PubSubPush(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		// Truncated push request, Pub/Sub sends it again
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "error when reading the Pub/Sub message")
+		return
+	}
+	envelope := pubsubEnvelope{}
+	if err = json.Unmarshal(body, &envelope); err != nil {
+		logErrorf(ctx, "invalid Pub/Sub message acknowledged without prediction: %s", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	attributes := envelope.Message.Attributes
+
+	if eventType := attributes["eventType"]; eventType != "" && eventType != GCS_OBJECT_FINALIZE {
+		logInfof(ctx, "Pub/Sub message %s of event %s acknowledged without prediction", envelope.Message.MessageID, eventType)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	object, err := getNotificationObject(envelope)
+	if err != nil {
+		logErrorf(ctx, "Pub/Sub message %s acknowledged without prediction: %s", envelope.Message.MessageID, err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if strings.HasSuffix(object.Name, "/") {
+		// Directory placeholder, there is nothing to predict
+		logInfof(ctx, "Pub/Sub message %s of directory %s acknowledged without prediction", envelope.Message.MessageID, object.Name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("input", SCHEME_GCS+"://"+object.Bucket+"/"+object.Name)
+	for name, value := range map[string]string{"model": pubsubModel, "output": pubsubOutput} {
+		if attributes[name] != "" {
+			value = attributes[name]
+		}
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	// The log entries of the run have the model and input of the message
+	fields, _ := ctx.Value(logFieldsKey{}).(logFields)
+	fields.Model = query.Get("model")
+	fields.Input = query.Get("input")
+	ctx = context.WithValue(ctx, logFieldsKey{}, fields)
+	run := r.Clone(ctx)
+	run.Method = http.MethodGet
+	run.URL.RawQuery = query.Encode()
+	run.Body = http.NoBody
+
+	logInfof(ctx, "Pub/Sub message %s, prediction of %s", envelope.Message.MessageID, query.Get("input"))
+	response := &jobResponse{header: http.Header{}}
+	LoadAndPredict(response, run)
+	if response.status == 0 || response.status == http.StatusOK {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !isRetryableStatus(response.status) {
+		logErrorf(ctx, "Pub/Sub message %s acknowledged after a prediction failure with status %d: %s", envelope.Message.MessageID, response.status, strings.TrimSpace(response.body.String()))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if contentType := response.header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(response.status)
+	w.Write(response.body.Bytes())
+}
+
+//Return true if the failure of the run may not happen again, like an unavailable server, a run in conflict or a
+//canceled request. The other client errors, like an invalid input or model, are permanent
+func isRetryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusConflict || status == STATUS_REQUEST_CANCELLED
+}
+
+//Get the object of the GCS notification, from the message data, else from the bucketId and objectId attributes
+func getNotificationObject(envelope pubsubEnvelope) (gcsNotificationObject, error) {
+	object := gcsNotificationObject{}
+	if envelope.Message.Data != "" {
+		data, err := base64.StdEncoding.DecodeString(envelope.Message.Data)
+		if err != nil {
+			return object, errors.New(fmt.Sprintf("invalid Pub/Sub message data, must be base64 encoded: %s", err))
+		}
+		if err = json.Unmarshal(data, &object); err != nil {
+			return object, errors.New(fmt.Sprintf("invalid Pub/Sub message data, must be a GCS object JSON: %s", err))
+		}
+	}
+	if object.Bucket == "" {
+		object.Bucket = envelope.Message.Attributes["bucketId"]
+	}
+	if object.Name == "" {
+		object.Name = envelope.Message.Attributes["objectId"]
+	}
+	if object.Bucket == "" || object.Name == "" {
+		return object, errors.New("no GCS object in the Pub/Sub message, the bucket and the name are required")
+	}
+	return object, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Push request of the GCS notification of the object
+func pubsubRequest(object string) *http.Request {
+	data := base64.StdEncoding.EncodeToString([]byte(object))
+	body := fmt.Sprintf(`{"message":{"data":"%s","attributes":{"eventType":"%s"},"messageId":"1"},"subscription":"s"}`, data, GCS_OBJECT_FINALIZE)
+	return httptest.NewRequest("POST", "/pubsub?output=gs://out/p/", strings.NewReader(body))
+}
+
+//Only the retryable failures are answered with an error, for a retry by Pub/Sub. The permanent ones are acknowledged
+func TestPubSubPush(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	unavailable := false
+	_, restore := useStubTF(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"unavailable"}`))
+			return
+		}
+		echoPredictions(w, r)
+	})
+	defer restore()
+	input := stores.bucket(SCHEME_GCS, "in")
+	input.put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		status  int
+	}{
+		{name: "predicted", request: pubsubRequest(`{"bucket":"in","name":"data/a.jsonl"}`), status: http.StatusNoContent},
+		{name: "missing input", request: pubsubRequest(`{"bucket":"in","name":"data/missing.jsonl"}`), status: http.StatusNoContent},
+		{name: "no object", request: pubsubRequest(`{"bucket":"in"}`), status: http.StatusNoContent},
+		{name: "invalid message", request: httptest.NewRequest("POST", "/pubsub", strings.NewReader("{")), status: http.StatusNoContent},
+	}
+	for _, test := range tests {
+		if w := serve(test.request); w.Code != test.status {
+			t.Errorf("%s: status %d, %d expected: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+	if stores.bucket(SCHEME_GCS, "out").get("p/a.jsonl") == nil {
+		t.Errorf("no output of the predicted object, outputs %v", stores.bucket(SCHEME_GCS, "out").names())
+	}
+
+	unavailable = true
+	w := serve(pubsubRequest(`{"bucket":"in","name":"data/a.jsonl"}`))
+	if !isRetryableStatus(w.Code) {
+		t.Errorf("unavailable server: status %d, a retryable status expected: %s", w.Code, w.Body)
+	}
+
+	for status, retryable := range map[int]bool{400: false, 403: false, 404: false, 409: true, 429: true, 499: true, 500: true, 503: true} {
+		if isRetryableStatus(status) != retryable {
+			t.Errorf("status %d retryable %v", status, !retryable)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+//Response writer which records if the response is started, for answering an error only before
+type recoverResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *recoverResponseWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoverResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+//Flush the data already written to the client, for the streamed responses
+func (w *recoverResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Wrap the handler for recovering its panics: the panic is logged with its stack trace and the request answers a 500,
+//if its response isn't started yet. The aborts of net/http are panicked again
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoverResponseWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			logErrorf(r.Context(), "panic when handling %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+			if !rw.written {
+				rw.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(rw, "internal error")
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Encoding of the compressed HTTP responses
+const GZIP_ENCODING = "gzip"
+
+//Compress the HTTP responses with gzip when the client accepts it. Disabled with GZIP_RESPONSE=false
+var gzipResponse = getEnvBool("GZIP_RESPONSE", true)
+
+//Response writer which compresses the body with gzip
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+//Compress the body data
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+//Flush the compressed data already written to the client, for the streamed responses
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Wrap the handler for compressing its response with gzip when the request Accept-Encoding header allows it
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !gzipResponse || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", GZIP_ENCODING)
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	})
+}
+
+//Return true if gzip is in the accepted encodings of the request, and not refused with a zero quality
+func acceptsGzip(r *http.Request) bool {
+	q, _ := acceptQuality(r.Header.Get("Accept-Encoding"), GZIP_ENCODING)
+	return q > 0
+}
+
+//Get the quality of the value in an Accept or Accept-Encoding header, from its most specific matching range: the
+//value itself, then type/* for a media type, then * or */*. The quality is 0 if no range matches or if the value is
+//refused with q=0. Exact is true if the value itself is listed
+func acceptQuality(header string, value string) (q float64, exact bool) {
+	best := 0
+	for _, part := range strings.Split(header, ",") {
+		s := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(s[0]))
+		specificity := 0
+		switch {
+		case mediaRange == value:
+			specificity = 3
+		case strings.HasSuffix(mediaRange, "/*") && mediaRange != "*/*" && strings.HasPrefix(value, strings.TrimSuffix(mediaRange, "*")):
+			specificity = 2
+		case mediaRange == "*" || mediaRange == "*/*":
+			specificity = 1
+		}
+		if specificity <= best {
+			continue
+		}
+		best = specificity
+		q = 1
+		for _, param := range s[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+	}
+	return q, best == 3
+}
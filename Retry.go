@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	//Max number of attempts of the storage reads, listings and deletions on a transient error
+	storageAttempts = getEnvInt("STORAGE_ATTEMPTS", 3)
+	//Pause before the second attempt of a storage call, in milliseconds, doubled on each attempt, with a jitter
+	storageBackoffMs = getEnvInt("STORAGE_BACKOFF_MS", 200)
+)
+
+//Store which retries its calls on the transient errors. The uploads aren't retried here, the buffered outputs are
+//retried with their content by UPLOAD_ATTEMPTS, and a download is only retried on its opening, not during the read
+type retryStore struct {
+	ObjectStore
+}
+
+func (s *retryStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var ret []objectInfo
+	err := retryStorage(ctx, "listing of "+s.Location(prefix), func() error {
+		var err error
+		ret, err = s.ObjectStore.List(ctx, prefix)
+		return err
+	})
+	return ret, err
+}
+
+func (s *retryStore) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	var ret []string
+	err := retryStorage(ctx, "listing of "+s.Location(prefix), func() error {
+		var err error
+		ret, err = s.ObjectStore.ListDirs(ctx, prefix)
+		return err
+	})
+	return ret, err
+}
+
+func (s *retryStore) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	var ret io.ReadCloser
+	err := retryStorage(ctx, "download of "+s.Location(name), func() error {
+		var err error
+		ret, err = s.ObjectStore.Download(ctx, name, generation)
+		return err
+	})
+	return ret, err
+}
+
+func (s *retryStore) Delete(ctx context.Context, name string) error {
+	return retryStorage(ctx, "deletion of "+s.Location(name), func() error {
+		return s.ObjectStore.Delete(ctx, name)
+	})
+}
+
+//Call the storage operation up to STORAGE_ATTEMPTS times while it fails on a transient error, with an exponential
+//backoff. The jitter spreads the retries of the concurrent calls. The cancellation of the context stops the retries
+func retryStorage(ctx context.Context, operation string, call func() error) error {
+	backoff := time.Duration(storageBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= storageAttempts || ctx.Err() != nil || !isTransientStorageError(err) {
+			return err
+		}
+		delay := backoff
+		if backoff > 0 {
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		}
+		logWarningf(ctx, "%s failed, attempt %d/%d, retried in %s: %s", operation, attempt, storageAttempts, delay, err)
+		if err = sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+//The rate limits, the server errors, the network errors and the timeouts are transient. The missing objects and the permission
+//errors aren't
+func isTransientStorageError(err error) bool {
+	if _, ok := err.(*notFoundError); ok {
+		return false
+	}
+	var timeoutErr *storageTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	var gcsErr *googleapi.Error
+	if errors.As(err, &gcsErr) {
+		return gcsErr.Code == http.StatusTooManyRequests || gcsErr.Code >= http.StatusInternalServerError
+	}
+	var s3Err awserr.RequestFailure
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode() == http.StatusTooManyRequests || s3Err.StatusCode() >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//Max size of the JSON body of a prediction run, which only has params
+const MAX_RUN_BODY_BYTES = 1 << 20
+
+//JSON body of a prediction run, instead of the query params. The options are the optional query params, by name
+type runRequest struct {
+	Model   interface{}            `json:"model"`
+	Input   interface{}            `json:"input"`
+	Inputs  interface{}            `json:"inputs"`
+	Output  interface{}            `json:"output"`
+	Options map[string]interface{} `json:"options"`
+}
+
+//Run the prediction of the JSON body, like LoadAndPredict with the query params
+func PredictRun(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	run, err := withRunBody(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	LoadAndPredict(w, run)
+}
+
+//Get the request with the params of the JSON body as query params. The body params take precedence on the query
+//params of the same name. The request is returned as is if the body is empty
+func withRunBody(r *http.Request) (*http.Request, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_RUN_BODY_BYTES+1))
+	if err != nil {
+		return nil, errors.New("error when reading the body: " + err.Error())
+	}
+	if len(body) > MAX_RUN_BODY_BYTES {
+		return nil, errors.New(fmt.Sprintf("body larger than %d bytes", MAX_RUN_BODY_BYTES))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return r, nil
+	}
+	req := runRequest{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&req); err != nil {
+		return nil, errors.New("invalid JSON body: " + err.Error())
+	}
+
+	query := r.URL.Query()
+	params := map[string]interface{}{"model": req.Model, "input": req.Input, "inputs": req.Inputs, "output": req.Output}
+	for name, value := range req.Options {
+		if _, ok := params[name]; ok {
+			return nil, errors.New(fmt.Sprintf("'%s' must be set at the top level of the body, not in the options", name))
+		}
+		params[name] = value
+	}
+	for name, value := range params {
+		if value == nil {
+			continue
+		}
+		s, err := queryValue(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("'%s' of the body: %s", name, err))
+		}
+		query.Set(name, s)
+	}
+
+	// The log entries of the run have the model and input of the body
+	ctx := r.Context()
+	fields, _ := ctx.Value(logFieldsKey{}).(logFields)
+	fields.Model = query.Get("model")
+	fields.Input = query.Get("input")
+	ctx = context.WithValue(ctx, logFieldsKey{}, fields)
+	run := r.Clone(ctx)
+	run.URL.RawQuery = query.Encode()
+	run.Body = http.NoBody
+	run.ContentLength = 0
+	return run, nil
+}
+
+//Encode the JSON value like the query params: the arrays are comma separated lists and the objects comma separated
+//lists of key=value pairs
+func queryValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, err := queryValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		var pairs []string
+		for key, item := range v {
+			s, err := queryValue(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	}
+	return "", errors.New(fmt.Sprintf("unsupported value %v", value))
+}
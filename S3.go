@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+)
+
+var (
+	//Endpoint of an S3 compatible storage, like MinIO. AWS S3 if empty
+	s3Endpoint = getEnvString("S3_ENDPOINT", "")
+	//Address the buckets in the path of the URL instead of the host name, as usually required by MinIO
+	s3ForcePathStyle = getEnvBool("S3_FORCE_PATH_STYLE", false)
+)
+
+//Client of the S3 API. The region and the credentials are taken from the standard AWS environment variables and
+//shared configuration files
+type s3Client struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func newS3Client() (*s3Client, error) {
+	config := aws.NewConfig().WithS3ForcePathStyle(s3ForcePathStyle)
+	if s3Endpoint != "" {
+		config = config.WithEndpoint(s3Endpoint)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{Config: *config, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+	return &s3Client{client: client, uploader: s3manager.NewUploaderWithClient(client)}, nil
+}
+
+func (c *s3Client) bucket(name string) *s3Store {
+	return &s3Store{name: name, client: c}
+}
+
+//S3 bucket. The object generations aren't supported
+type s3Store struct {
+	name   string
+	client *s3Client
+}
+
+func (s *s3Store) Location(name string) string {
+	return SCHEME_S3 + "://" + s.name + "/" + name
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var ret []objectInfo
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.name), Prefix: aws.String(prefix)}
+	err := s.client.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			// The listing doesn't return the content type, it's unknown
+			ret = append(ret, objectInfo{Name: aws.StringValue(o.Key), Size: aws.Int64Value(o.Size), Version: aws.StringValue(o.ETag)})
+		}
+		return true
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil, &notFoundError{message: fmt.Sprintf("bucket %s not found", s.Location(""))}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *s3Store) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	var ret []string
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.name), Prefix: aws.String(prefix), Delimiter: aws.String("/")}
+	err := s.client.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, p := range page.CommonPrefixes {
+			ret = append(ret, aws.StringValue(p.Prefix))
+		}
+		return true
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil, &notFoundError{message: fmt.Sprintf("bucket %s not found", s.Location(""))}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *s3Store) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	if generation != 0 {
+		return nil, errors.New("object generations are only supported on GCS")
+	}
+	output, err := s.client.client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(s.name), Key: aws.String(name)})
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == s3.ErrCodeNoSuchBucket) {
+		return nil, &notFoundError{message: fmt.Sprintf("object %s not found", s.Location(name))}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+//The content is streamed to the uploader through a pipe. The object is created by S3 at the end of the content
+func (s *s3Store) Upload(ctx context.Context, name string, contentType string, contentEncoding string, metadata map[string]string) io.WriteCloser {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, uploaded: make(chan error, 1)}
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(s.name),
+		Key:      aws.String(name),
+		Body:     pr,
+		Metadata: aws.StringMap(metadata),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if contentEncoding != "" {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+	go func() {
+		_, err := s.client.uploader.UploadWithContext(ctx, input)
+		// Unblock the writes if the upload stopped before the end of the content
+		pr.CloseWithError(err)
+		w.uploaded <- err
+	}()
+	return w
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	_, err := s.client.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.name), Key: aws.String(name)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil
+	}
+	return err
+}
+
+//Writer of an S3 object, uploaded while it's written
+type s3Writer struct {
+	pw       *io.PipeWriter
+	uploaded chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+//Wait the end of the upload. Close error means no object
+func (w *s3Writer) Close() error {
+	w.pw.Close()
+	return <-w.uploaded
+}
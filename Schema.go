@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//Max size of the JSON schema of the instances
+const MAX_SCHEMA_BYTES = 1 << 20
+
+//Keywords of the JSON schemas which don't validate anything, accepted and ignored
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+//Error of an input instance which doesn't match the JSON schema of the run. It's a user error, answered with a 400
+type schemaError struct {
+	message string
+}
+
+func (e *schemaError) Error() string {
+	return e.message
+}
+
+//JSON schema of the input instances. Only the type, enum, const, object, array, string and number keywords are
+//supported, a schema with another validation keyword, like $ref or oneOf, is rejected instead of being partially
+//applied
+type jsonSchema struct {
+	//The false schema rejects any value
+	never bool
+	types []string
+	enum  []interface{}
+	//Set if hasConst
+	constant interface{}
+	hasConst bool
+	//Keywords of the objects. Without additionalProperties, the other properties are allowed
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	//Keywords of the arrays
+	items    *jsonSchema
+	minItems int
+	maxItems int
+	//Keywords of the strings
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+	//Keywords of the numbers, nil if not set
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+}
+
+//Read and parse the JSON schema object
+func readSchema(ctx context.Context, store ObjectStore, path string) (*jsonSchema, error) {
+	r, err := store.Download(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, MAX_SCHEMA_BYTES+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MAX_SCHEMA_BYTES {
+		return nil, errors.New(fmt.Sprintf("schema larger than %d bytes", MAX_SCHEMA_BYTES))
+	}
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
+		return nil, errors.New(fmt.Sprintf("schema bad formatted: %s", err))
+	}
+	return parseSchema(v, "$")
+}
+
+//Parse the decoded JSON schema. The path locates the schema in the document, for the error messages
+func parseSchema(v interface{}, path string) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		return &jsonSchema{never: !b, minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}, nil
+	}
+	o, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("schema %s must be a JSON object or a boolean", path))
+	}
+	s := &jsonSchema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	var keywords []string
+	for keyword := range o {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		value := o[keyword]
+		invalid := errors.New(fmt.Sprintf("schema %s: invalid '%s'", path, keyword))
+		var err error
+		switch keyword {
+		case "type":
+			switch t := value.(type) {
+			case string:
+				s.types = []string{t}
+			case []interface{}:
+				for _, item := range t {
+					name, ok := item.(string)
+					if !ok {
+						return nil, invalid
+					}
+					s.types = append(s.types, name)
+				}
+			default:
+				return nil, invalid
+			}
+			for _, t := range s.types {
+				switch t {
+				case "object", "array", "string", "number", "integer", "boolean", "null":
+				default:
+					return nil, errors.New(fmt.Sprintf("schema %s: unknown type '%s'", path, t))
+				}
+			}
+		case "enum":
+			if s.enum, ok = value.([]interface{}); !ok {
+				return nil, invalid
+			}
+		case "const":
+			s.constant, s.hasConst = value, true
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, invalid
+			}
+			s.properties = map[string]*jsonSchema{}
+			for name, property := range properties {
+				if s.properties[name], err = parseSchema(property, path+"."+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			required, ok := value.([]interface{})
+			if !ok {
+				return nil, invalid
+			}
+			for _, item := range required {
+				name, ok := item.(string)
+				if !ok {
+					return nil, invalid
+				}
+				s.required = append(s.required, name)
+			}
+		case "additionalProperties":
+			if s.additionalProperties, err = parseSchema(value, path+".additionalProperties"); err != nil {
+				return nil, err
+			}
+		case "items":
+			if s.items, err = parseSchema(value, path+"[]"); err != nil {
+				return nil, err
+			}
+		case "minItems", "maxItems", "minLength", "maxLength":
+			n, ok := value.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return nil, invalid
+			}
+			switch keyword {
+			case "minItems":
+				s.minItems = int(n)
+			case "maxItems":
+				s.maxItems = int(n)
+			case "minLength":
+				s.minLength = int(n)
+			default:
+				s.maxLength = int(n)
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, invalid
+			}
+			if s.pattern, err = regexp.Compile(pattern); err != nil {
+				return nil, errors.New(fmt.Sprintf("schema %s: invalid 'pattern': %s", path, err))
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum":
+			n, ok := value.(float64)
+			if !ok {
+				return nil, invalid
+			}
+			switch keyword {
+			case "minimum":
+				s.minimum = &n
+			case "maximum":
+				s.maximum = &n
+			case "exclusiveMinimum":
+				s.exclusiveMinimum = &n
+			default:
+				s.exclusiveMaximum = &n
+			}
+		default:
+			if !schemaAnnotations[keyword] {
+				return nil, errors.New(fmt.Sprintf("schema %s: unsupported keyword '%s'", path, keyword))
+			}
+		}
+	}
+	return s, nil
+}
+
+//Validate the decoded JSON value against the schema. The error locates the first invalid value by its path, $ for
+//the instance
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	if s.never {
+		return errors.New(fmt.Sprintf("%s: no value allowed", path))
+	}
+	if len(s.types) > 0 && !hasSchemaType(v, s.types) {
+		return errors.New(fmt.Sprintf("%s: %s isn't of type %s", path, schemaValue(v), strings.Join(s.types, " or ")))
+	}
+	if s.hasConst && !reflect.DeepEqual(v, s.constant) {
+		return errors.New(fmt.Sprintf("%s: %s isn't %s", path, schemaValue(v), schemaValue(s.constant)))
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("%s: %s isn't one of the enum values", path, schemaValue(v)))
+		}
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := value[name]; !ok {
+				return errors.New(fmt.Sprintf("%s: required field '%s' missing", path, name))
+			}
+		}
+		var names []string
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.properties[name]
+			if !ok {
+				property = s.additionalProperties
+			}
+			if property == nil {
+				continue
+			}
+			if property.never && !ok {
+				return errors.New(fmt.Sprintf("%s: field '%s' not allowed", path, name))
+			}
+			if err := property.validate(value[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.minItems >= 0 && len(value) < s.minItems {
+			return errors.New(fmt.Sprintf("%s: %d item(s), at least %d expected", path, len(value), s.minItems))
+		}
+		if s.maxItems >= 0 && len(value) > s.maxItems {
+			return errors.New(fmt.Sprintf("%s: %d item(s), at most %d expected", path, len(value), s.maxItems))
+		}
+		if s.items != nil {
+			for i, item := range value {
+				if err := s.items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.minLength >= 0 && length < s.minLength {
+			return errors.New(fmt.Sprintf("%s: %d char(s), at least %d expected", path, length, s.minLength))
+		}
+		if s.maxLength >= 0 && length > s.maxLength {
+			return errors.New(fmt.Sprintf("%s: %d char(s), at most %d expected", path, length, s.maxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			return errors.New(fmt.Sprintf("%s: %s doesn't match the pattern %s", path, schemaValue(v), s.pattern))
+		}
+	case float64:
+		if (s.minimum != nil && value < *s.minimum) || (s.exclusiveMinimum != nil && value <= *s.exclusiveMinimum) {
+			return errors.New(fmt.Sprintf("%s: %s below the minimum", path, schemaValue(v)))
+		}
+		if (s.maximum != nil && value > *s.maximum) || (s.exclusiveMaximum != nil && value >= *s.exclusiveMaximum) {
+			return errors.New(fmt.Sprintf("%s: %s above the maximum", path, schemaValue(v)))
+		}
+	}
+	return nil
+}
+
+//Return true if the decoded JSON value has one of the schema types. An integer is a number without fractional part
+func hasSchemaType(v interface{}, types []string) bool {
+	for _, t := range types {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && value == math.Trunc(value)) {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case nil:
+			if t == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//JSON representation of the value in the validation errors, truncated
+func schemaValue(v interface{}) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 64 {
+		return string(b[:61]) + "..."
+	}
+	return string(b)
+}
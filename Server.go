@@ -3,457 +3,3706 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"cloud.google.com/go/storage"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
-	"google.golang.org/api/iterator"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-//JSON response of Tensorflow server. Contain predictions or error.
-type outputPredictions struct {
-	Prediction []interface{} `json:"predictions"`
-	Error      string        `json:"error"`
-}
-
-//JSON representation of Instance for Prediction
-type inputPredictions struct {
-	Instances []interface{} `json:"instances"`
-}
-
 //FilePath represent the file name and it's relative path
 type filePath struct {
 	RelativePath string
 	FileName     string
+	//Size of the object in bytes
+	Size int64
+	//Generation of the object to read. The latest if 0
+	Generation int64
+	//Content type of the object. Empty if unknown
+	ContentType string
+	//Checksums of the object, for verifying its download
+	Checksums objectChecksums
+}
+
+//Options of the prediction, extracted from the optional Query parameters
+type predictionOptions struct {
+	//Stream the formatted predictions to the output object while they are formatted
+	StreamOutput bool
+	//JSON field of the serving response which contains the error
+	ErrorKey string
+	//Only the input subdirectories starting with one of these relative paths are processed. All if empty
+	IncludeSubdirs []string
+	//The input subdirectories starting with one of these relative paths are skipped
+	ExcludeSubdirs []string
+	//Only the input files whose name matches one of these globs, or ends by one of these suffixes, are processed
+	InputFilter []string
+	//Encoded query string appended to the prediction URL, for custom serving layers
+	TFQuery string
+	//Grouping of the predictions in the output objects. Per file if empty
+	GroupOutput string
+	//Key/value labels recorded in the manifest and set as custom metadata on the output objects
+	Labels map[string]string
+	//Write the run manifest in the output path
+	WriteManifest bool
+	//Fraction, between 0 and 1, of the input instances to predict
+	SampleRate float64
+	//Seed of the random sampling of the instances
+	SampleSeed int64
+	//Policy applied on the already uploaded outputs when the run fails
+	OnUploadFailure string
+	//Behavior on an input file without instance, skip or fail
+	OnEmptyInput string
+	//Fields of the input instances renamed before the prediction, from the key name to the value name
+	RenameFields map[string]string
+	//Behavior on NaN and Infinity values in the serving response: fail, null, string or a JSON number sentinel
+	OnNonFinite string
+	//Pause between 2 prediction requests to the serving backend
+	InterRequestDelay time.Duration
+	//Format of the predictions in the output objects
+	OutputFormat string
+	//Prefix of the output object names, added to the file name only
+	OutputPrefix string
+	//The outputs mirror the input tree under a single output root, by default the predictions directory of the input
+	Mirror bool
+	//Predictions of all the input files in the single output object of the aggregate name
+	Aggregate     bool
+	AggregateName string
+	//Compression of the output objects, none if empty
+	OutputCompression string
+	//Named output of the model kept in each prediction, instead of the full prediction object
+	OutputKey string
+	//Fields kept in each prediction object, all if empty
+	Select []string
+	//Fail the prediction when a selected field is missing, instead of omitting it
+	SelectStrict bool
+	//Wrap each prediction with the index of its instance in the input file
+	AnnotateIndex bool
+	//Name of the model in the Tensorflow server, TF_MODEL_NAME or the served model of the request
+	ModelName string
+	//Send a discarded prediction request of the first input instance after the start of the Tensorflow server
+	Warmup bool
+	//Check the shape of the instances against the model inputs before the prediction
+	ValidateShapes bool
+	//JSON schema of the input instances, checked while they are read. None if nil, set from the schema object
+	Schema *jsonSchema
+	//Serve only the highest numeric version subdirectory of the model path
+	ServeLatest bool
+	//Numeric version subdirectory of the model path served, none if empty
+	Version string
+	//Keep the local model files after the request, for troubleshooting
+	KeepScratch bool
+	//Number of input files predicted in parallel
+	Concurrency int
+	//Behavior on the input objects which don't have a text or JSON content type: off, warn or fail
+	ContentTypeCheck string
+	//Also return the predictions in the response, in addition to the output objects
+	AlsoReturn bool
+	//Number of retries of a failed prediction request
+	PredictRetries int
+	//On retry, only the instances without prediction are sent again
+	IdempotentRetry bool
+	//Record the prediction requests of each input file in the manifest
+	ManifestDetails bool
+	//Format of the input files. Detected from the file name if empty
+	InputFormat string
+	//Layout of the JSON input files: auto, lines or array
+	JSONLayout string
+	//Keep all the CSV values as JSON strings, the numeric values included
+	CSVAllStrings bool
+	//Field delimiter of the CSV input files, a comma by default
+	CSVDelim rune
+	//Input files not named like JSON or CSV files read as a single base64 encoded instance
+	Binary bool
+	//Skip the failed input files and continue the run, instead of failing it
+	ContinueOnError bool
+	//Write the instances of the batches rejected by the serving backend in error records and continue the file
+	ErrorRecords bool
+	//A batch rejected by the serving backend fails as a whole, else its instances are predicted one by one for
+	//isolating the rejected ones
+	StrictBatch bool
+	//Skip the input files whose output object already exists in all the destinations
+	SkipExisting bool
+	//Overwrite the existing output objects, else the run fails before any prediction if one exists
+	Overwrite bool
+	//Protocol of the prediction requests, rest or grpc
+	Protocol string
+	//Signature of the Tensorflow model used for the predictions
+	Signature string
+	//Format of the instances in the Tensorflow REST requests, row or columnar
+	RequestFormat string
+	//Tensorflow Serving API of the prediction requests, predict, classify or regress
+	Method string
 }
 
 const (
-	//Name of the model when tensorflow start
-	MODEL_NAME = "mymodel"
-	//Local storage of the model
-	LOCAL_MODEL_PATH = "/tmp/model/"
+	//Default name of the model when tensorflow start
+	DEFAULT_MODEL_NAME = "mymodel"
 	//Number of the model. Required by Tensorflow. The value doesn't matter here
 	MODEL_DUMMY_VERSION = "000000/"
 
-	//The prefix of a GCS bucket definition
-	BUCKET_PREFIX = "gs://"
-	//The prefix of all generated prediction file(s)
-	OUTPUT_PREFIX = "prediction_"
+	//The suffix of the gzip compressed input files
+	GZIP_SUFFIX = ".gz"
+	//Default JSON field of the serving response which contains the error. Tensorflow server uses "error"
+	DEFAULT_ERROR_KEY = "error"
+	//Output grouping with one output object per top level input subdirectory
+	GROUP_OUTPUT_PER_DIR = "per_dir"
+	//Name of the aggregated output object, without the extension of the output format
+	DEFAULT_AGGREGATE_NAME = "predictions"
+	//On run failure, keep the already uploaded outputs and list them
+	ON_UPLOAD_FAILURE_REPORT = "report"
+	//On run failure, delete the already uploaded outputs
+	ON_UPLOAD_FAILURE_ROLLBACK = "rollback"
+	//The JSON input files are JSON lines, or a single JSON array of instances when it's detected
+	JSON_LAYOUT_AUTO = "auto"
+	//The JSON input files are JSON lines, also when a file starts with an array
+	JSON_LAYOUT_LINES = "lines"
+	//The JSON input files are a single JSON array of instances
+	JSON_LAYOUT_ARRAY = "array"
+	//An input file without instance is skipped, with a warning
+	ON_EMPTY_INPUT_SKIP = "skip"
+	//An input file without instance fails the prediction with a 400
+	ON_EMPTY_INPUT_FAIL = "fail"
+	//NaN and Infinity values in the serving response fail the prediction
+	ON_NONFINITE_FAIL = "fail"
+	//NaN and Infinity values in the serving response are replaced by null
+	ON_NONFINITE_NULL = "null"
+	//NaN and Infinity values in the serving response are replaced by the strings "NaN", "Infinity" and "-Infinity"
+	ON_NONFINITE_STRING = "string"
+	//The content type of the input objects isn't checked
+	CONTENT_TYPE_CHECK_OFF = "off"
+	//The input objects without a text or JSON content type are logged
+	CONTENT_TYPE_CHECK_WARN = "warn"
+	//The input objects without a text or JSON content type fail the run before any prediction
+	CONTENT_TYPE_CHECK_FAIL = "fail"
 
-	//The API Rest port for Tensorflow server
-	TF_PORT = "8501"
-	//URL to call for a prediction on Tensorflow server
-	TF_URL = "http://localhost:" + TF_PORT + "/v1/models/" + MODEL_NAME + ":predict"
+	//Default API Rest and gRPC ports for Tensorflow server
+	DEFAULT_TF_REST_PORT = 8501
+	DEFAULT_TF_GRPC_PORT = 8500
+	//Interval between 2 readiness checks of the Tensorflow server
+	TF_READY_POLL_INTERVAL = 500 * time.Millisecond
+	//Default max size of the end of the Tensorflow logs reported when the server exits during the startup
+	DEFAULT_TF_LOG_TAIL_BYTES = 4096
 	//Content type of the request to Tensorflow server
 	TF_CONTENT_TYPE = "application/json"
-	//The tensorflow server start timeout
+	//Status of the requests cancelled before the response, by the client or the deadline, like the reverse proxies
+	STATUS_REQUEST_CANCELLED = 499
+	//Directory of the outputs under the input path, in mirror mode without output param
+	MIRROR_OUTPUT_DIR = "predictions/"
+
+	//Steps of a run, reported when REQUEST_TIMEOUT is exceeded
+	PHASE_PARAMS     = "params checks"
+	PHASE_MODEL_LOAD = "model loading"
+	PHASE_TF_STARTUP = "tensorflow startup"
+	PHASE_PREDICTION = "predictions"
+	PHASE_UPLOAD     = "outputs upload"
+	PHASE_REPORTS    = "reports writing"
+	//Pause before the retry of a failed prediction request
+	PREDICT_RETRY_INTERVAL = time.Second
+	//Idle connections kept open to the Tensorflow server, and their max idle duration
+	TF_MAX_IDLE_CONNS    = 32
+	TF_IDLE_CONN_TIMEOUT = 90 * time.Second
+	//The default tensorflow server start timeout, in seconds
 	TF_TIMEOUT = 30
+	//Delay suggested to the clients rejected by MAX_CONCURRENT_REQUESTS, in seconds
+	RETRY_AFTER_SECONDS = 10
 )
 
-//Run the server on the default port.
-func main() {
-	router := initializeRouter()
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+var (
+	//Writable local directory of the model files and the server configs. /tmp by default, set another one for the
+	//read-only root filesystems or a dedicated scratch volume
+	scratchDir = strings.TrimSuffix(getEnvString("LOCAL_SCRATCH_DIR", "/tmp"), "/")
+	//Local storage of the model
+	localModelPath = scratchDir + "/model/"
+	//Config file of the served models, in the ModelServerConfig text format of Tensorflow Serving
+	modelConfigPath = scratchDir + "/models.config"
+	//Port of the HTTP server
+	port = getEnvInt("PORT", 8080)
+	//Name of the model served by the Tensorflow server, in its URLs
+	modelName = getEnvString("TF_MODEL_NAME", DEFAULT_MODEL_NAME)
+	//Tensorflow Serving binary, looked up in the PATH if it's only a name
+	tfServingBinary = getEnvString("TF_SERVING_BINARY", "tensorflow_model_server")
+	//The API Rest and gRPC ports for Tensorflow server
+	tfPort     = strconv.Itoa(getEnvInt("TF_REST_PORT", DEFAULT_TF_REST_PORT))
+	tfGRPCPort = strconv.Itoa(getEnvInt("TF_GRPC_PORT", DEFAULT_TF_GRPC_PORT))
+	//Remote Tensorflow Serving REST API, like http://tf-serving:8501, used instead of a local server. The model isn't
+	//downloaded and no Tensorflow server is started
+	tfRemoteURL = strings.TrimSuffix(getEnvString("TF_REMOTE_URL", ""), "/")
+	//Threads of the Tensorflow server for running one op, and for running the independent ops in parallel. All the
+	//CPUs for one op and half of them for the parallel ops by default, 0 keeps the Tensorflow default
+	tfIntraOpThreads = getEnvInt("TF_INTRA_OP_THREADS", runtime.NumCPU())
+	tfInterOpThreads = getEnvInt("TF_INTER_OP_THREADS", defaultInterOpThreads())
+	//Extra flags of the Tensorflow server, space separated. The GPU flags are dropped by the CPU fallback
+	tfServingFlags = strings.Fields(getEnvString("TF_SERVING_FLAGS", ""))
+	tfGPUFlags     = strings.Fields(getEnvString("TF_GPU_FLAGS", ""))
+	//Start the Tensorflow server again on CPU when its startup fails, for the nodes without GPU
+	tfCPUFallback = getEnvBool("TF_CPU_FALLBACK", false)
+	//Max number of automatic restarts of a Tensorflow server which exited unexpectedly
+	tfMaxRestarts = getEnvInt("TF_MAX_RESTARTS", 3)
+	//Max size of the end of the Tensorflow logs kept during the startup, for reporting an exit
+	tfLogTailBytes = getEnvInt("TF_LOG_TAIL_BYTES", DEFAULT_TF_LOG_TAIL_BYTES)
+	//Max number of lines accepted in an input file. 0 means unlimited
+	maxLinesPerFile = getEnvInt("MAX_LINES_PER_FILE", 0)
+	//Number of instances per prediction request. 0 means all the instances of a file in one request
+	batchSize = getEnvInt("BATCH_SIZE", 100)
+	//Max size in bytes of a line of an input file
+	maxLineBytes = getEnvInt("MAX_LINE_BYTES", 8*1024*1024)
+	//Max size in bytes of an input file, and of all the input files of a run. 0 means unlimited
+	maxInputBytes      = int64(getEnvInt("MAX_INPUT_BYTES", 0))
+	maxTotalInputBytes = int64(getEnvInt("MAX_TOTAL_INPUT_BYTES", 0))
+	//Max number of instances predicted by a run, all the input files together. 0 means unlimited
+	maxTotalInstances = int64(getEnvInt("MAX_TOTAL_INSTANCES", 0))
+	//Number of readiness checks of the REST API port when the start marker isn't found in the logs
+	tfReadyRetries = getEnvInt("TF_READY_RETRIES", 20)
+	//Timeout of the Tensorflow server start, in seconds
+	tfStartupTimeout = getEnvInt("TF_STARTUP_TIMEOUT", TF_TIMEOUT)
+	//Number of files downloaded in parallel
+	downloadConcurrency = getEnvInt("DOWNLOAD_CONCURRENCY", 8)
+	//Max size in bytes of the body of the POST prediction requests. 0 means unlimited
+	maxRequestBytes = int64(getEnvInt("MAX_REQUEST_BYTES", 0))
+	//Max duration of a prediction run, in seconds, from the request to the response. 0 means unlimited
+	requestTimeout = getEnvInt("REQUEST_TIMEOUT", 0)
+	//Max duration of the prediction of an input file, in seconds, its download and its prediction requests. 0 means
+	//unlimited
+	predictFileTimeout = getEnvInt("PREDICT_FILE_TIMEOUT", 0)
+	//Default prefix of the output object names, none by default: the outputs have the same name as the inputs
+	outputPrefix = getEnvString("OUTPUT_PREFIX", "")
+	//Number of output objects uploaded in parallel, in the background of the predictions
+	uploadConcurrency = getEnvInt("UPLOAD_CONCURRENCY", 4)
+	//Max number of attempts of the upload of a buffered output object
+	uploadAttempts = getEnvInt("UPLOAD_ATTEMPTS", 3)
+	//Default of the warmup param
+	warmupDefault = getEnvBool("WARMUP", false)
+	//Default number of input files predicted in parallel, when the request doesn't set concurrency
+	predictConcurrency = getEnvInt("PREDICT_CONCURRENCY", 1)
+	//Max number of attempts of a prediction request on the transient failures: connection errors and 5xx responses
+	tfPostAttempts = getEnvInt("TF_POST_ATTEMPTS", 3)
+	//Pause before the second attempt of a prediction request on a transient failure, in milliseconds, doubled on each
+	//attempt. Independent of the storage backoff, the warmup of the server isn't a rate limit
+	tfPostBackoffMs = getEnvInt("TF_POST_BACKOFF_MS", 200)
+	//Timeout, in seconds, of a request to the Tensorflow server
+	tfRequestTimeout = getEnvInt("TF_REQUEST_TIMEOUT", 300)
+	//Max size in bytes of the body of a prediction request to the Tensorflow server, and of its response. 0 means
+	//unlimited
+	tfMaxRequestBytes  = getEnvInt("TF_MAX_REQUEST_BYTES", 0)
+	tfMaxResponseBytes = int64(getEnvInt("TF_MAX_RESPONSE_BYTES", 0))
+	//Projects billed for the requests on the model, input and output buckets, for requester pays buckets
+	modelProject  = getEnvString("MODEL_PROJECT", "")
+	inputProject  = getEnvString("INPUT_PROJECT", "")
+	outputProject = getEnvString("OUTPUT_PROJECT", "")
+	//Local SavedModel used when the model param is omitted, served without download
+	modelBasePath = getEnvString("MODEL_BASE_PATH", "")
+)
+
+//HTTP client of all the requests to the Tensorflow server. The connections are kept open and reused between the
+//requests, instead of exhausting the ephemeral ports. At least one idle connection per file predicted in parallel
+var tfClient = &http.Client{
+	Timeout: time.Duration(tfRequestTimeout) * time.Second,
+	Transport: &http.Transport{
+		MaxIdleConns:        tfMaxIdleConns(),
+		MaxIdleConnsPerHost: tfMaxIdleConns(),
+		IdleConnTimeout:     TF_IDLE_CONN_TIMEOUT,
+	},
+}
+
+func defaultInterOpThreads() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+func tfMaxIdleConns() int {
+	if predictConcurrency > TF_MAX_IDLE_CONNS {
+		return predictConcurrency
 	}
+	return TF_MAX_IDLE_CONNS
+}
+
+//Model names usable in the URLs and as directory name
+var validModelName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
 
-	//Create the storage client
+//Run the server on the default port, until SIGINT or SIGTERM. In batch mode, run one prediction and exit instead
+func main() {
+	// The messages of the libraries are also JSON entries
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	flag.Parse()
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	// Fail before serving on an invalid environment variable, instead of its default in the middle of the requests
+	if err := config.check(); err != nil {
+		logFatal(err)
+	}
+	logInfof(ctx, "configuration: %s", config.effective())
+
+	//Select the serving backend
+	p, err := newPredictor(backend, modelLayout)
 	if err != nil {
-		fmt.Println(err)
-		return
+		logFatal(err)
+	}
+	predictor = p
+	if !validModelName.MatchString(modelName) {
+		logFatal(errors.New(fmt.Sprintf("invalid TF_MODEL_NAME '%s', only letters, digits, '_', '-' and '.' are allowed", modelName)))
+	}
+	logInfof(ctx, "serving backend: %s", predictor.Name())
+	models, err := readModelConfig(ctx)
+	if err != nil {
+		logFatal(err)
+	}
+	if tfRemoteURL != "" {
+		if predictor.Name() != BACKEND_TENSORFLOW || len(models) > 0 {
+			logFatal(errors.New(fmt.Sprintf("TF_REMOTE_URL requires the '%s' backend and can't be used with served models", BACKEND_TENSORFLOW)))
+		}
+		logInfof(ctx, "model %s served by the remote Tensorflow server %s", modelName, tfRemoteURL)
+	} else {
+		// Fail fast on a missing binary, instead of failing the start of each request
+		binary := predictor.Command().Args[0]
+		if _, err = exec.LookPath(binary); err != nil {
+			logFatal(errors.New(fmt.Sprintf("serving binary %s not found, set TF_SERVING_BINARY for Tensorflow: %s", binary, err)))
+		}
+		captureServingVersion(ctx)
+		if len(models) > 0 {
+			if err = startServedModels(ctx, models); err != nil {
+				logFatal(err)
+			}
+		}
+		logInfof(ctx, "model %s served on the ports %s (REST) and %s (gRPC)", modelName, tfPort, tfGRPCPort)
 	}
+	logInfof(ctx, "serving backend startup timeout: %d seconds", tfStartupTimeout)
+	logInfof(ctx, "retries: %d prediction attempts from %dms (TF_POST_ATTEMPTS, TF_POST_BACKOFF_MS), %d storage attempts from %dms (STORAGE_ATTEMPTS, STORAGE_BACKOFF_MS), %d upload attempts (UPLOAD_ATTEMPTS)",
+		tfPostAttempts, tfPostBackoffMs, storageAttempts, storageBackoffMs, uploadAttempts)
 
-	//Download model
-	fmt.Println(downloadFiles(ctx, client.Bucket("gib-datascience"), "consumptionsH/rnn/1/export/exporter/1546446862/saved_model.pb", ".\\000000\\"))
+	if isBatchMode() {
+		os.Exit(runBatch())
+	}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), router))
+	router := initializeRouter()
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logFatal(err)
+		}
+	}()
+	waitShutdown(server)
 }
 
-//Initialize the router. Only one route.
+//Initialize the router.
 func initializeRouter() *mux.Router {
 	// StrictSlash is true => redirect /cars/ to /cars
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.Methods("GET").Path("/").HandlerFunc(LoadAndPredict)
+	router.Methods("POST").Path("/").HandlerFunc(PredictBody)
+	router.Methods("POST").Path("/run").HandlerFunc(PredictRun)
+	router.Methods("GET").Path("/estimate").HandlerFunc(Estimate)
+	router.Methods("GET").Path("/models").HandlerFunc(ListModels)
+	router.Methods("POST").Path("/jobs").HandlerFunc(CreateJob)
+	router.Methods("POST").Path("/pubsub").HandlerFunc(PubSubPush)
+	router.Methods("GET").Path("/jobs/{id}").HandlerFunc(GetJob)
+	router.Methods("GET").Path("/jobs/{id}/logs").HandlerFunc(GetJobLogs)
+	router.Methods("GET").Path("/health").HandlerFunc(Health)
+	router.Methods("GET").Path("/version").HandlerFunc(Version)
+	router.Methods("GET").Path("/ready").HandlerFunc(Ready)
+	router.Methods("GET").Path("/metrics").Handler(metricsHandler())
+	router.Use(logHandler)
+	router.Use(authHandler)
+	router.Use(forwardHeadersHandler)
+	router.Use(gzipHandler)
+	// Innermost, for answering the error through the compressed response
+	router.Use(recoverHandler)
 	return router
 }
 
 //Extract the required bucket/path params from the Query parameters
-func getParam(r *http.Request, paramName string) (string, string, error) {
+func getParam(r *http.Request, paramName string) (storeLocation, error) {
+	param, ok := r.URL.Query()[paramName]
+	if !ok || len(param[0]) < 1 {
+		return storeLocation{}, errors.New(fmt.Sprintf("Query Param '%s' is missing", paramName))
+	}
+	location, err := extractLocation(param[0])
+	if err != nil {
+		return storeLocation{}, errors.New(fmt.Sprintf("'%s' bad formatted: %s", paramName, err.Error()))
+	}
+	return location, nil
+
+}
+
+//Extract the required comma separated list of bucket/path params from the Query parameters. The same location
+//can't be set twice
+func getLocationListParam(r *http.Request, paramName string) ([]storeLocation, error) {
+	list := getListParam(r, paramName)
+	if len(list) == 0 {
+		return nil, errors.New(fmt.Sprintf("Query Param '%s' is missing", paramName))
+	}
+	var ret []storeLocation
+	locations := map[storeLocation]bool{}
+	for _, location := range list {
+		l, err := extractLocation(location)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("'%s' bad formatted: %s", paramName, err.Error()))
+		}
+		if !strings.HasSuffix(l.Path, "/") {
+			l.Path += "/"
+		}
+		if locations[l] {
+			return nil, errors.New(fmt.Sprintf("'%s' bad formatted: %s is set twice", paramName, location))
+		}
+		locations[l] = true
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
+
+//Get the output locations of the output param. In mirror mode, the param is a single output root, and the
+//predictions directory of the input is the default root
+func getOutputLocations(r *http.Request, input storeLocation) ([]storeLocation, error) {
+	mirror, err := getBoolParam(r, "mirror", false)
+	if err != nil {
+		return nil, err
+	}
+	if mirror && getStringParam(r, "output", "") == "" {
+		output := input
+		output.Path = input.Path[:strings.LastIndex(input.Path, "/")+1] + MIRROR_OUTPUT_DIR
+		return []storeLocation{output}, nil
+	}
+	ret, err := getLocationListParam(r, "output")
+	if err == nil && mirror && len(ret) > 1 {
+		return nil, errors.New("'mirror' requires a single output root")
+	}
+	return ret, err
+}
+
+//Extract an optional boolean from the Query parameters. The default value is returned when the param is missing
+func getBoolParam(r *http.Request, paramName string, defaultValue bool) (bool, error) {
+	param, ok := r.URL.Query()[paramName]
+	if !ok || len(param[0]) < 1 {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseBool(param[0])
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("'%s' must be a boolean", paramName))
+	}
+	return value, nil
+}
+
+//Extract an optional float from the Query parameters. The default value is returned when the param is missing
+func getFloatParam(r *http.Request, paramName string, defaultValue float64) (float64, error) {
+	param, ok := r.URL.Query()[paramName]
+	if !ok || len(param[0]) < 1 {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(param[0], 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("'%s' must be a number", paramName))
+	}
+	return value, nil
+}
+
+//Extract an optional integer from the Query parameters. The default value is returned when the param is missing
+func getIntParam(r *http.Request, paramName string, defaultValue int64) (int64, error) {
+	param, ok := r.URL.Query()[paramName]
+	if !ok || len(param[0]) < 1 {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseInt(param[0], 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("'%s' must be an integer", paramName))
+	}
+	return value, nil
+}
+
+//Extract an optional string from the Query parameters. The default value is returned when the param is missing
+func getStringParam(r *http.Request, paramName string, defaultValue string) string {
 	param, ok := r.URL.Query()[paramName]
 	if !ok || len(param[0]) < 1 {
-		return "", "", errors.New(fmt.Sprintf("Query Param '%s' is missing", paramName))
+		return defaultValue
+	}
+	return param[0]
+}
+
+//Extract an optional comma separated list from the Query parameters. Empty values are ignored
+func getListParam(r *http.Request, paramName string) []string {
+	var ret []string
+	for _, v := range strings.Split(getStringParam(r, paramName, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+//Extract an optional comma separated list of key=value pairs from the Query parameters
+func getMapParam(r *http.Request, paramName string) (map[string]string, error) {
+	return parseKeyValues(paramName, getStringParam(r, paramName, ""))
+}
+
+//Parse a comma separated list of key=value pairs, nil if empty. The name is the one of the param or the env var
+func parseKeyValues(name string, value string) (map[string]string, error) {
+	var ret map[string]string
+	for _, kv := range strings.Split(value, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		s := strings.SplitN(kv, "=", 2)
+		if len(s) != 2 || strings.TrimSpace(s[0]) == "" {
+			return nil, errors.New(fmt.Sprintf("'%s' bad formatted: '%s' must be key=value", name, kv))
+		}
+		if ret == nil {
+			ret = map[string]string{}
+		}
+		ret[strings.TrimSpace(s[0])] = strings.TrimSpace(s[1])
+	}
+	return ret, nil
+}
+
+//Extract the optional prediction options from the Query parameters
+func getPredictionOptions(r *http.Request) (*predictionOptions, error) {
+	streamOutput, err := getBoolParam(r, "stream_output", false)
+	if err != nil {
+		return nil, err
+	}
+	tfQuery, err := url.ParseQuery(getStringParam(r, "tf_query", ""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("'tf_query' bad formatted: %s", err.Error()))
+	}
+	groupOutput := getStringParam(r, "group_output", "")
+	if groupOutput != "" && groupOutput != GROUP_OUTPUT_PER_DIR {
+		return nil, errors.New(fmt.Sprintf("'group_output' must be '%s'", GROUP_OUTPUT_PER_DIR))
+	}
+	outputCompression := getStringParam(r, "output_compression", "")
+	if outputCompression != "" && outputCompression != OUTPUT_COMPRESSION_GZIP {
+		return nil, errors.New(fmt.Sprintf("'output_compression' must be '%s'", OUTPUT_COMPRESSION_GZIP))
+	}
+	prefix := getStringParam(r, "output_prefix", outputPrefix)
+	if strings.Contains(prefix, "/") {
+		return nil, errors.New("'output_prefix' can't contain '/'")
+	}
+	labels, err := getMapParam(r, "labels")
+	if err != nil {
+		return nil, err
+	}
+	writeManifest, err := getBoolParam(r, "write_manifest", false)
+	if err != nil {
+		return nil, err
+	}
+	sampleRate, err := getFloatParam(r, "sample_rate", 1)
+	if err != nil {
+		return nil, err
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, errors.New("'sample_rate' must be between 0 and 1")
+	}
+	sampleSeed, err := getIntParam(r, "sample_seed", time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	renameFields, err := getMapParam(r, "rename_fields")
+	if err != nil {
+		return nil, err
+	}
+	renamed := map[string]string{}
+	for from, to := range renameFields {
+		if other, ok := renamed[to]; ok {
+			return nil, errors.New(fmt.Sprintf("'rename_fields' bad formatted: '%s' and '%s' are both renamed to '%s'", other, from, to))
+		}
+		renamed[to] = from
+	}
+	onEmptyInput := getStringParam(r, "on_empty_input", ON_EMPTY_INPUT_SKIP)
+	if onEmptyInput != ON_EMPTY_INPUT_SKIP && onEmptyInput != ON_EMPTY_INPUT_FAIL {
+		return nil, errors.New(fmt.Sprintf("'on_empty_input' must be '%s' or '%s'", ON_EMPTY_INPUT_SKIP, ON_EMPTY_INPUT_FAIL))
+	}
+	onNonFinite := getStringParam(r, "on_nonfinite", ON_NONFINITE_FAIL)
+	if onNonFinite != ON_NONFINITE_FAIL && onNonFinite != ON_NONFINITE_NULL && onNonFinite != ON_NONFINITE_STRING {
+		// The sentinel is written as is in the JSON response: NaN, Inf, the hex floats and the out of range numbers,
+		// accepted by ParseFloat, are rejected with the JSON number syntax
+		f, err := strconv.ParseFloat(onNonFinite, 64)
+		if err != nil || !csvNumber.MatchString(onNonFinite) || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New(fmt.Sprintf("'on_nonfinite' must be '%s', '%s', '%s' or a finite JSON number", ON_NONFINITE_FAIL, ON_NONFINITE_NULL, ON_NONFINITE_STRING))
+		}
+	}
+	inputFilter := getListParam(r, "input_filter")
+	for _, pattern := range inputFilter {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Contains(pattern, "/") {
+			return nil, errors.New(fmt.Sprintf("'input_filter' bad formatted: '%s' must be a glob or a suffix of the file names, without '/'", pattern))
+		}
+	}
+	skipExisting, err := getBoolParam(r, "skip_existing", false)
+	if err != nil {
+		return nil, err
+	}
+	overwrite, err := getBoolParam(r, "overwrite", true)
+	if err != nil {
+		return nil, err
+	}
+	continueOnError, err := getBoolParam(r, "continue_on_error", false)
+	if err != nil {
+		return nil, err
+	}
+	errorRecords, err := getBoolParam(r, "error_records", false)
+	if err != nil {
+		return nil, err
+	}
+	if errorRecords && !continueOnError {
+		return nil, errors.New("'error_records' requires 'continue_on_error'")
+	}
+	inputFormat := getStringParam(r, "input_format", "")
+	if inputFormat != "" && inputFormat != INPUT_FORMAT_JSON && inputFormat != INPUT_FORMAT_CSV {
+		return nil, errors.New(fmt.Sprintf("'input_format' must be '%s' or '%s'", INPUT_FORMAT_JSON, INPUT_FORMAT_CSV))
+	}
+	jsonLayout := getStringParam(r, "json_layout", JSON_LAYOUT_AUTO)
+	if jsonLayout != JSON_LAYOUT_AUTO && jsonLayout != JSON_LAYOUT_LINES && jsonLayout != JSON_LAYOUT_ARRAY {
+		return nil, errors.New(fmt.Sprintf("'json_layout' must be '%s', '%s' or '%s'", JSON_LAYOUT_AUTO, JSON_LAYOUT_LINES, JSON_LAYOUT_ARRAY))
+	}
+	if jsonLayout != JSON_LAYOUT_AUTO && inputFormat == INPUT_FORMAT_CSV {
+		return nil, errors.New(fmt.Sprintf("'json_layout' can't be used with the '%s' input_format", INPUT_FORMAT_CSV))
+	}
+	csvAllStrings, err := getBoolParam(r, "csv_all_strings", false)
+	if err != nil {
+		return nil, err
+	}
+	csvDelim, err := getCSVDelimParam(r)
+	if err != nil {
+		return nil, err
+	}
+	if csvDelim != ',' && inputFormat == INPUT_FORMAT_JSON {
+		return nil, errors.New(fmt.Sprintf("'csv_delim' can't be used with the '%s' input_format", INPUT_FORMAT_JSON))
+	}
+	binary, err := getBoolParam(r, "binary", false)
+	if err != nil {
+		return nil, err
+	}
+	// The format of all the input files is forced, none would be binary
+	if binary && inputFormat != "" {
+		return nil, errors.New("'binary' and 'input_format' can't be used together")
+	}
+	manifestDetails, err := getBoolParam(r, "manifest_details", false)
+	if err != nil {
+		return nil, err
+	}
+	predictRetries, err := getIntParam(r, "predict_retries", 0)
+	if err != nil {
+		return nil, err
+	}
+	if predictRetries < 0 {
+		return nil, errors.New("'predict_retries' must be 0 or more")
+	}
+	idempotentRetry, err := getBoolParam(r, "idempotent_retry", false)
+	if err != nil {
+		return nil, err
+	}
+	alsoReturn, err := getBoolParam(r, "also_return", false)
+	if err != nil {
+		return nil, err
+	}
+	contentTypeCheck := getStringParam(r, "content_type_check", CONTENT_TYPE_CHECK_OFF)
+	if contentTypeCheck != CONTENT_TYPE_CHECK_OFF && contentTypeCheck != CONTENT_TYPE_CHECK_WARN && contentTypeCheck != CONTENT_TYPE_CHECK_FAIL {
+		return nil, errors.New(fmt.Sprintf("'content_type_check' must be '%s', '%s' or '%s'", CONTENT_TYPE_CHECK_OFF, CONTENT_TYPE_CHECK_WARN, CONTENT_TYPE_CHECK_FAIL))
+	}
+	concurrency, err := getIntParam(r, "concurrency", int64(predictConcurrency))
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, errors.New("'concurrency' must be at least 1")
+	}
+	warmup, err := getBoolParam(r, "warmup", warmupDefault)
+	if err != nil {
+		return nil, err
+	}
+	keepScratch, err := getBoolParam(r, "keep_scratch", false)
+	if err != nil {
+		return nil, err
+	}
+	serveLatest, err := getBoolParam(r, "serve_latest", false)
+	if err != nil {
+		return nil, err
+	}
+	version := getStringParam(r, "version", "")
+	if version != "" {
+		if _, err := strconv.ParseInt(version, 10, 64); err != nil || strings.HasPrefix(version, "-") {
+			return nil, errors.New(fmt.Sprintf("'version' must be a positive integer, got '%s'", version))
+		}
+		if serveLatest {
+			return nil, errors.New("'version' and 'serve_latest' can't be used together")
+		}
+		// The served and the remote models are already loaded by their server
+		if predictor.Name() != BACKEND_TENSORFLOW || len(servedModels) > 0 || tfRemoteURL != "" {
+			return nil, errors.New(fmt.Sprintf("'version' is only supported by the '%s' backend, without served models nor TF_REMOTE_URL", BACKEND_TENSORFLOW))
+		}
+	}
+	validateShapes, err := getBoolParam(r, "validate_shapes", false)
+	if err != nil {
+		return nil, err
+	}
+	interRequestDelay, err := getIntParam(r, "inter_request_delay_ms", 0)
+	if err != nil {
+		return nil, err
+	}
+	if interRequestDelay < 0 {
+		return nil, errors.New("'inter_request_delay_ms' must be 0 or more")
+	}
+	// Without the param, the format can be negotiated with the Accept header
+	outputFormat := getStringParam(r, "output_format", "")
+	if outputFormat == "" {
+		outputFormat = OUTPUT_FORMAT_JSONL
+		// MessagePack must be listed, not only matched by a wildcard, and preferred to the JSON types
+		accept := r.Header.Get("Accept")
+		msgpackQuality, listed := acceptQuality(accept, MSGPACK_CONTENT_TYPE)
+		jsonQuality, _ := acceptQuality(accept, TF_CONTENT_TYPE)
+		ndjsonQuality, _ := acceptQuality(accept, NDJSON_CONTENT_TYPE)
+		if listed && msgpackQuality > 0 && msgpackQuality >= jsonQuality && msgpackQuality >= ndjsonQuality {
+			outputFormat = OUTPUT_FORMAT_MSGPACK
+		}
+	}
+	if outputFormat != OUTPUT_FORMAT_JSONL && outputFormat != OUTPUT_FORMAT_MSGPACK && outputFormat != OUTPUT_FORMAT_BQ_NDJSON &&
+		outputFormat != OUTPUT_FORMAT_RAW {
+		return nil, errors.New(fmt.Sprintf("'output_format' must be '%s', '%s', '%s' or '%s'", OUTPUT_FORMAT_JSONL, OUTPUT_FORMAT_MSGPACK, OUTPUT_FORMAT_BQ_NDJSON, OUTPUT_FORMAT_RAW))
+	}
+	aggregate, err := getBoolParam(r, "aggregate", false)
+	if err != nil {
+		return nil, err
+	}
+	if aggregate && groupOutput != "" {
+		return nil, errors.New("'aggregate' and 'group_output' can't be used together")
+	}
+	mirror, err := getBoolParam(r, "mirror", false)
+	if err != nil {
+		return nil, err
+	}
+	if mirror && (aggregate || groupOutput != "") {
+		return nil, errors.New("'mirror' can't be used with 'aggregate' or 'group_output', one output per input file mirrors the input")
+	}
+	aggregateName := getStringParam(r, "aggregate_name", "")
+	if aggregateName == "" {
+		aggregateName = DEFAULT_AGGREGATE_NAME + ".jsonl"
+		if outputFormat == OUTPUT_FORMAT_MSGPACK {
+			aggregateName = DEFAULT_AGGREGATE_NAME + ".msgpack"
+		}
+	}
+	if strings.HasPrefix(aggregateName, "/") || strings.HasSuffix(aggregateName, "/") {
+		return nil, errors.New("'aggregate_name' can't start or end by '/'")
+	}
+	outputKey := getStringParam(r, "output_key", "")
+	if outputFormat == OUTPUT_FORMAT_RAW && outputKey != "" {
+		return nil, errors.New(fmt.Sprintf("'output_key' can't be used with the '%s' output_format", OUTPUT_FORMAT_RAW))
+	}
+	selectFields := getListParam(r, "select")
+	if len(selectFields) > 0 && outputFormat == OUTPUT_FORMAT_RAW {
+		return nil, errors.New(fmt.Sprintf("'select' can't be used with the '%s' output_format", OUTPUT_FORMAT_RAW))
+	}
+	// The output key already replaces each prediction object by the value of one of its fields
+	if len(selectFields) > 0 && outputKey != "" {
+		return nil, errors.New("'select' and 'output_key' can't be used together")
+	}
+	selectStrict, err := getBoolParam(r, "select_strict", false)
+	if err != nil {
+		return nil, err
+	}
+	annotateIndex, err := getBoolParam(r, "annotate_index", false)
+	if err != nil {
+		return nil, err
+	}
+	if annotateIndex && outputFormat == OUTPUT_FORMAT_RAW {
+		return nil, errors.New(fmt.Sprintf("'annotate_index' can't be used with the '%s' output_format", OUTPUT_FORMAT_RAW))
+	}
+	// The idempotent retry splits the batches, their responses wouldn't be in the instances order
+	if outputFormat == OUTPUT_FORMAT_RAW && idempotentRetry {
+		return nil, errors.New(fmt.Sprintf("'idempotent_retry' can't be used with the '%s' output_format", OUTPUT_FORMAT_RAW))
 	}
-	bucket, path, err := extractLocation(param[0])
+	// The idempotent retry already isolates the bad instances, but only reports their count
+	if errorRecords && idempotentRetry {
+		return nil, errors.New("'error_records' and 'idempotent_retry' can't be used together")
+	}
+	strictBatch, err := getBoolParam(r, "strict_batch", true)
+	if err != nil {
+		return nil, err
+	}
+	// The one by one predictions would have one raw response per instance, and the idempotent retry already splits
+	if !strictBatch && outputFormat == OUTPUT_FORMAT_RAW {
+		return nil, errors.New(fmt.Sprintf("'strict_batch=false' can't be used with the '%s' output_format", OUTPUT_FORMAT_RAW))
+	}
+	if !strictBatch && idempotentRetry {
+		return nil, errors.New("'strict_batch=false' and 'idempotent_retry' can't be used together")
+	}
+	protocol := getStringParam(r, "protocol", PROTOCOL_REST)
+	if protocol != PROTOCOL_REST && protocol != PROTOCOL_GRPC {
+		return nil, errors.New(fmt.Sprintf("'protocol' must be '%s' or '%s'", PROTOCOL_REST, PROTOCOL_GRPC))
+	}
+	if protocol == PROTOCOL_GRPC {
+		if tfRemoteURL != "" {
+			return nil, errors.New(fmt.Sprintf("the '%s' protocol can't be used with TF_REMOTE_URL", PROTOCOL_GRPC))
+		}
+		// The gRPC responses are converted to predictions, there is no REST body to return or query to append
+		if predictor.Name() != BACKEND_TENSORFLOW {
+			return nil, errors.New(fmt.Sprintf("the '%s' protocol requires the '%s' backend", PROTOCOL_GRPC, BACKEND_TENSORFLOW))
+		}
+		if outputFormat == OUTPUT_FORMAT_RAW {
+			return nil, errors.New(fmt.Sprintf("the '%s' output_format can't be used with the '%s' protocol", OUTPUT_FORMAT_RAW, PROTOCOL_GRPC))
+		}
+		if len(tfQuery) > 0 {
+			return nil, errors.New(fmt.Sprintf("'tf_query' can't be used with the '%s' protocol", PROTOCOL_GRPC))
+		}
+	}
+	signature := getStringParam(r, "signature", TF_DEFAULT_SIGNATURE)
+	requestFormat := getStringParam(r, "request_format", REQUEST_FORMAT_ROW)
+	if requestFormat != REQUEST_FORMAT_ROW && requestFormat != REQUEST_FORMAT_COLUMNAR {
+		return nil, errors.New(fmt.Sprintf("'request_format' must be '%s' or '%s'", REQUEST_FORMAT_ROW, REQUEST_FORMAT_COLUMNAR))
+	}
+	if (signature != TF_DEFAULT_SIGNATURE || requestFormat != REQUEST_FORMAT_ROW) && predictor.Name() != BACKEND_TENSORFLOW {
+		return nil, errors.New(fmt.Sprintf("'signature' and 'request_format' are only supported by the '%s' backend", BACKEND_TENSORFLOW))
+	}
+	method := getStringParam(r, "method", METHOD_PREDICT)
+	if method != METHOD_PREDICT && method != METHOD_CLASSIFY && method != METHOD_REGRESS {
+		return nil, errors.New(fmt.Sprintf("'method' must be '%s', '%s' or '%s'", METHOD_PREDICT, METHOD_CLASSIFY, METHOD_REGRESS))
+	}
+	if method != METHOD_PREDICT {
+		// The examples have their own request format, and the gRPC requests are predict ones
+		if predictor.Name() != BACKEND_TENSORFLOW {
+			return nil, errors.New(fmt.Sprintf("the '%s' method requires the '%s' backend", method, BACKEND_TENSORFLOW))
+		}
+		if requestFormat != REQUEST_FORMAT_ROW {
+			return nil, errors.New(fmt.Sprintf("the '%s' method can't be used with the '%s' request_format", method, requestFormat))
+		}
+		if protocol == PROTOCOL_GRPC {
+			return nil, errors.New(fmt.Sprintf("the '%s' method can't be used with the '%s' protocol", method, PROTOCOL_GRPC))
+		}
+	}
+	onUploadFailure := getStringParam(r, "on_upload_failure", ON_UPLOAD_FAILURE_REPORT)
+	if onUploadFailure != ON_UPLOAD_FAILURE_REPORT && onUploadFailure != ON_UPLOAD_FAILURE_ROLLBACK {
+		return nil, errors.New(fmt.Sprintf("'on_upload_failure' must be '%s' or '%s'", ON_UPLOAD_FAILURE_REPORT, ON_UPLOAD_FAILURE_ROLLBACK))
+	}
+	// With served models, the model param is the name of the served model
+	name := modelName
+	if len(servedModels) > 0 {
+		name = getStringParam(r, "model", "")
+		if _, ok := servedModels[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("'model' must be the name of a served model: %s", strings.Join(tfModelNames(), ", ")))
+		}
+	}
+	return &predictionOptions{
+		ModelName:         name,
+		StreamOutput:      streamOutput,
+		ErrorKey:          getStringParam(r, "error_key", DEFAULT_ERROR_KEY),
+		IncludeSubdirs:    getListParam(r, "include_subdirs"),
+		InputFilter:       inputFilter,
+		ExcludeSubdirs:    getListParam(r, "exclude_subdirs"),
+		TFQuery:           tfQuery.Encode(),
+		GroupOutput:       groupOutput,
+		Mirror:            mirror,
+		Aggregate:         aggregate,
+		AggregateName:     aggregateName,
+		OutputPrefix:      prefix,
+		OutputCompression: outputCompression,
+		OutputKey:         outputKey,
+		Select:            selectFields,
+		SelectStrict:      selectStrict,
+		AnnotateIndex:     annotateIndex,
+		Warmup:            warmup,
+		Labels:            labels,
+		WriteManifest:     writeManifest,
+		SampleRate:        sampleRate,
+		SampleSeed:        sampleSeed,
+		OnUploadFailure:   onUploadFailure,
+		OnEmptyInput:      onEmptyInput,
+		RenameFields:      renameFields,
+		OnNonFinite:       onNonFinite,
+		InterRequestDelay: time.Duration(interRequestDelay) * time.Millisecond,
+		OutputFormat:      outputFormat,
+		ValidateShapes:    validateShapes,
+		ServeLatest:       serveLatest,
+		Version:           version,
+		KeepScratch:       keepScratch,
+		Concurrency:       int(concurrency),
+		ContentTypeCheck:  contentTypeCheck,
+		AlsoReturn:        alsoReturn,
+		PredictRetries:    int(predictRetries),
+		IdempotentRetry:   idempotentRetry,
+		ManifestDetails:   manifestDetails,
+		InputFormat:       inputFormat,
+		JSONLayout:        jsonLayout,
+		CSVAllStrings:     csvAllStrings,
+		CSVDelim:          csvDelim,
+		Binary:            binary,
+		ContinueOnError:   continueOnError,
+		ErrorRecords:      errorRecords,
+		StrictBatch:       strictBatch,
+		SkipExisting:      skipExisting,
+		Overwrite:         overwrite,
+		Protocol:          protocol,
+		Signature:         signature,
+		RequestFormat:     requestFormat,
+		Method:            method,
+	}, nil
+}
+
+//Slots of the requests in progress or waiting the model, at most MAX_CONCURRENT_REQUESTS. Nil without limit
+var requestSlots = newRequestSlots(getEnvInt("MAX_CONCURRENT_REQUESTS", 0))
+
+func newRequestSlots(size int) chan struct{} {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan struct{}, size)
+}
+
+//Take a request slot. When all the slots are taken, a 503 with a Retry-After header is answered and false is returned,
+//for a backpressure signal to the load balancers instead of piling up the requests
+func acquireRequestSlot(ctx context.Context, w http.ResponseWriter) bool {
+	if requestSlots == nil {
+		return true
+	}
+	select {
+	case requestSlots <- struct{}{}:
+		return true
+	default:
+		logWarningf(ctx, "%d requests in progress, limit set by MAX_CONCURRENT_REQUESTS, request rejected", cap(requestSlots))
+		w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_SECONDS))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "too many requests in progress, retry later")
+		return false
+	}
+}
+
+//Wait a free request slot, without answering. For the jobs, which are already accepted
+func waitRequestSlot() {
+	if requestSlots != nil {
+		requestSlots <- struct{}{}
+	}
+}
+
+func releaseRequestSlot() {
+	if requestSlots != nil {
+		<-requestSlots
+	}
+}
+
+// Input File must be a JSONL (json line, with 1 full and consistent JSON object on one line)
+func LoadAndPredict(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), runPhaseKey{}, &runPhase{name: PHASE_PARAMS})
+	// The JSON error response is written once the run is done
+	w, flushError := newErrorResponseWriter(ctx, w, r)
+	defer flushError()
+
+	// Summary of the run, posted to the metrics webhook at the end with the response status
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+	metrics := &runMetrics{
+		Model:  getStringParam(r, "model", ""),
+		Input:  getStringParam(r, "input", ""),
+		Output: getStringParam(r, "output", ""),
+	}
+	predictionRequests.Inc()
+	defer func() {
+		if recorder.status != http.StatusOK {
+			failedRequests.Inc()
+		}
+		metrics.Status = recorder.status
+		metrics.Success = recorder.status == http.StatusOK
+		metrics.TotalSeconds = time.Since(start).Seconds()
+		sendMetricsAsync(ctx, *metrics)
+	}()
+
+	// The deadline cancels the downloads, the predictions and the uploads in progress, like a client disconnection
+	if requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(requestTimeout)*time.Second)
+		defer cancel()
+	}
+
+	// Root span of the run, exported with the spans of its steps at the end
+	ctx, root := startRootSpan(ctx, r, "prediction run")
+	root.set("model", metrics.Model)
+	root.set("input", metrics.Input)
+	root.set("output", metrics.Output)
+	defer func() {
+		root.set("http.status_code", recorder.status)
+		if recorder.status != http.StatusOK {
+			root.fail(errors.New(fmt.Sprintf("run answered %d", recorder.status)))
+		}
+		root.end(ctx)
+	}()
+
+	// The jobs take their slot before their run
+	if getJob(ctx) == nil {
+		if !acquireRequestSlot(ctx, w) {
+			return
+		}
+		defer releaseRequestSlot()
+	}
+
+	// Get Model param, nil for the local model
+	model, err := getModelParam(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	// Get Input param, or the list of input objects
+	input, listedInputs, err := getInputParams(r)
 	if err != nil {
-		return "", "", errors.New(fmt.Sprintf("'%s' bad formatted: %s", paramName, err.Error()))
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	// Get Output  param, a comma separated list of destinations
+	outputLocations, err := getOutputLocations(r, input)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	// Get the optional params
+	opts, err := getPredictionOptions(r)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+
+	// Get the optional Input manifest param
+	var inputManifest *storeLocation
+	if getStringParam(r, "manifest", "") != "" {
+		l, err := getParam(r, "manifest")
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		inputManifest = &l
+	}
+
+	// Get the optional JSON schema param of the instances
+	var schemaLocation *storeLocation
+	if getStringParam(r, "schema", "") != "" {
+		l, err := getParam(r, "schema")
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		schemaLocation = &l
+	}
+
+	// Check the params without running the predictions
+	isDryRun, err := getBoolParam(r, "dry_run", false)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	if isDryRun && listedInputs != nil {
+		logErrorf(ctx, "dry_run not supported with inputs")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "'dry_run' can't be used with 'inputs'")
+		return
+	}
+	if isDryRun {
+		dryRun(ctx, w, model, input, outputLocations, inputManifest, opts)
+		return
+	}
+
+	logDebugf(ctx, "param parsed successfully. Start process")
+
+	// Only one request at the time uses the model directory and the Tensorflow server. The remote server is shared
+	if tfRemoteURL == "" {
+		currentModel.mu.Lock()
+		defer currentModel.mu.Unlock()
+	}
+	getJob(ctx).start()
+
+	//Create the storage clients. The request context aborts the storage and Tensorflow server calls when the client
+	//disconnects
+	clients := newStoreProvider()
+	modelStore, modelPath, err := getModelStore(ctx, clients, model)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+	inputStore, err := clients.Store(ctx, input, inputProject)
+	if err != nil {
+		logError(ctx, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "error when creating storage client")
+		return
+	}
+	var destinations []*outputDestination
+	var outputs []string
+	for _, l := range outputLocations {
+		store, err := clients.Store(ctx, l, outputProject)
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when creating storage client")
+			return
+		}
+		d := &outputDestination{store: store, path: l.Path}
+		destinations = append(destinations, d)
+		outputs = append(outputs, d.location(""))
+	}
+
+	//Read the pinned inputs, before the model download for failing fast on an invalid manifest
+	inputs := listedInputs
+	if inputManifest != nil {
+		manifestStore, err := clients.Store(ctx, *inputManifest, inputProject)
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when creating storage client")
+			return
+		}
+		inputs, err = readInputManifest(ctx, manifestStore, inputManifest.Path)
+		if err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "error when reading the input manifest: "+err.Error())
+			return
+		}
+	}
+
+	//Read the schema of the instances, also before the model download
+	if schemaLocation != nil {
+		schemaStore, err := clients.Store(ctx, *schemaLocation, inputProject)
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when creating storage client")
+			return
+		}
+		if opts.Schema, err = readSchema(ctx, schemaStore, schemaLocation.Path); err != nil {
+			logError(ctx, err)
+			if writeCancelled(ctx, w) {
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "error when reading the schema: "+err.Error())
+			return
+		}
+	}
+
+	// Load the model, or reuse the one already loaded in persistent mode
+	setPhase(ctx, PHASE_MODEL_LOAD)
+	loadStart := time.Now()
+	tf, modelLocation, ok := loadModel(ctx, w, modelStore, modelPath, opts, metrics)
+	defer releaseModel(ctx, tf, opts)
+	metrics.ModelLoadSeconds = time.Since(loadStart).Seconds()
+	if !ok {
+		return
+	}
+	// The start of the Tensorflow server isn't interrupted by the cancellation
+	if writeCancelled(ctx, w) {
+		return
+	}
+	metrics.Model = modelLocation
+
+	manifest := &runManifest{
+		Model:     modelLocation,
+		Input:     inputStore.Location(input.Path),
+		Output:    strings.Join(outputs, ","),
+		Labels:    opts.Labels,
+		StartTime: time.Now(),
+	}
+	// The returned predictions are kept in memory until the end of the run, for reporting the errors in the response
+	var returned *bytes.Buffer
+	var inline io.Writer
+	if opts.AlsoReturn {
+		returned = &bytes.Buffer{}
+		inline = returned
+	}
+	setPhase(ctx, PHASE_PREDICTION)
+	predictionsCtx, predictions := startSpan(ctx, "predictions")
+	uploaded, err := makePredictions(predictionsCtx, inputStore, input.Path, inputs, destinations, inline, opts, manifest)
+	predictions.set("files", len(manifest.Files))
+	predictions.set("instances", manifest.Instances)
+	predictions.set("input_bytes", manifest.InputBytes)
+	predictions.set("outputs", len(uploaded))
+	predictions.fail(err)
+	predictions.end(ctx)
+	metrics.PredictionSeconds = time.Since(manifest.StartTime).Seconds()
+	metrics.Files = len(manifest.Files)
+	metrics.Instances = manifest.Instances
+	metrics.InputBytes = manifest.InputBytes
+	metrics.Outputs = len(uploaded)
+	metrics.UploadSeconds = manifest.uploadTime.Seconds()
+	if err != nil {
+		logError(ctx, err)
+		// The rollback is done even if the request is cancelled
+		partialOutputs := handlePartialOutputs(context.Background(), uploaded, opts)
+		logWarningf(ctx, "%s", partialOutputs)
+		if _, ok := err.(*inputSizeError); ok {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintln(w, err.Error())
+		} else if _, ok := err.(*notFoundError); ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "input not found: "+err.Error())
+		} else if _, ok := err.(*emptyInputError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+		} else if _, ok := err.(*instanceLimitError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+		} else if _, ok := err.(*schemaError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err.Error())
+		} else if _, ok := err.(*conflictError); ok {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, err.Error())
+		} else if tf != nil && tf.isRestarting() && ctx.Err() == nil {
+			writeRestarting(ctx, w)
+		} else if !writeCancelled(ctx, w) {
+			w.WriteHeader(http.StatusInternalServerError)
+			if tf != nil && !tf.isRunning() {
+				fmt.Fprintln(w, "error when making predictions: tensorflow server exited during the predictions")
+			} else {
+				fmt.Fprintln(w, "error when making predictions")
+			}
+		}
+		fmt.Fprintln(w, partialOutputs)
+		return
+	}
+
+	setPhase(ctx, PHASE_REPORTS)
+	if opts.ContinueOnError {
+		for _, d := range destinations {
+			if err = writeErrors(ctx, d.store, d.path, manifest.Failed, opts); err != nil {
+				logError(ctx, err)
+				if writeCancelled(ctx, w) {
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error when writing the errors report in %s\n", d.location(""))
+				return
+			}
+		}
+		if len(manifest.Failed) > 0 {
+			logWarningf(ctx, "%d input file(s) failed, listed in %s", len(manifest.Failed), outputs[0]+ERRORS_NAME)
+		}
+	}
+	if opts.ErrorRecords {
+		var rejected int
+		for _, d := range destinations {
+			if rejected, err = writeErrorRecords(ctx, d.store, d.path, manifest.Files, opts); err != nil {
+				logError(ctx, err)
+				if writeCancelled(ctx, w) {
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error when writing the error records in %s\n", d.location(""))
+				return
+			}
+		}
+		if rejected > 0 {
+			logWarningf(ctx, "%d instance(s) rejected by the serving backend, written in the %s*.jsonl error records", rejected, ERROR_RECORDS_PREFIX)
+		}
+	}
+
+	if opts.WriteManifest {
+		manifest.EndTime = time.Now()
+		for _, d := range destinations {
+			if err = writeManifest(ctx, d.store, d.path, manifest, opts); err != nil {
+				logError(ctx, err)
+				if writeCancelled(ctx, w) {
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "error when writing the manifest in %s\n", d.location(""))
+				return
+			}
+		}
+	}
+
+	// Number of outputs uploaded per destination
+	counts := map[*outputDestination]int{}
+	for _, u := range uploaded {
+		counts[u.destination]++
+	}
+	for _, d := range destinations {
+		logInfof(ctx, "%d output(s) uploaded in %s", counts[d], d.location(""))
+	}
+
+	if returned != nil {
+		w.Header().Set("Content-Type", getEncoder(opts.OutputFormat).ContentType())
+		w.WriteHeader(http.StatusOK)
+		if _, err = returned.WriteTo(w); err != nil {
+			logError(ctx, err)
+		}
+		return
+	}
+
+	summary := runSummary{
+		ModelDownloadSeconds: metrics.ModelDownloadSeconds,
+		TFStartupSeconds:     metrics.TFStartupSeconds,
+		PredictionSeconds:    metrics.PredictionSeconds,
+		UploadSeconds:        metrics.UploadSeconds,
+		TotalSeconds:         time.Since(start).Seconds(),
+		Files:                metrics.Files,
+		Instances:            metrics.Instances,
+		FailedFiles:          len(manifest.Failed),
+		SkippedFiles:         len(manifest.Skipped),
+		Outputs:              map[string]int{},
+	}
+	for _, d := range destinations {
+		summary.Outputs[d.location("")] = counts[d]
+	}
+	if opts.KeepScratch {
+		summary.ScratchPath = localModelPath
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summary)
+}
+
+//Download the model and start the Tensorflow server on it, or reuse them if the model is already loaded in persistent
+//mode. The returned server must be released at the end of the request, even on failure. The storage location of the
+//loaded model is returned. On failure, the error response is written and false is returned.
+//The durations of the download and of the start are recorded in the metrics
+func loadModel(ctx context.Context, w http.ResponseWriter, modelStore ObjectStore, pathModel string, opts *predictionOptions, metrics *runMetrics) (*tfServer, string, bool) {
+	// The served models are all loaded at startup. A restart in progress is waited
+	if len(servedModels) > 0 {
+		if servedServer.isRestarting() && !servedServer.waitRestart(ctx) {
+			if !writeCancelled(ctx, w) {
+				writeRestarting(ctx, w)
+			}
+			return nil, "", false
+		}
+		if !servedServer.isRunning() {
+			logErrorf(ctx, "tensorflow server of the served models not running")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "tensorflow server of the served models not running")
+			return nil, "", false
+		}
+		return servedServer, servedModels[opts.ModelName], true
+	}
+
+	// The remote model is only checked, there is no local server to return
+	if tfRemoteURL != "" {
+		if opts.ServeLatest {
+			logErrorf(ctx, "serve_latest not supported with the remote Tensorflow server")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "'serve_latest' can't be used with the remote Tensorflow server of TF_REMOTE_URL")
+			return nil, "", false
+		}
+		if err := predictor.ModelAvailable(); err != nil {
+			logErrorf(ctx, "remote model %s not available: %s", predictor.StatusURL(), err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "remote model %s not available\n", predictor.StatusURL())
+			return nil, "", false
+		}
+		return nil, predictor.StatusURL(), true
+	}
+
+	// Select the requested version of the model, or the latest one, kept under its own version directory
+	modelPath := predictor.ModelPath()
+	if modelStore == nil && (opts.ServeLatest || opts.Version != "") {
+		logErrorf(ctx, "serve_latest and version not supported with the local model")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "'serve_latest' and 'version' can't be used with the local model of MODEL_BASE_PATH")
+		return nil, "", false
+	}
+	if isModelArchive(pathModel) && (opts.ServeLatest || opts.Version != "") {
+		logErrorf(ctx, "serve_latest and version not supported with a model archive")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "'serve_latest' and 'version' can't be used with a model archive, the archive is a single version")
+		return nil, "", false
+	}
+	if opts.Version != "" {
+		logInfof(ctx, "model version %s requested", opts.Version)
+		pathModel += opts.Version + "/"
+		modelPath = localModelPath + opts.Version + "/"
+	}
+	if opts.ServeLatest {
+		if predictor.Name() != BACKEND_TENSORFLOW {
+			logErrorf(ctx, "serve_latest not supported by the %s backend", predictor.Name())
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "'serve_latest' is only supported by the %s backend\n", BACKEND_TENSORFLOW)
+			return nil, "", false
+		}
+		version, err := getLatestVersion(ctx, modelStore, pathModel)
+		if err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "error when selecting the latest model version: "+err.Error())
+			return nil, "", false
+		}
+		logInfof(ctx, "latest model version %s selected", version)
+		pathModel += version + "/"
+		modelPath = localModelPath + version + "/"
+	}
+
+	modelKey := SCHEME_FILE + "://" + modelBasePath
+	if modelStore != nil {
+		modelKey = modelStore.Location(pathModel)
+	}
+	tf, loadedKey := currentModel.get()
+	// The loaded model is kept while its server restarts after an unexpected exit, instead of being loaded again
+	if persistentModel && tf != nil && loadedKey == modelKey && tf.isRestarting() {
+		logInfof(ctx, "tensorflow server of the model %s restarting, waiting for it", modelKey)
+		if !tf.waitRestart(ctx) {
+			if !writeCancelled(ctx, w) {
+				writeRestarting(ctx, w)
+			}
+			return nil, "", false
+		}
+	}
+	if persistentModel && currentModel.isLoaded(modelKey) {
+		logInfof(ctx, "model %s already loaded, download and Tensorflow start skipped", modelKey)
+		// The reused server is already warm from the previous predictions
+		opts.Warmup = false
+	} else {
+		// Clear the previous model, a kept scratch included. A complete downloaded model is kept in the model cache
+		currentModel.unload()
+		modelCache.clearLocal(ctx)
+
+		var err error
+		// A model already downloaded by a previous request is moved back from the model cache, if its objects are
+		// unchanged in the storage
+		servedPath, cached, fingerprint := "", false, ""
+		if modelStore != nil && modelCacheBytes > 0 {
+			if fingerprint, err = modelFingerprint(ctx, modelStore, pathModel); err != nil {
+				logWarningf(ctx, "model %s not looked up in the model cache: %s", modelKey, err)
+				fingerprint = ""
+			} else {
+				servedPath, cached = modelCache.restore(ctx, modelKey, fingerprint)
+			}
+		}
+		if cached {
+			modelPath = localModelPath + servedPath
+			metrics.ModelCacheHit = true
+			logInfof(ctx, "model %s restored from the model cache, download skipped", modelKey)
+		} else {
+			//Download model, or link the local one
+			downloadStart := time.Now()
+			downloadCtx, download := startSpan(ctx, "model download")
+			if modelStore != nil {
+				download.set("storage.location", modelStore.Location(pathModel))
+				err = downloadModel(downloadCtx, modelStore, pathModel, modelPath)
+			} else {
+				download.set("storage.location", modelKey)
+				err = linkLocalModel(modelPath)
+			}
+			download.fail(err)
+			download.end(ctx)
+			if err != nil {
+				logError(ctx, err)
+				if writeCancelled(ctx, w) {
+					return nil, "", false
+				}
+				if _, ok := err.(*notFoundError); ok {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintln(w, "model not found: "+err.Error())
+					return nil, "", false
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "error when downloading model files")
+				return nil, "", false
+			}
+
+			metrics.ModelDownloadSeconds = time.Since(downloadStart).Seconds()
+			logInfof(ctx, "model loaded to %s in %.3fs", modelPath, metrics.ModelDownloadSeconds)
+
+			// A model param which is a base directory of versions is served with its versions, not under the dummy version
+			if predictor.Name() == BACKEND_TENSORFLOW && modelPath == localModelPath+MODEL_DUMMY_VERSION {
+				versioned, err := arrangeVersions(modelPath)
+				if err != nil {
+					logError(ctx, err)
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintln(w, "error when arranging the model versions")
+					return nil, "", false
+				}
+				if versioned {
+					logInfof(ctx, "model %s has numeric version directories, served with its versions", modelKey)
+					modelPath = localModelPath
+				}
+			}
+		}
+
+		// Fail fast on a path which isn't a model, instead of waiting the start timeout of the server
+		if err = predictor.ValidateModel(modelPath); err != nil {
+			logError(ctx, err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid model %s: %s\n", modelKey, err)
+			return nil, "", false
+		}
+
+		// Start tensorflow serving with the model. Blocking start until the initialization
+		setPhase(ctx, PHASE_TF_STARTUP)
+		startupStart := time.Now()
+		_, startup := startSpan(ctx, "tensorflow startup")
+		tf, err = startTFServer(ctx)
+		startup.fail(err)
+		startup.end(ctx)
+		if err != nil {
+			tf.stop()
+			logError(ctx, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "error when starting tensorflow: "+err.Error())
+			return nil, "", false
+		}
+		metrics.TFStartupSeconds = time.Since(startupStart).Seconds()
+		logInfof(ctx, "tensorflow server started in %.3fs", metrics.TFStartupSeconds)
+		if modelStore != nil {
+			modelCache.setLocal(modelKey, fingerprint, strings.TrimPrefix(modelPath, localModelPath))
+		}
+		if persistentModel {
+			currentModel.set(modelKey, tf)
+			logInfof(ctx, "model %s kept loaded for the next requests", modelKey)
+		}
+	}
+
+	return tf, modelKey, true
+}
+
+//Get the model param. Without it, the local model of MODEL_BASE_PATH is used if set, nil is then returned. With served
+//models, the param is a model name, checked with the options, and nil is returned. With the remote Tensorflow server,
+//the param is ignored and nil is returned
+func getModelParam(r *http.Request) (*storeLocation, error) {
+	if len(servedModels) > 0 || tfRemoteURL != "" {
+		return nil, nil
+	}
+	if modelBasePath != "" && getStringParam(r, "model", "") == "" {
+		return nil, nil
+	}
+	model, err := getParam(r, "model")
+	if err != nil {
+		return nil, err
+	}
+	// Model path must be the directory where the pb and variables are stored, or a model archive
+	if !strings.HasSuffix(model.Path, "/") && !isModelArchive(model.Path) {
+		model.Path += "/"
+	}
+	return &model, nil
+}
+
+//Get the store and the path of the model. Nil and empty for the local model
+func getModelStore(ctx context.Context, clients StoreProvider, model *storeLocation) (ObjectStore, string, error) {
+	if model == nil {
+		return nil, "", nil
+	}
+	store, err := clients.Store(ctx, *model, modelProject)
+	return store, model.Path, err
+}
+
+//Link the local model of MODEL_BASE_PATH in the model directory of the backend, instead of downloading it. In the
+//versioned layout, where the model directory is the base path, each version directory is linked. Only the links are
+//deleted with the model directory
+func linkLocalModel(modelPath string) error {
+	base := strings.TrimSuffix(modelBasePath, "/")
+	if modelPath != localModelPath {
+		if err := os.MkdirAll(filepath.Dir(strings.TrimSuffix(modelPath, "/")), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(base, strings.TrimSuffix(modelPath, "/"))
+	}
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(localModelPath, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = os.Symlink(base+"/"+e.Name(), localModelPath+e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Write the request cancelled response if the request has been cancelled, by the client or by its deadline. The failure
+//of the current step is then a consequence of the cancellation. The exceeded REQUEST_TIMEOUT answers a 504 with the
+//step in progress. Return false if the request isn't cancelled
+func writeCancelled(ctx context.Context, w http.ResponseWriter) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		phase := getPhase(ctx)
+		logWarningf(ctx, "request timeout of %ds exceeded during the %s", requestTimeout, phase)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		fmt.Fprintf(w, "request timeout of %ds exceeded during the %s\n", requestTimeout, phase)
+		return true
+	}
+	logWarningf(ctx, "request cancelled: %s", ctx.Err())
+	w.WriteHeader(STATUS_REQUEST_CANCELLED)
+	fmt.Fprintf(w, "request cancelled: %s\n", ctx.Err())
+	return true
+}
+
+//Step of the run in progress
+type runPhase struct {
+	mu   sync.Mutex
+	name string
+}
+
+type runPhaseKey struct{}
+
+//Record the step of the run in progress. Nothing is recorded outside of a prediction run
+func setPhase(ctx context.Context, name string) {
+	if p, ok := ctx.Value(runPhaseKey{}).(*runPhase); ok {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.name = name
+	}
+}
+
+func getPhase(ctx context.Context) string {
+	p, ok := ctx.Value(runPhaseKey{}).(*runPhase)
+	if !ok {
+		return "request"
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.name
+}
+
+//Stop the Tensorflow server and clean the local model at the end of the request, unless they are kept. In persistent
+//mode, the loaded model is kept, also when the request failed before replacing it, but a partial download or a failed
+//start is cleaned
+func releaseModel(ctx context.Context, tf *tfServer, opts *predictionOptions) {
+	if tf != nil && tf == servedServer {
+		return
+	}
+	if loaded, _ := currentModel.get(); persistentModel && loaded != nil && (tf == nil || tf == loaded) {
+		return
+	}
+	if tf != nil {
+		tf.stop()
+	}
+	if opts.KeepScratch {
+		logInfof(ctx, "keep_scratch set, local model files kept in %s", localModelPath)
+		return
+	}
+	modelCache.clearLocal(ctx)
+}
+
+//Start the Tensorflow server and wait the start marker of the backend, "Exporting HTTP/REST API" for Tensorflow, for
+//considering the start completed and ready to use.
+//If the server is not in a ready state after a timeout, or if it exits before, an error is raised and the process is
+//killed. Else the returned channel receives the result of the process Wait when it exits
+func startAndWaitTF(cmd *exec.Cmd) (<-chan error, error) {
+	cmd.Stdout = os.Stdout
+	// Pipe closed only by the end of the process, for reading the logs while the process is waited
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = pw
+
+	start := time.Now()
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	tail := &logTail{}
+	captured := make(chan struct{})
+	ready := make(chan error, 1)
+	//Catch the output in a goroutine and evaluate them!
+	go func() {
+		defer pr.Close()
+		stderrIn := bufio.NewReader(pr)
+		err := copyAndCapture(io.MultiWriter(os.Stderr, tail), stderrIn, predictor.StartMarker())
+		close(captured)
+		if err == io.EOF {
+			// The logs ended without the marker. They can be buffered or written elsewhere, check the port directly
+			logInfof(context.Background(), "end of Tensorflow logs without the start marker, polling the REST API port")
+			err = pollTFReady()
+		}
+		if err == nil {
+			err = waitModelAvailable(start.Add(time.Duration(tfStartupTimeout) * time.Second))
+		}
+		ready <- err
+		if err == nil {
+			// Keep forwarding the output, else the server blocks when the pipe is full
+			io.Copy(os.Stderr, stderrIn)
+		}
+	}()
+
+	// Wait, the TF startup, its exit or the timeout
+	select {
+	case err = <-ready:
+		if err == nil {
+			tfStartupSeconds.Observe(time.Since(start).Seconds())
+			logInfof(context.Background(), "Tensorflow Started. Continue the process")
+			return exited, nil
+		}
+	case err = <-exited:
+		// Let the last logs be read
+		select {
+		case <-captured:
+		case <-time.After(time.Second):
+		}
+		reason := "exit status 0"
+		if err != nil {
+			reason = err.Error()
+		}
+		return nil, errors.New(fmt.Sprintf("tensorflow server exited during the startup with %s, last logs:\n%s", reason, tail))
+	case <-time.After(time.Duration(tfStartupTimeout) * time.Second):
+		logErrorf(context.Background(), "timeout exceeded. TF doesn't start in %d seconds", tfStartupTimeout)
+		err = errors.New("timeout exceeded")
+	}
+	cmd.Process.Kill()
+	<-exited
+	return nil, err
+}
+
+//Last bytes of the logs, for reporting why the server exited during the startup
+type logTail struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > tfLogTailBytes {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-tfLogTailBytes:]...)
+	}
+	return len(p), nil
+}
+
+func (t *logTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+//Poll the REST API of the Tensorflow server until the model status answers, up to TF_READY_RETRIES times
+func pollTFReady() error {
+	var err error
+	for i := 0; i < tfReadyRetries; i++ {
+		var resp *http.Response
+		resp, err = tfClient.Get(predictor.StatusURL())
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = errors.New(fmt.Sprintf("model status returned %s", resp.Status))
+		}
+		time.Sleep(TF_READY_POLL_INTERVAL)
+	}
+	return errors.New(fmt.Sprintf("tensorflow server not ready after %d checks: %s", tfReadyRetries, err))
+}
+
+//Poll the model status until the model is available, the API can be exported before the model is loaded. The
+//polling stops at the deadline of the startup
+func waitModelAvailable(deadline time.Time) error {
+	for {
+		err := predictor.ModelAvailable()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("model not available before the startup timeout: %s", err))
+		}
+		time.Sleep(TF_READY_POLL_INTERVAL)
+	}
+}
+
+//Supervised Tensorflow server process. When the process exits without being stopped, it's restarted, with the same
+//model, up to TF_MAX_RESTARTS times
+type tfServer struct {
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	running  bool
+	stopped  bool
+	restarts int
+	//Restart in progress after an unexpected exit
+	restarting bool
+	//Started by the CPU fallback, the restarts are also on CPU
+	cpu bool
+}
+
+//Start a supervised Tensorflow server. With TF_CPU_FALLBACK, a failed startup, like with GPU flags on a node without
+//GPU, is retried once on CPU
+func startTFServer(ctx context.Context) (*tfServer, error) {
+	s := &tfServer{}
+	err := s.start()
+	if !tfCPUFallback || predictor.Name() != BACKEND_TENSORFLOW {
+		return s, err
+	}
+	if err == nil {
+		logInfof(ctx, "tensorflow server started in GPU mode, with the configured flags")
+		return s, nil
+	}
+	s.stop()
+	logWarningf(ctx, "tensorflow server startup failed, new attempt on CPU with TF_CPU_FALLBACK: %s", err)
+	s = &tfServer{cpu: true}
+	if err = s.start(); err != nil {
+		return s, errors.New("startup failed, also with the CPU fallback: " + err.Error())
+	}
+	logWarningf(ctx, "tensorflow server started in CPU fallback mode, without the GPU flags and the GPUs hidden")
+	return s, nil
+}
+
+//Start the Tensorflow server, wait it's ready and supervise it
+func (s *tfServer) start() error {
+	cmd := predictor.Command()
+	if s.cpu {
+		cmd = cpuCommand(cmd)
+	}
+	exited, err := startAndWaitTF(cmd)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || !trackServer(s) {
+		// Stopped during the startup, or by the shutdown
+		cmd.Process.Kill()
+		<-exited
+		return errors.New("tensorflow server stopped during the startup")
+	}
+	s.cmd = cmd
+	s.running = true
+	s.restarting = false
+	go s.supervise(cmd, exited)
+	return nil
+}
+
+//Wait the end of the process and restart it if it hasn't been stopped
+func (s *tfServer) supervise(cmd *exec.Cmd, exited <-chan error) {
+	err := <-exited
+
+	s.mu.Lock()
+	s.running = false
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	logErrorf(context.Background(), "tensorflow server exited unexpectedly with code %d: %v", cmd.ProcessState.ExitCode(), err)
+	s.restarting = true
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		if s.stopped {
+			s.restarting = false
+			s.mu.Unlock()
+			return
+		}
+		if s.restarts >= tfMaxRestarts {
+			logErrorf(context.Background(), "tensorflow server not restarted, max restarts reached (%d)", tfMaxRestarts)
+			s.restarting = false
+			s.mu.Unlock()
+			return
+		}
+		s.restarts++
+		logWarningf(context.Background(), "restarting tensorflow server (%d/%d)", s.restarts, tfMaxRestarts)
+		s.mu.Unlock()
+
+		if err := s.start(); err != nil {
+			logErrorf(context.Background(), "tensorflow server restart failed: %v", err)
+			continue
+		}
+		return
+	}
+}
+
+//Stop the Tensorflow server. It won't be restarted
+func (s *tfServer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	untrackServer(s)
+	if s.running {
+		s.cmd.Process.Kill()
+	}
+}
+
+//Return true if the Tensorflow server process is running
+func (s *tfServer) isRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+//Return true while the Tensorflow server is restarted after an unexpected exit
+func (s *tfServer) isRestarting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restarting
+}
+
+//Wait the end of the restart in progress, up to the startup timeout or the cancellation of the context. Return true if
+//the server is running
+func (s *tfServer) waitRestart(ctx context.Context) bool {
+	deadline := time.Now().Add(time.Duration(tfStartupTimeout) * time.Second)
+	for s.isRestarting() && time.Now().Before(deadline) {
+		if sleepContext(ctx, TF_READY_POLL_INTERVAL) != nil {
+			break
+		}
+	}
+	return s.isRunning()
+}
+
+//Answer a 503 with a Retry-After header when the Tensorflow server is restarting: the request can be retried once
+//it's running again
+func writeRestarting(ctx context.Context, w http.ResponseWriter) {
+	logWarningf(ctx, "tensorflow server restarting, request answered with a %d", http.StatusServiceUnavailable)
+	w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER_SECONDS))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, "tensorflow server restarting, retry later")
+}
+
+// Run TF and copy the output to the writer, line by line. Exit in success when the start marker of the backend,
+// "Exporting HTTP/REST API" for Tensorflow, is found in the logs. The lines after the marker stay in the reader.
+// Nothing is retained here, the writer keeps the logs it needs, like the bounded logTail
+func copyAndCapture(w io.Writer, r *bufio.Reader, marker string) error {
+	for {
+		// Blocking until a full line, or the end of the logs
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+			if strings.Contains(line, marker) {
+				// The server is running
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//Perform the prediction file by file. The output folder hierarchy respect the input one.
+//With concurrency, up to concurrency files are predicted in parallel by orderedPredictions, their predictions are
+//buffered and written in the input order. Else one file is processed at the time, streamed to its output
+//The processed files are recorded in the manifest. The names of the uploaded output objects are returned, also in
+//case of error
+func makePredictions(ctx context.Context, inputStore ObjectStore, inputPath string, inputs []filePath, destinations []*outputDestination, inline io.Writer, opts *predictionOptions, manifest *runManifest) ([]uploadedOutput, error) {
+
+	// Get inputs of input file, if they aren't pinned by an input manifest
+	var err error
+	if inputs == nil {
+		inputs, err = listFiles(ctx, inputStore, inputPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(inputs) == 0 {
+			return nil, &notFoundError{message: fmt.Sprintf("no input file in %s", inputStore.Location(inputPath))}
+		}
+	}
+	inputs = filterSubdirs(ctx, inputs, opts.IncludeSubdirs, opts.ExcludeSubdirs)
+	inputs = filterFileNames(ctx, inputs, opts.InputFilter)
+	if opts.Mirror {
+		inputs = skipOutputFiles(ctx, inputStore, inputPath, inputs, destinations)
+	}
+	if err = checkContentTypes(ctx, inputs, opts.ContentTypeCheck); err != nil {
+		return nil, err
+	}
+
+	//Get the root path of the input.
+	rootInputPath := inputPath[:strings.LastIndex(inputPath, "/")+1]
+	if err = checkInputSizes(rootInputPath, inputs); err != nil {
+		return nil, err
+	}
+
+	// The aggregated output follows the sorted input names, like the listing, also for the inputs pinned by a manifest
+	if opts.Aggregate {
+		sort.SliceStable(inputs, func(i, j int) bool {
+			return inputs[i].RelativePath+inputs[i].FileName < inputs[j].RelativePath+inputs[j].FileName
+		})
+	}
+
+	// Re-runs only predict the inputs without output
+	if opts.SkipExisting {
+		var skipped []filePath
+		if inputs, skipped, err = skipExistingOutputs(ctx, inputs, destinations, opts); err != nil {
+			return nil, err
+		}
+		for _, s := range skipped {
+			manifest.Skipped = append(manifest.Skipped, rootInputPath+s.RelativePath+s.FileName)
+		}
+	}
+	if !opts.Overwrite {
+		if err = checkExistingOutputs(ctx, inputs, destinations, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	getJob(ctx).setTotal(len(inputs))
+
+	if opts.Warmup && len(inputs) > 0 {
+		warmupModel(ctx, inputStore, rootInputPath, inputs[0], opts)
+	}
+
+	// Count of the predicted instances, for MAX_TOTAL_INSTANCES
+	ctx = context.WithValue(ctx, instanceTallyKey{}, new(int64))
+	sampler := newInstanceSampler(ctx, opts, opts.SampleSeed)
+	// Manifest entries of the input files, filled with their prediction requests during the predictions
+	files := make([]*manifestFile, len(inputs))
+	for i := range files {
+		files[i] = &manifestFile{}
+	}
+	// In parallel, the predictions are written in the input order. Each file has its own sampling seed, for a
+	// reproducible sample whatever the completion order
+	var ordered *orderedPredictions
+	if opts.Concurrency > 1 {
+		logInfof(ctx, "%d input files predicted in parallel", opts.Concurrency)
+		ordered = newOrderedPredictions(ctx, len(inputs), opts.Concurrency, opts.InterRequestDelay, func(ctx context.Context, i int, w io.Writer) (int, error) {
+			return executePrediction(ctx, inputStore, rootInputPath, inputs[i], opts, newInstanceSampler(ctx, opts, opts.SampleSeed+int64(i)), w, files[i].trace(opts), files[i].errorRecords(opts))
+		})
+		defer ordered.stop()
+	}
+	uploads := newUploadPool(uploadConcurrency)
+	var output *multiOutput
+	// Index of the manifest files of the current output
+	outputFiles := 0
+	//Commit the current output in the background. Without continue_on_error, the run stops after a failed upload
+	commit := func() error {
+		if (opts.ContinueOnError && outputFiles == len(manifest.Files)) || (!opts.ContinueOnError && uploads.failed()) {
+			// All the input files of the output failed, or the run stops, nothing to upload
+			output.abort()
+			output = nil
+			if !opts.ContinueOnError {
+				return errUploadFailed
+			}
+			return nil
+		}
+		uploads.commit(output, outputFiles, len(manifest.Files))
+		output = nil
+		return nil
+	}
+	//Wait the uploads in progress and return all the committed outputs, also in case of error. With
+	//continue_on_error, the input files of a failed upload are failed, else the upload errors are combined in the
+	//returned error
+	finish := func(err error) ([]uploadedOutput, error) {
+		// A failed prediction stays in the predictions phase, for the code of its error
+		if err == nil || err == errUploadFailed {
+			setPhase(ctx, PHASE_UPLOAD)
+		}
+		var uploaded []uploadedOutput
+		var errs []string
+		if err != nil && err != errUploadFailed {
+			errs = append(errs, err.Error())
+		}
+		failedFiles := map[int]bool{}
+		for _, u := range uploads.wait() {
+			uploaded = append(uploaded, u.output.committed...)
+			if u.err == nil {
+				continue
+			}
+			if opts.ContinueOnError && ctx.Err() == nil {
+				logError(ctx, u.err)
+				for i := u.from; i < u.to; i++ {
+					f := manifest.Files[i]
+					manifest.Failed = append(manifest.Failed, failedInput{Input: f.Input, Generation: f.Generation, Error: u.err.Error()})
+					failedFiles[i] = true
+				}
+				continue
+			}
+			errs = append(errs, u.err.Error())
+		}
+		manifest.uploadTime = uploads.duration
+		if len(failedFiles) > 0 {
+			var kept []manifestFile
+			for i, f := range manifest.Files {
+				if !failedFiles[i] {
+					kept = append(kept, f)
+				}
+			}
+			manifest.Files = kept
+		}
+		switch {
+		case len(errs) == 1 && err != nil && err != errUploadFailed:
+			// Only the error of the run, kept as is for its status
+		case len(errs) == 1:
+			err = errors.New(errs[0])
+		case len(errs) > 1:
+			err = errors.New(fmt.Sprintf("%d errors:\n%s", len(errs), strings.Join(errs, "\n")))
+		}
+		return uploaded, err
+	}
+
+	for i, input := range inputs {
+		// Pace the prediction requests, for sharing the serving backend politely. Done at the start in parallel
+		if ordered == nil && i > 0 && opts.InterRequestDelay > 0 {
+			if err = sleepContext(ctx, opts.InterRequestDelay); err != nil {
+				if output != nil {
+					output.abort()
+				}
+				return finish(err)
+			}
+		}
+
+		// Inputs of the same group are contiguous in the listing. Commit the output of the previous group
+		name := getOutputName(input, opts)
+		if output != nil && name != output.name {
+			if err = commit(); err != nil {
+				return finish(err)
+			}
+		}
+		if output == nil {
+			output = openOutputs(ctx, destinations, name, opts, inline)
+			outputFiles = len(manifest.Files)
+		}
+
+		//Execute the prediction on each input. Extracted function for preventing memory leaks (defer in loop for)
+		var predicted int
+		if ordered != nil {
+			predicted, err = ordered.writeNext(i, output)
+		} else if opts.ContinueOnError {
+			// Buffered, for not writing the predictions of a failed file in the output
+			buffer := &bytes.Buffer{}
+			predicted, err = executePrediction(ctx, inputStore, rootInputPath, input, opts, sampler, buffer, files[i].trace(opts), files[i].errorRecords(opts))
+			if err == nil {
+				_, err = io.Copy(output, buffer)
+			}
+		} else {
+			predicted, err = executePrediction(ctx, inputStore, rootInputPath, input, opts, sampler, output, files[i].trace(opts), files[i].errorRecords(opts))
+		}
+		getJob(ctx).fileDone()
+		_, limited := err.(*instanceLimitError)
+		if err != nil && opts.ContinueOnError && ctx.Err() == nil && !limited {
+			logWarningf(ctx, "input file %s%s failed, run continued: %s", input.RelativePath, input.FileName, err)
+			spanFromContext(ctx).event("input file failed", map[string]interface{}{"input": input.RelativePath + input.FileName, "error": err.Error()})
+			manifest.Failed = append(manifest.Failed, failedInput{
+				Input:      rootInputPath + input.RelativePath + input.FileName,
+				Generation: input.Generation,
+				Error:      err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			output.abort()
+			if ordered != nil && !limited {
+				err = ordered.aggregate(i, inputs, err)
+			}
+			return finish(err)
+		}
+		filesPredicted.Inc()
+		manifest.Instances += int64(predicted)
+		manifest.InputBytes += input.Size
+		files[i].Input = rootInputPath + input.RelativePath + input.FileName
+		files[i].Generation = input.Generation
+		files[i].Output = name
+		manifest.Files = append(manifest.Files, *files[i])
+		spanFromContext(ctx).event("input file predicted", map[string]interface{}{
+			"input":     files[i].Input,
+			"instances": predicted,
+			"bytes":     input.Size,
+		})
+	}
+	// The error of a file failed with continue_on_error isn't the run result
+	err = nil
+	if output != nil {
+		err = commit()
+	}
+	return finish(err)
+}
+
+//Apply the ON_UPLOAD_FAILURE policy on the output objects uploaded before the failure of the run and return the
+//description of the result.
+//In rollback, the uploaded objects are deleted, else they are kept and listed
+func handlePartialOutputs(ctx context.Context, uploaded []uploadedOutput, opts *predictionOptions) string {
+	if len(uploaded) == 0 {
+		return "no output uploaded"
+	}
+	var locations []string
+	for _, u := range uploaded {
+		locations = append(locations, u.destination.location(u.name))
+	}
+	if opts.OnUploadFailure != ON_UPLOAD_FAILURE_ROLLBACK {
+		return fmt.Sprintf("%d output(s) uploaded before the failure:\n%s", len(uploaded), strings.Join(locations, "\n"))
+	}
+
+	var notDeleted []string
+	for i, u := range uploaded {
+		if err := u.destination.store.Delete(ctx, u.destination.path+u.name); err != nil {
+			logErrorf(ctx, "rollback of %s failed: %s", locations[i], err)
+			notDeleted = append(notDeleted, locations[i])
+		}
+	}
+	if len(notDeleted) > 0 {
+		return fmt.Sprintf("rollback failed, %d output(s) not deleted:\n%s", len(notDeleted), strings.Join(notDeleted, "\n"))
+	}
+	return fmt.Sprintf("rollback completed, %d output(s) deleted", len(uploaded))
+}
+
+//Split the inputs between the ones to predict and the ones skipped because their output object already exists in all
+//the destinations. Per directory, all the inputs of an existing output are skipped
+func skipExistingOutputs(ctx context.Context, inputs []filePath, destinations []*outputDestination, opts *predictionOptions) ([]filePath, []filePath, error) {
+	// Number of destinations which contain each output
+	existing := map[string]int{}
+	for _, d := range destinations {
+		outputs, err := listFiles(ctx, d.store, d.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, o := range outputs {
+			existing[o.RelativePath+o.FileName]++
+		}
+	}
+
+	var kept, skipped []filePath
+	for _, input := range inputs {
+		if existing[getOutputName(input, opts)] == len(destinations) {
+			skipped = append(skipped, input)
+			continue
+		}
+		kept = append(kept, input)
+	}
+	logInfof(ctx, "%d input file(s) skipped on %d, their output already exists", len(skipped), len(inputs))
+	return kept, skipped, nil
+}
+
+//Fail with a conflict error on the first output object of the inputs which already exists in a destination
+func checkExistingOutputs(ctx context.Context, inputs []filePath, destinations []*outputDestination, opts *predictionOptions) error {
+	for _, d := range destinations {
+		outputs, err := listFiles(ctx, d.store, d.path)
+		if err != nil {
+			return err
+		}
+		existing := map[string]bool{}
+		for _, o := range outputs {
+			existing[o.RelativePath+o.FileName] = true
+		}
+		for _, input := range inputs {
+			if name := getOutputName(input, opts); existing[name] {
+				return &conflictError{fmt.Sprintf("output object %s already exists and overwrite is false", d.location(name))}
+			}
+		}
+	}
+	return nil
+}
+
+//Get the output object name, relative to the output path, of the input file.
+//Per file, the output has the same relative path and name as the input. Per directory, the output is named after
+//the top level subdirectory of the input, and the files at the root of the input path keep their own output. In
+//aggregate, all the inputs have the same output, named after the aggregate name.
+//The output prefix is added to the name, not to the relative path. The compressed outputs end by .gz
+func getOutputName(input filePath, opts *predictionOptions) string {
+	name := input.RelativePath + opts.OutputPrefix + input.FileName
+	if opts.Aggregate {
+		name = opts.AggregateName
+	} else if opts.GroupOutput == GROUP_OUTPUT_PER_DIR && input.RelativePath != "" {
+		name = opts.OutputPrefix + strings.SplitN(input.RelativePath, "/", 2)[0]
+	}
+	if opts.OutputCompression == OUTPUT_COMPRESSION_GZIP && !strings.HasSuffix(name, GZIP_SUFFIX) {
+		name += GZIP_SUFFIX
+	}
+	return name
+}
+
+//Skip the input files inside an output destination, like the predictions of a previous run in the mirror directory
+//under the input path
+func skipOutputFiles(ctx context.Context, inputStore ObjectStore, inputPath string, files []filePath, destinations []*outputDestination) []filePath {
+	rootInputPath := inputPath[:strings.LastIndex(inputPath, "/")+1]
+	var ret []filePath
+	for _, f := range files {
+		location := inputStore.Location(rootInputPath + f.RelativePath + f.FileName)
+		inside := false
+		for _, d := range destinations {
+			if strings.HasPrefix(location, d.location("")) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			ret = append(ret, f)
+		}
+	}
+	if len(ret) < len(files) {
+		logInfof(ctx, "%d input file(s) skipped, they are in the output location", len(files)-len(ret))
+	}
+	return ret
+}
+
+//Keep only the files whose name matches one of the patterns: a glob, like "*.jsonl", or else a suffix, like ".jsonl".
+//The match is on the file name, not on the relative path. The skipped files are logged
+func filterFileNames(ctx context.Context, files []filePath, patterns []string) []filePath {
+	if len(patterns) == 0 {
+		return files
+	}
+	var ret []filePath
+	for _, f := range files {
+		if matchFileName(f.FileName, patterns) {
+			ret = append(ret, f)
+			continue
+		}
+		logDebugf(ctx, "input file %s%s skipped, its name doesn't match the input_filter", f.RelativePath, f.FileName)
+	}
+	logInfof(ctx, "%d input file(s) kept on %d after the input_filter", len(ret), len(files))
+	return ret
+}
+
+func matchFileName(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			if strings.HasSuffix(name, pattern) {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Keep only the files in the included subdirectories and not in the excluded ones. The match is a prefix match on the
+//relative path, by directory: "2020" matches "2020/" and "2020/01/" but not "2020-old/".
+//When includes are set, the files at the root of the input path are skipped.
+func filterSubdirs(ctx context.Context, files []filePath, includes []string, excludes []string) []filePath {
+	if len(includes) == 0 && len(excludes) == 0 {
+		return files
+	}
+	matchAny := func(relativePath string, subdirs []string) bool {
+		for _, subdir := range subdirs {
+			if !strings.HasSuffix(subdir, "/") {
+				subdir += "/"
+			}
+			if strings.HasPrefix(relativePath, subdir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var ret []filePath
+	for _, f := range files {
+		if len(includes) > 0 && !matchAny(f.RelativePath, includes) {
+			continue
+		}
+		if matchAny(f.RelativePath, excludes) {
+			continue
+		}
+		ret = append(ret, f)
+	}
+	logInfof(ctx, "%d input file(s) kept on %d after subdirectories filtering", len(ret), len(files))
+	return ret
+}
+
+//Return true if the content starts with the gzip magic bytes. JSON content can't start with them
+func isGzip(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+//Check that the input objects have a text or JSON content type, for catching a wrong input path before reading binary
+//objects. The objects of unknown content type, pinned by an input manifest, aren't checked
+func checkContentTypes(ctx context.Context, inputs []filePath, check string) error {
+	if check == CONTENT_TYPE_CHECK_OFF {
+		return nil
+	}
+	for _, input := range inputs {
+		if input.ContentType == "" || isTextContentType(input.ContentType, input.FileName) {
+			continue
+		}
+		msg := fmt.Sprintf("input file %s%s has the content type '%s', not a text or JSON type", input.RelativePath, input.FileName, input.ContentType)
+		if check == CONTENT_TYPE_CHECK_FAIL {
+			return errors.New(msg)
+		}
+		logWarningf(ctx, "%s", msg)
+	}
+	return nil
+}
+
+//Error of the input files larger than the size limits, returned before any prediction
+type inputSizeError struct {
+	message string
+}
+
+func (e *inputSizeError) Error() string {
+	return e.message
+}
+
+//Error of a run which reaches MAX_TOTAL_INSTANCES. It's a user error, answered with a 400, also with
+//continue_on_error
+type instanceLimitError struct {
+	message string
+}
+
+func (e *instanceLimitError) Error() string {
+	return e.message
+}
+
+type conflictError struct {
+	message string
+}
+
+func (e *conflictError) Error() string {
+	return e.message
+}
+
+type instanceTallyKey struct{}
+
+//Add the instances of a batch to the count of the run, and return false once the count is more than
+//MAX_TOTAL_INSTANCES. The instances of the parallel files are counted together. Always true outside of a run
+func tallyInstances(ctx context.Context, n int) bool {
+	tally, ok := ctx.Value(instanceTallyKey{}).(*int64)
+	if !ok || maxTotalInstances <= 0 {
+		return true
+	}
+	return atomic.AddInt64(tally, int64(n)) <= maxTotalInstances
+}
+
+//Error of an input file without instance, with on_empty_input=fail. It's a user error, answered with a 400
+type emptyInputError struct {
+	message string
+}
+
+func (e *emptyInputError) Error() string {
+	return e.message
+}
+
+//Reject the input files larger than MAX_INPUT_BYTES, and the input files larger than MAX_TOTAL_INPUT_BYTES
+//altogether, before downloading them. The files of unknown size are checked while read
+func checkInputSizes(rootInputPath string, inputs []filePath) error {
+	var total int64
+	for _, input := range inputs {
+		if maxInputBytes > 0 && input.Size > maxInputBytes {
+			return &inputSizeError{fmt.Sprintf("input file %s%s%s has %d bytes, more than the %d bytes allowed by MAX_INPUT_BYTES", rootInputPath, input.RelativePath, input.FileName, input.Size, maxInputBytes)}
+		}
+		total += input.Size
+		if maxTotalInputBytes > 0 && total > maxTotalInputBytes {
+			return &inputSizeError{fmt.Sprintf("input files exceed the %d bytes allowed by MAX_TOTAL_INPUT_BYTES at %s%s%s", maxTotalInputBytes, rootInputPath, input.RelativePath, input.FileName)}
+		}
+	}
+	return nil
+}
+
+//Reader of the input file name which fails with an inputSizeError once more than remaining bytes are read
+type maxBytesReader struct {
+	io.ReadCloser
+	name      string
+	remaining int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return 0, &inputSizeError{fmt.Sprintf("input file %s has more than the %d bytes allowed by MAX_INPUT_BYTES", r.name, maxInputBytes)}
+	}
+	return n, err
+}
+
+//Return true for the text and JSON content types, and for gzip on the compressed input files
+func isTextContentType(contentType string, fileName string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "jsonl") ||
+		mediaType == "application/x-jsonlines" {
+		return true
+	}
+	return strings.HasSuffix(fileName, GZIP_SUFFIX) && (mediaType == "application/gzip" || mediaType == "application/x-gzip")
+}
+
+//Execute the prediction on each input file and write the formatted predictions to the output. The number of predicted
+//instances is returned. The prediction requests are recorded in the trace, if not nil. With error_records, the
+//instances of the batches rejected by the serving backend are recorded in rejected and the file continues
+func executePrediction(ctx context.Context, inputStore ObjectStore, rootInputPath string, input filePath, opts *predictionOptions, sampler *instanceSampler, output io.Writer, trace *[]manifestRequest, rejected *[]rejectedInstance) (count int, err error) {
+	// A stuck file fails alone, the run continues with the next files with continue_on_error
+	if predictFileTimeout > 0 {
+		runCtx := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(predictFileTimeout)*time.Second)
+		defer cancel()
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded && runCtx.Err() == nil {
+				err = errors.New(fmt.Sprintf("input file %s%s: not predicted in %d seconds, limit set by PREDICT_FILE_TIMEOUT", input.RelativePath, input.FileName, predictFileTimeout))
+			}
+		}()
+	}
+	start := time.Now()
+	//Read the input file, at the pinned generation if any
+	src, err := inputStore.Download(ctx, rootInputPath+input.RelativePath+input.FileName, input.Generation)
+	if err != nil {
+		if _, ok := err.(*notFoundError); !ok && input.Generation != 0 {
+			return 0, errors.New(fmt.Sprintf("input file %s%s generation %d: %s", input.RelativePath, input.FileName, input.Generation, err))
+		}
+		return 0, err
+	}
+	defer src.Close()
+	if maxInputBytes > 0 && input.Size == 0 {
+		// Unknown size, like for the input manifest entries, checked while read
+		src = &maxBytesReader{ReadCloser: src, name: rootInputPath + input.RelativePath + input.FileName, remaining: maxInputBytes}
+	}
+
+	//Decompress the gzip input files, detected by their magic bytes. A .gz object stored with the gzip content
+	//encoding is already decompressed by GCS on download
+	reader := bufio.NewReader(src)
+	if isGzip(reader) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("input file %s%s: %s", input.RelativePath, input.FileName, err))
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+
+	var shapes map[string][]int
+	if opts.ValidateShapes {
+		if shapes, err = predictor.InputShapes(opts); err != nil {
+			return 0, errors.New(fmt.Sprintf("input file %s%s: model input shapes unavailable: %s", input.RelativePath, input.FileName, err))
+		}
+	}
+
+	// Predict the instances and format the output batch by batch, while the input is read, for keeping only one
+	// batch in memory whatever the size of the file. In raw format, the responses of each batch are recorded for
+	// writing them
+	encoder := getEncoder(opts.OutputFormat)
+	var responses []manifestRequest
+	var instances io.Reader = reader
+	if isCSVInput(input, opts) {
+		instances = newCSVJSONReader(reader, opts.CSVAllStrings, opts.CSVDelim)
+	}
+	// Record the instances of a rejected batch, instead of failing the file
+	reject := func(positions []int, instances []interface{}, err error) bool {
+		if rejected == nil || !isRejectedBatch(err) || ctx.Err() != nil {
+			return false
+		}
+		logWarningf(ctx, "input file %s%s: %d instance(s) rejected, written in the error records: %s", input.RelativePath, input.FileName, len(instances), err)
+		for i, instance := range instances {
+			*rejected = append(*rejected, rejectedInstance{
+				Input:    rootInputPath + input.RelativePath + input.FileName,
+				Index:    positions[i],
+				Instance: instance,
+				Error:    err.Error(),
+			})
+		}
+		return true
+	}
+	// The index alone is ambiguous in an output shared by several input files, their input is also annotated
+	annotateInputs := opts.AnnotateIndex && (opts.Aggregate || opts.GroupOutput == GROUP_OUTPUT_PER_DIR)
+	encode := func(predictions []interface{}) error {
+		if annotateInputs {
+			annotateInput(predictions, input.RelativePath+input.FileName)
+		}
+		return encoder.Encode(output, predictions)
+	}
+	handle := func(positions []int, instances []interface{}) error {
+		// Stop before sending more instances than allowed to the serving backend
+		if !tallyInstances(ctx, len(instances)) {
+			return &instanceLimitError{fmt.Sprintf("more than the %d instances allowed by MAX_TOTAL_INSTANCES at input file %s%s%s, run aborted", maxTotalInstances, rootInputPath, input.RelativePath, input.FileName)}
+		}
+		// Check the instances before the serving backend rejects them with a less clear error
+		if shapes != nil {
+			if err := checkShapes(shapes, instances, positions); err != nil {
+				return err
+			}
+		}
+		if opts.OutputFormat != OUTPUT_FORMAT_RAW {
+			predictions, err := predictBatch(ctx, predictor, instances, positions, opts, trace)
+			// Only a rejected batch is predicted again, the accepted ones have no overhead
+			if err != nil && !opts.StrictBatch && len(instances) > 1 && isRejectedBatch(err) {
+				logWarningf(ctx, "input file %s%s: %s, instances predicted one by one", input.RelativePath, input.FileName, err)
+				var failed []string
+				var failure *servingStatusError
+				predictions, err = isolateRejected(ctx, predictor, instances, positions, opts, trace, func(index int, instance interface{}, err *servingStatusError) {
+					if !reject([]int{index}, []interface{}{instance}, err) {
+						failed = append(failed, strconv.Itoa(index))
+						if failure == nil {
+							failure = err
+						}
+					}
+				})
+				if err == nil && len(failed) > 0 {
+					err = &servingStatusError{status: failure.status, message: fmt.Sprintf("instance(s) %s rejected by the serving backend, first error: %s", strings.Join(failed, ", "), failure.message)}
+				}
+				if err != nil {
+					return err
+				}
+				return encode(predictions)
+			}
+			if err != nil {
+				if reject(positions, instances, err) {
+					return nil
+				}
+				return err
+			}
+			return encode(predictions)
+		}
+		responses = responses[:0]
+		if _, err := predictBatch(ctx, predictor, instances, positions, opts, &responses); err != nil {
+			if reject(positions, instances, err) {
+				return nil
+			}
+			return err
+		}
+		if trace != nil {
+			for _, r := range responses {
+				r.response = nil
+				*trace = append(*trace, r)
+			}
+		}
+		return writeRawResponses(output, responses)
+	}
+	if isBinaryInput(input, opts) {
+		count, err = readBinaryInstance(reader, sampler, handle)
+	} else {
+		count, err = readBatches(instances, sampler, opts, batchSize, handle)
+	}
+	if _, ok := err.(*instanceLimitError); ok {
+		return 0, err
+	}
+	if _, ok := err.(*inputSizeError); ok {
+		return 0, err
+	}
+	if e, ok := err.(*schemaError); ok {
+		return 0, &schemaError{message: fmt.Sprintf("input file %s%s: %s", input.RelativePath, input.FileName, e.message)}
+	}
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("input file %s%s: %s", input.RelativePath, input.FileName, err))
+	}
+	if count == 0 && sampler != nil {
+		logInfof(ctx, "no instance sampled in input file %s%s, prediction skipped", input.RelativePath, input.FileName)
+		return 0, nil
+	}
+	// Empty or only blank lines. Nothing is sent to the serving backend
+	if count == 0 {
+		if opts.OnEmptyInput == ON_EMPTY_INPUT_FAIL {
+			return 0, &emptyInputError{message: fmt.Sprintf("input file %s%s has no instance", input.RelativePath, input.FileName)}
+		}
+		logWarningf(ctx, "input file %s%s has no instance, prediction skipped", input.RelativePath, input.FileName)
+		return 0, nil
+	}
+	filePredictionSeconds.Observe(time.Since(start).Seconds())
+	return count, nil
+}
+
+//Stop the read of the input after the first instance
+var errWarmupDone = errors.New("warmup done")
+
+//Predict the first instance of the input file and discard the prediction, for the lazy initializations of the model
+//before the predictions. Best effort, a failure is only logged
+func warmupModel(ctx context.Context, inputStore ObjectStore, rootInputPath string, input filePath, opts *predictionOptions) {
+	start := time.Now()
+	src, err := inputStore.Download(ctx, rootInputPath+input.RelativePath+input.FileName, input.Generation)
+	if err != nil {
+		logWarningf(ctx, "warmup skipped: %s", err)
+		return
+	}
+	defer src.Close()
+	reader := bufio.NewReader(src)
+	if isGzip(reader) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			logWarningf(ctx, "warmup skipped: input file %s%s: %s", input.RelativePath, input.FileName, err)
+			return
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+	var instances io.Reader = reader
+	if isCSVInput(input, opts) {
+		instances = newCSVJSONReader(reader, opts.CSVAllStrings, opts.CSVDelim)
+	}
+	handle := func(positions []int, instances []interface{}) error {
+		if _, err := predict(ctx, predictor, instances, opts, nil); err != nil {
+			return err
+		}
+		return errWarmupDone
+	}
+	if isBinaryInput(input, opts) {
+		_, err = readBinaryInstance(reader, nil, handle)
+	} else {
+		_, err = readBatches(instances, nil, opts, 1, handle)
+	}
+	if err != nil && err != errWarmupDone {
+		logWarningf(ctx, "warmup failed: %s", err)
+		return
+	}
+	logInfof(ctx, "model warmed up in %.3fs with the first instance of %s%s", time.Since(start).Seconds(), input.RelativePath, input.FileName)
+}
+
+//Build the URL of the prediction with the optional query forwarded to the serving layer
+func predictionURL(p Predictor, opts *predictionOptions) string {
+	if opts.TFQuery == "" {
+		return p.PredictURL(opts)
+	}
+	return p.PredictURL(opts) + "?" + opts.TFQuery
+}
+
+//Call the serving backend with the instances, in the backend format, and return the predictions
+func predict(ctx context.Context, p Predictor, instances []interface{}, opts *predictionOptions, trace *[]manifestRequest) ([]interface{}, error) {
+	if opts.Protocol == PROTOCOL_GRPC {
+		return predictGRPC(ctx, p, instances, opts, trace)
+	}
+	body, err := p.FormatInput(instances, opts)
+	if err != nil {
+		return nil, err
+	}
+	if tfMaxRequestBytes > 0 && len(body) > tfMaxRequestBytes {
+		return nil, errors.New(fmt.Sprintf("prediction request of %d bytes, more than the %d bytes allowed by TF_MAX_REQUEST_BYTES, reduce BATCH_SIZE", len(body), tfMaxRequestBytes))
+	}
+
+	// Record the request once completed, successful or not
+	request := manifestRequest{URL: predictionURL(p, opts), RequestBytes: len(body)}
+	if trace != nil {
+		defer func() { *trace = append(*trace, request) }()
+	}
+
+	status, output, err := postWithBackoff(ctx, request.URL, body, &request.Attempts)
+	request.Status = status
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, statusError(status, output, opts)
+	}
+	if output, err = replaceNonFinite(output, opts.OnNonFinite); err != nil {
+		return nil, err
+	}
+	predictions, err := p.FormatOutput(output, opts)
+	request.Predictions = len(predictions)
+	if err == nil && opts.OutputFormat == OUTPUT_FORMAT_RAW {
+		compacted := &bytes.Buffer{}
+		if err = json.Compact(compacted, output); err != nil {
+			return nil, err
+		}
+		request.response = compacted.Bytes()
+	}
+	return predictions, err
+}
+
+//Write the successful serving responses of the requests, one per line, for the raw output format
+func writeRawResponses(w io.Writer, requests []manifestRequest) error {
+	for _, r := range requests {
+		if r.response == nil {
+			continue
+		}
+		if _, err := w.Write(append(r.response, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Post the prediction request, with up to TF_POST_ATTEMPTS attempts and an exponential backoff on the transient
+//failures: the connection errors, like during the warmup, and the 5xx responses. The 4xx responses and the timeouts,
+//of a hung Tensorflow server, aren't retried.
+//The status and the body of the last response are returned, for surfacing the serving error. Each attempt is recorded
+//with its outcome in the attempts, if not nil
+func postWithBackoff(ctx context.Context, url string, body []byte, attempts *[]manifestAttempt) (int, []byte, error) {
+	backoff := time.Duration(tfPostBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		status, output, err := post(ctx, url, body)
+		recordAttempt(attempts, status, err)
+		// The same request gets the same response, it's not retried
+		if err == errResponseTooLarge {
+			return status, nil, errors.New(fmt.Sprintf("serving response larger than the %d bytes allowed by TF_MAX_RESPONSE_BYTES, reduce BATCH_SIZE", tfMaxResponseBytes))
+		}
+		if (err == nil && status < http.StatusInternalServerError) || attempt >= tfPostAttempts {
+			return status, output, err
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return status, output, errors.New(fmt.Sprintf("no serving response after %d seconds, limit set by TF_REQUEST_TIMEOUT: %s", tfRequestTimeout, err))
+		}
+		if err == nil {
+			err = errors.New(fmt.Sprintf("serving response status %d: %s", status, output))
+		}
+		logWarningf(ctx, "prediction request attempt %d/%d failed, new attempt in %s: %s", attempt, tfPostAttempts, backoff, err)
+		if err = sleepContext(ctx, backoff); err != nil {
+			return 0, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+//Returned by post when the response is larger than TF_MAX_RESPONSE_BYTES
+var errResponseTooLarge = errors.New("serving response too large")
+
+//Slots of the prediction requests in progress on the serving backend, at most TF_MAX_INFLIGHT whatever the number of
+//files predicted in parallel and of requests. Nil without limit
+var tfInflight = newRequestSlots(getEnvInt("TF_MAX_INFLIGHT", 0))
+
+//Wait a free slot of prediction request, until the cancellation. The returned release frees the slot
+func acquireInflight(ctx context.Context) (func(), error) {
+	if tfInflight == nil {
+		return func() {}, nil
+	}
+	select {
+	case tfInflight <- struct{}{}:
+		return func() { <-tfInflight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//Post the prediction request once and read the response. The response is read up to TF_MAX_RESPONSE_BYTES, a larger
+//one isn't kept in memory. The request holds a TF_MAX_INFLIGHT slot until its response is read
+func post(ctx context.Context, url string, body []byte) (int, []byte, error) {
+	release, err := acquireInflight(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, values := range getForwardedHeaders(ctx) {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", TF_CONTENT_TYPE)
+	resp, err := tfClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if tfMaxResponseBytes <= 0 {
+		output, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, output, err
+	}
+	if resp.ContentLength > tfMaxResponseBytes {
+		return resp.StatusCode, nil, errResponseTooLarge
+	}
+	output, err := ioutil.ReadAll(io.LimitReader(resp.Body, tfMaxResponseBytes+1))
+	if err == nil && int64(len(output)) > tfMaxResponseBytes {
+		return resp.StatusCode, nil, errResponseTooLarge
+	}
+	return resp.StatusCode, output, err
+}
+
+//Predict the instances by batches of BATCH_SIZE instances, sent one after the other. The predictions are concatenated
+//in the instances order. The positions are the ones of the instances in the input
+func predictBatches(ctx context.Context, p Predictor, instances []interface{}, positions []int, opts *predictionOptions, trace *[]manifestRequest) ([]interface{}, error) {
+	size := batchSize
+	if size <= 0 || size > len(instances) {
+		size = len(instances)
+	}
+	var predictions []interface{}
+	for start := 0; start < len(instances); start += size {
+		end := start + size
+		if end > len(instances) {
+			end = len(instances)
+		}
+		batch, err := predictBatch(ctx, p, instances[start:end], positions[start:end], opts, trace)
+		if err != nil {
+			return nil, err
+		}
+		predictions = append(predictions, batch...)
 	}
-	return bucket, path, nil
-
+	return predictions, nil
 }
 
-// Input File must be a JSONL (json line, with 1 full and consistent JSON object on one line)
-func LoadAndPredict(w http.ResponseWriter, r *http.Request) {
-
-	// Get Model param
-	bucketModel, pathModel, err := getParam(r, "model")
+//Predict one batch of instances. The positions are the ones of the instances in the input, from 0, for the error
+//messages and annotate_index. They follow each other, unless the instances are sampled
+func predictBatch(ctx context.Context, p Predictor, instances []interface{}, positions []int, opts *predictionOptions, trace *[]manifestRequest) ([]interface{}, error) {
+	first, last := positions[0], positions[len(positions)-1]
+	predictions, err := predictWithRetries(ctx, p, instances, opts, trace)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(w, err.Error())
-		return
+		message := fmt.Sprintf("batch of instances %d to %d: %s", first, last, err)
+		// The status is kept for the error records
+		if e, ok := err.(*servingStatusError); ok {
+			return nil, &servingStatusError{status: e.status, message: message}
+		}
+		return nil, errors.New(message)
 	}
-
-	// Model path must be the directory where the pb and variables are stored
-	if !strings.HasSuffix(pathModel, "/") {
-		pathModel += "/"
+	if len(predictions) != len(instances) {
+		return nil, errors.New(fmt.Sprintf("batch of instances %d to %d: %d predictions for %d instances", first, last, len(predictions), len(instances)))
 	}
-
-	// Get Input param
-	bucketInput, pathInput, err := getParam(r, "input")
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(w, err.Error())
-		return
+	if opts.OutputKey != "" {
+		if predictions, err = selectOutput(predictions, opts.OutputKey, positions); err != nil {
+			return nil, err
+		}
 	}
-
-	// Get Output  param
-	bucketOutput, pathOutput, err := getParam(r, "output")
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(w, err.Error())
-		return
+	if len(opts.Select) > 0 {
+		if predictions, err = selectFields(predictions, opts.Select, opts.SelectStrict, positions); err != nil {
+			return nil, err
+		}
 	}
+	if opts.AnnotateIndex {
+		return annotateIndex(predictions, positions), nil
+	}
+	return predictions, nil
+}
 
-	log.Println("param parsed successfully. Start process")
+//Wrap each prediction in an object with the index of its instance in the input, for joining the predictions with the
+//instances whatever the output order. The positions are the ones of the instances of the predictions
+func annotateIndex(predictions []interface{}, positions []int) []interface{} {
+	annotated := make([]interface{}, len(predictions))
+	for i, prediction := range predictions {
+		annotated[i] = map[string]interface{}{"index": positions[i], "prediction": prediction}
+	}
+	return annotated
+}
 
-	// Clear the previous execution
-	os.RemoveAll(LOCAL_MODEL_PATH)
+//Add the input file, relative to the input path, to the predictions annotated with their index
+func annotateInput(predictions []interface{}, input string) {
+	for _, prediction := range predictions {
+		prediction.(map[string]interface{})["input"] = input
+	}
+}
 
-	//Create the storage client
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, "error when creating storage client")
-		return
+//Project each prediction object on the selected fields. A missing field is omitted, or fails the prediction if
+//strict. The predictions which aren't JSON objects are kept as is. The positions are the ones of the instances of the
+//predictions, for the error messages
+func selectFields(predictions []interface{}, fields []string, strict bool, positions []int) ([]interface{}, error) {
+	selected := make([]interface{}, len(predictions))
+	for i, prediction := range predictions {
+		outputs, ok := prediction.(map[string]interface{})
+		if !ok {
+			selected[i] = prediction
+			continue
+		}
+		projection := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			value, ok := outputs[field]
+			if !ok {
+				if strict {
+					return nil, errors.New(fmt.Sprintf("instance %d: no field '%s' in the prediction, required by 'select_strict'", positions[i], field))
+				}
+				continue
+			}
+			projection[field] = value
+		}
+		selected[i] = projection
 	}
+	return selected, nil
+}
 
-	//Download model
-	err = downloadFiles(ctx, client.Bucket(bucketModel), pathModel, LOCAL_MODEL_PATH+MODEL_DUMMY_VERSION)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, "error when downloading model files")
-		return
+//Keep only the value of the named output in each prediction. The predictions must be JSON objects, with one field
+//per named output. The positions are the ones of the instances of the predictions, for the error messages
+func selectOutput(predictions []interface{}, key string, positions []int) ([]interface{}, error) {
+	selected := make([]interface{}, len(predictions))
+	for i, prediction := range predictions {
+		outputs, ok := prediction.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("instance %d: the prediction isn't a JSON object of named outputs, 'output_key' can't be used", positions[i]))
+		}
+		value, ok := outputs[key]
+		if !ok {
+			var names []string
+			for name := range outputs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, errors.New(fmt.Sprintf("instance %d: no output '%s' in the prediction, outputs: %s", positions[i], key, strings.Join(names, ", ")))
+		}
+		selected[i] = value
 	}
+	return selected, nil
+}
 
-	log.Println("model loaded to " + LOCAL_MODEL_PATH + MODEL_DUMMY_VERSION)
+//Predict the instances, with up to PredictRetries retries of a failed prediction request. In idempotent retry, a
+//failed batch of instances is split in 2 halves on each retry and the halves already predicted aren't sent again. The
+//bad instances of a batch are isolated this way, and the predictions are merged in the instances order
+func predictWithRetries(ctx context.Context, p Predictor, instances []interface{}, opts *predictionOptions, trace *[]manifestRequest) ([]interface{}, error) {
+	predictions, err := predict(ctx, p, instances, opts, trace)
+	if err == nil || opts.PredictRetries == 0 {
+		return predictions, err
+	}
 
-	// Start tensorflow serving with the model
-	cmd := exec.Command("tensorflow_model_server", "--port=8500", "--rest_api_port="+TF_PORT,
-		"--model_name="+MODEL_NAME, "--model_base_path="+LOCAL_MODEL_PATH)
+	// Ranges [start, end) of the instances without prediction
+	predictions = make([]interface{}, len(instances))
+	unresolved := [][2]int{{0, len(instances)}}
+	for attempt := 1; attempt <= opts.PredictRetries; attempt++ {
+		logWarningf(ctx, "prediction failed, retry %d/%d: %s", attempt, opts.PredictRetries, err)
+		if sleepErr := sleepContext(ctx, PREDICT_RETRY_INTERVAL); sleepErr != nil {
+			return nil, sleepErr
+		}
 
-	// Blocking start until the initialization
-	err = startAndWaitTF(cmd)
-	defer cmd.Process.Kill()
+		if !opts.IdempotentRetry {
+			var batch []interface{}
+			if batch, err = predict(ctx, p, instances, opts, trace); err == nil {
+				return batch, nil
+			}
+			continue
+		}
 
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, "error when starting tensorflow")
-		return
+		var failed [][2]int
+		for _, r := range unresolved {
+			ranges := [][2]int{r}
+			if r[1]-r[0] > 1 {
+				middle := (r[0] + r[1]) / 2
+				ranges = [][2]int{{r[0], middle}, {middle, r[1]}}
+			}
+			for _, rr := range ranges {
+				batch, batchErr := predict(ctx, p, instances[rr[0]:rr[1]], opts, trace)
+				if batchErr == nil && len(batch) != rr[1]-rr[0] {
+					batchErr = errors.New(fmt.Sprintf("%d predictions for %d instances", len(batch), rr[1]-rr[0]))
+				}
+				if batchErr != nil {
+					err = batchErr
+					failed = append(failed, rr)
+					continue
+				}
+				copy(predictions[rr[0]:rr[1]], batch)
+			}
+		}
+		if unresolved = failed; len(unresolved) == 0 {
+			return predictions, nil
+		}
 	}
-
-	if err = makePredictions(ctx, client.Bucket(bucketInput), pathInput, client.Bucket(bucketOutput), pathOutput); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, "error when making predictions")
-		return
+	if opts.IdempotentRetry {
+		count := 0
+		for _, r := range unresolved {
+			count += r[1] - r[0]
+		}
+		return nil, errors.New(fmt.Sprintf("%d instance(s) without prediction after %d retries, from instance %d: %s", count, opts.PredictRetries, unresolved[0][0], err))
 	}
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "predictions completed")
+	return nil, err
 }
 
-//Start the Tensorflow server and wait the entry "Exporting HTTP/REST API" for considering the
-//start completed and ready to use.
-//If the server is not in a ready state after a timeout, an error is raised.
-func startAndWaitTF(cmd *exec.Cmd) error {
-	var stderr []byte
-	var errStderr error
-	cmd.Stdout = os.Stdout
-	stderrIn, _ := cmd.StderrPipe()
-
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
+//Replace the NaN, Infinity and -Infinity tokens, invalid in JSON, of the serving response according to the
+//on_nonfinite behavior. The tokens are only searched outside the JSON strings
+func replaceNonFinite(body []byte, behavior string) ([]byte, error) {
+	var ret []byte
+	copied := 0
+	inString := false
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if inString {
+			if c == '\\' {
+				// Escaped char, can't end the string
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+			continue
+		}
 
-	started := make(chan bool, 1)
-	//Catch the output in a goroutine and evaluate them!
-	go func() {
-		stderr, errStderr = copyAndCapture(os.Stderr, stderrIn)
-		if errStderr != nil {
-			started <- false
+		token := ""
+		for _, t := range []string{"NaN", "Infinity", "-Infinity"} {
+			if bytes.HasPrefix(body[i:], []byte(t)) {
+				token = t
+				break
+			}
+		}
+		if token == "" {
+			continue
 		}
-		started <- true
-	}()
 
-	// Wait, the TF startup or the timeout
-	select {
-	case res := <-started:
-		if res {
-			log.Println("Tensorflow Started. Continue the process")
-			// Redirect the output
-			cmd.Stderr = os.Stderr
-		} else {
-			return errStderr
+		var replacement string
+		switch behavior {
+		case ON_NONFINITE_FAIL:
+			return nil, errors.New(fmt.Sprintf("non finite value %s in the serving response, set on_nonfinite for replacing it", token))
+		case ON_NONFINITE_NULL:
+			replacement = "null"
+		case ON_NONFINITE_STRING:
+			replacement = `"` + token + `"`
+		default:
+			replacement = behavior
 		}
-	case <-time.After(TF_TIMEOUT * time.Second):
-		log.Printf("timeout exceeded. TF doesn't start in %d seconds\n", TF_TIMEOUT)
-		return errors.New("timeout exceeded")
+		ret = append(ret, body[copied:i]...)
+		ret = append(ret, replacement...)
+		i += len(token) - 1
+		copied = i + 1
 	}
-	return nil
+	if ret == nil {
+		return body, nil
+	}
+	return append(ret, body[copied:]...), nil
 }
 
-// Run TF and capture the output. Exit in success when "Exporting HTTP/REST API" is found in the logs
-func copyAndCapture(w io.Writer, r io.Reader) ([]byte, error) {
-	var out []byte
-	buf := make([]byte, 1024, 1024)
-	for {
-		//Let the time to the buffer to contain char
-		<-time.After(1 * time.Second)
-		n, err := r.Read(buf[:])
-		if n > 0 {
-			d := buf[:n]
-			out = append(out, d...)
-			_, err := w.Write(d)
+//Check the shape of the inputs of each instance against the model input shapes. An instance is a JSON object with
+//one field per model input, or directly the value of the input if the model has only one input. The positions are the
+//ones of the instances in the input
+func validateShapes(p Predictor, instances []interface{}, positions []int, opts *predictionOptions) error {
+	shapes, err := p.InputShapes(opts)
+	if err != nil {
+		return errors.New(fmt.Sprintf("model input shapes unavailable: %s", err))
+	}
+	return checkShapes(shapes, instances, positions)
+}
+
+//Check the shape of the inputs of each instance against the model input shapes. The positions are the ones of the
+//instances in the input, for the error messages
+func checkShapes(shapes map[string][]int, instances []interface{}, positions []int) error {
+	for i, instance := range instances {
+		for name, expected := range shapes {
+			value, err := getInstanceInput(instance, name, len(shapes))
 			if err != nil {
-				return out, err
+				return errors.New(fmt.Sprintf("instance %d: %s", positions[i], err))
 			}
-			if strings.Contains(string(d), "Exporting HTTP/REST API") {
-				// The server is running
-				return out, nil
+			if shape := getShape(value); !matchShape(shape, expected) {
+				return errors.New(fmt.Sprintf("instance %d: input '%s' shape %v doesn't match the model shape %v", positions[i], name, shape, expected))
 			}
 		}
-		if err != nil {
-			return out, err
-		}
 	}
+	return nil
 }
 
-//Perform the prediction file by file. The output folder hierarchy respect the input one.
-//One file is processed at the time to limit the memory usage
-func makePredictions(ctx context.Context, inputBucket *storage.BucketHandle, inputPath string, outputBucket *storage.BucketHandle, outputPath string) error {
+//Return true if the shape matches the expected one. The -1 dimensions match any size
+func matchShape(shape []int, expected []int) bool {
+	if len(shape) != len(expected) {
+		return false
+	}
+	for i := range shape {
+		if expected[i] != -1 && shape[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
 
-	// Get inputs of input file
-	inputs, err := listGcsFiles(ctx, inputBucket, inputPath)
-	if err != nil {
-		return err
+//Get the error message from the error field of the serving response. A string is returned as is, other JSON values
+//(object, array, true, number) are returned in their JSON representation. A missing field and the empty values, null,
+//false, 0, "", [] and {}, mean no error
+func getResponseError(rawError json.RawMessage) string {
+	if len(rawError) == 0 {
+		return ""
+	}
+	var value interface{}
+	if err := json.Unmarshal(rawError, &value); err != nil {
+		return string(rawError)
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		if !v {
+			return ""
+		}
+	case float64:
+		if v == 0 {
+			return ""
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return ""
+		}
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return ""
+		}
 	}
+	return string(rawError)
+}
 
-	//Get the root path of the input.
-	rootInputPath := inputPath[:strings.LastIndex(inputPath, "/")+1]
+//Error of a serving response which isn't a 200, with its HTTP status
+type servingStatusError struct {
+	status  int
+	message string
+}
 
-	//Make sure that ourput is a directory
-	if !strings.HasSuffix(outputPath, "/") {
-		outputPath += "/"
-	}
+func (e *servingStatusError) Error() string {
+	return e.message
+}
 
-	for _, input := range inputs {
-		//Execute the prediction on each input. Extracted function for preventing memory leaks (defer in loop for)
-		if err = executePrediction(ctx, inputBucket, rootInputPath, outputBucket, outputPath, input); err != nil {
-			return err
+//Build the error of a serving response which isn't a 200, for example a 400 on a shape mismatch or a missing input.
+//The message is the error field of the JSON body, else the body itself
+func statusError(status int, body []byte, opts *predictionOptions) error {
+	message := strings.TrimSpace(string(body))
+	answer := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &answer); err == nil {
+		if predictionError := getResponseError(answer[opts.ErrorKey]); predictionError != "" {
+			message = predictionError
 		}
 	}
-	return nil
+	return &servingStatusError{status: status, message: fmt.Sprintf("serving response status %d %s: %s", status, http.StatusText(status), message)}
 }
 
-//Execute the prediction on each input file.
-func executePrediction(ctx context.Context, inputBucket *storage.BucketHandle, rootInputPath string, outputBucket *storage.BucketHandle, outputPath string, input filePath) error {
-	//Read the input file
-	src, err := inputBucket.Object(rootInputPath + input.RelativePath + input.FileName).NewReader(ctx)
+//Get the JSON line as input and return all the instances, one per line, with their positions in the input. See
+//readBatches
+func readInstances(input io.Reader, sampler *instanceSampler, opts *predictionOptions) ([]interface{}, []int, error) {
+	instances, positions := []interface{}{}, []int{}
+	_, err := readBatches(input, sampler, opts, 0, func(batchPositions []int, batch []interface{}) error {
+		instances = append(instances, batch...)
+		positions = append(positions, batchPositions...)
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer src.Close()
+	return instances, positions, nil
+}
 
-	// Prepare the input
-	finput, err := formatInput(src)
-	if err != nil {
+//Get the JSON line as input and pass the instances, one per line, to the handler by batches of size instances, with
+//their positions in the input, from 0, the skipped lines excluded. The lines are read while the batches are handled, only one batch is in
+//memory at the time. A size of 0 passes all the instances in one batch. The number of instances is returned.
+//The instances are formatted by the serving backend
+//If the input is a single JSON array of instances, the elements of the array are the instances instead. The elements
+//are decoded one by one, like the lines. The json_layout option forces the JSON lines or the JSON array, else the
+//layout is detected on the first line.
+//The input is rejected if it contains more lines, or array elements, than MAX_LINES_PER_FILE. The instances not kept
+//by the sampler are skipped. The fields of the instances are renamed according to the rename_fields option.
+//The empty and whitespace only lines, like the trailing ones, are skipped and aren't instances
+func readBatches(input io.Reader, sampler *instanceSampler, opts *predictionOptions, size int, handle func(positions []int, batch []interface{}) error) (int, error) {
+	var instances []interface{}
+	var positions []int
+	count, kept := 0, 0
+	//Handle the instances read since the previous batch
+	flush := func() error {
+		if len(instances) == 0 {
+			return nil
+		}
+		err := handle(positions, instances)
+		instances, positions = nil, nil
 		return err
 	}
+	//Add the instance. The position is the line, or the array element, at the number
+	add := func(position string, number int, raw []byte) error {
+		count++
+		if maxLinesPerFile > 0 && count > maxLinesPerFile {
+			return errors.New(fmt.Sprintf("more than %d lines, limit set by MAX_LINES_PER_FILE", maxLinesPerFile))
+		}
+		if !sampler.keep() {
+			return nil
+		}
+		var o interface{}
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return errors.New(fmt.Sprintf("%s %d: invalid JSON: %s", position, number, err))
+		}
+		if err := renameFields(o, opts.RenameFields); err != nil {
+			return errors.New(fmt.Sprintf("%s %d: %s", position, number, err))
+		}
+		// Checked before the batch of the instance is sent
+		if opts.Schema != nil {
+			if err := opts.Schema.validate(o, "$"); err != nil {
+				return &schemaError{message: fmt.Sprintf("%s %d doesn't match the schema: %s", position, number, err)}
+			}
+		}
+		instances = append(instances, o)
+		// The position counts the instances not kept by the sampler
+		positions = append(positions, count-1)
+		kept++
+		if size > 0 && len(instances) >= size {
+			return flush()
+		}
+		return nil
+	}
 
-	// Make prediction
-	resp, err := http.Post(TF_URL, TF_CONTENT_TYPE, strings.NewReader(finput))
-	if err != nil {
-		return err
+	addElements := func(elements []json.RawMessage) (int, error) {
+		for i, raw := range elements {
+			if err := add("element", i+1, raw); err != nil {
+				return 0, err
+			}
+		}
+		return kept, flush()
+	}
+	//Add the elements of the single JSON array, decoded one by one for not loading the whole input in memory
+	streamElements := func(r io.Reader, required string) (int, error) {
+		decoder := json.NewDecoder(r)
+		token, err := decoder.Token()
+		if err == nil && token != json.Delim('[') {
+			err = errors.New(fmt.Sprintf("unexpected %v", token))
+		}
+		for i := 1; err == nil && decoder.More(); i++ {
+			var raw json.RawMessage
+			if err = decoder.Decode(&raw); err != nil {
+				break
+			}
+			if err := add("element", i, raw); err != nil {
+				return 0, err
+			}
+		}
+		if err == nil {
+			_, err = decoder.Token()
+		}
+		if err == nil {
+			// Nothing after the array
+			if token, err = decoder.Token(); err == nil {
+				err = errors.New(fmt.Sprintf("unexpected %v after the array", token))
+			} else if err == io.EOF {
+				err = nil
+			}
+		}
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("not a single JSON array of instances%s: %s", required, err))
+		}
+		return kept, flush()
 	}
 
-	//Format the output
-	foutput, err := formatOutput(resp.Body)
-	if err != nil {
-		return err
+	layout := opts.JSONLayout
+	if _, ok := input.(*csvJSONReader); ok {
+		// The converted CSV rows are JSON lines
+		layout = JSON_LAYOUT_LINES
+	}
+	reader := bufio.NewReader(input)
+	if layout == JSON_LAYOUT_ARRAY {
+		if _, err := skipSpaces(reader); err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+		return streamElements(reader, fmt.Sprintf(", required by json_layout=%s", JSON_LAYOUT_ARRAY))
+	}
+	if layout != JSON_LAYOUT_LINES && startsWithArray(reader) {
+		// The layout is detected on the first line, the only one kept in memory
+		first, err := readFirstLine(reader, maxLineBytes)
+		if err != nil {
+			return 0, err
+		}
+		if len(first) > maxLineBytes || !json.Valid(first) {
+			// The array spans several lines
+			return streamElements(io.MultiReader(bytes.NewReader(first), reader), "")
+		}
+		newlines, err := skipSpaces(reader)
+		if err == io.EOF {
+			if elements, ok := getArrayElements(first); ok {
+				return addElements(elements)
+			}
+		} else if err != nil {
+			return 0, err
+		}
+		// JSON lines of arrays, the first line and the skipped ones are read again for keeping the line numbers
+		reader = bufio.NewReader(io.MultiReader(bytes.NewReader(first), bytes.NewReader(newlines), reader))
 	}
 
-	// Upload the prediction
-	w := outputBucket.Object(outputPath + input.RelativePath + input.FileName).NewWriter(ctx)
-	if _, err = io.Copy(w, strings.NewReader(foutput)); err != nil {
-		return err
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := add("line", line, scanner.Bytes()); err != nil {
+			return 0, err
+		}
 	}
-	if err := w.Close(); err != nil {
-		return err
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return 0, errors.New(fmt.Sprintf("line %d longer than %d bytes, limit set by MAX_LINE_BYTES", line+1, maxLineBytes))
+		}
+		return 0, err
 	}
+	return kept, flush()
+}
 
-	return nil
+//Return true if the first non whitespace char of the input is '[', the start of a JSON array.
+//Nothing is consumed, for keeping the line numbers of the JSON lines
+func startsWithArray(reader *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, err := reader.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+		case '[':
+			return true
+		default:
+			return false
+		}
+	}
 }
 
-//Format the output path as a JSON line format. Remove the "predictions" JSON array encapsulation of the
-//Tensorflow server response body.
-func formatOutput(input io.Reader) (string, error) {
-	output, err := ioutil.ReadAll(input)
-	if err != nil {
-		return "", err
+//Read the lines until the first non blank one, included. The read stops after max bytes, for a too long line
+func readFirstLine(reader *bufio.Reader, max int) ([]byte, error) {
+	var data []byte
+	for len(data) <= max {
+		line, err := reader.ReadSlice('\n')
+		data = append(data, line...)
+		if err == io.EOF || (err == nil && len(bytes.TrimSpace(line)) > 0) {
+			return data, nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
 	}
+	return data, nil
+}
 
-	//Fix JSON unmarshal in case of error
-	output = bytes.ReplaceAll(output, []byte("\\"), []byte("\\\\"))
+//Consume the whitespace of the reader, up to the next JSON value. The newlines consumed are returned, for keeping the
+//line numbers. The error is io.EOF if there is no other value
+func skipSpaces(reader *bufio.Reader) ([]byte, error) {
+	var newlines []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return newlines, err
+		}
+		switch b {
+		case ' ', '\t', '\r':
+		case '\n':
+			newlines = append(newlines, b)
+		default:
+			return newlines, reader.UnreadByte()
+		}
+	}
+}
 
-	//Unmarshal the prediction JSON
-	answer := outputPredictions{}
-	err = json.Unmarshal(output, &answer)
-	if err != nil {
-		log.Printf("Error during answer unmarshal %s\n", output)
-		return "", err
+//Get the elements if the data is a single JSON array of instances. JSON lines where each instance is an array also
+//start with '[' and are distinguished: the data must contain only one JSON value and, to be considered as an array
+//of instances, this array must span several lines or contain JSON objects. A single line array of scalars or
+//arrays, like [1,2,3], stays one JSON line instance
+func getArrayElements(data []byte) ([]json.RawMessage, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var first json.RawMessage
+	if err := decoder.Decode(&first); err != nil {
+		return nil, false
 	}
-	if answer.Error != "" {
-		// Prediction error
-		return "", errors.New(answer.Error)
+	rest, err := ioutil.ReadAll(decoder.Buffered())
+	if err != nil || len(bytes.TrimSpace(rest)) > 0 {
+		// Several JSON values: JSON lines
+		return nil, false
 	}
 
-	// Read only the content and return it
-	ret := ""
-	for _, p := range answer.Prediction {
-		b, err := json.Marshal(p)
-		if err != nil {
-			return "", err
+	var elements []json.RawMessage
+	if err = json.Unmarshal(first, &elements); err != nil {
+		return nil, false
+	}
+	if bytes.Contains(first, []byte("\n")) {
+		return elements, true
+	}
+	for _, e := range elements {
+		if t := bytes.TrimSpace(e); len(t) == 0 || t[0] != '{' {
+			return nil, false
 		}
-		ret += string(b) + "\n"
 	}
-	return ret, err
+	return elements, true
 }
 
-//Get the JSON line as input and format it as expected by Tensorflow server:
-//Encapsulate the JSON line into a "intances" JSON array
-func formatInput(input io.Reader) (string, error) {
-	i := inputPredictions{Instances: []interface{}{}}
-	scanner := bufio.NewScanner(input)
-	for scanner.Scan() {
-		var o interface{}
-		err := json.Unmarshal(scanner.Bytes(), &o)
-		if err != nil {
-			return "", err
+//Rename the fields of the instance, if it's a JSON object. The fields which aren't renamed are unchanged.
+//A rename to a field already present in the instance, and not renamed itself, is a collision and is rejected
+func renameFields(instance interface{}, renames map[string]string) error {
+	o, ok := instance.(map[string]interface{})
+	if !ok || len(renames) == 0 {
+		return nil
+	}
+	values := map[string]interface{}{}
+	for from, to := range renames {
+		if v, ok := o[from]; ok {
+			values[to] = v
+			delete(o, from)
 		}
-		i.Instances = append(i.Instances, o)
 	}
-	if err := scanner.Err(); err != nil {
-		return "", err
+	for to, v := range values {
+		if _, ok := o[to]; ok {
+			return errors.New(fmt.Sprintf("field '%s' already exists, it can't be the target of a rename", to))
+		}
+		o[to] = v
 	}
-	b, err := json.Marshal(i)
-	if err != nil {
-		return "", err
+	return nil
+}
+
+//Random selection of a fraction of the instances. The sampling is done per instance, each line of the input files is
+//kept with a probability equal to the sample rate
+type instanceSampler struct {
+	rate float64
+	rnd  *rand.Rand
+}
+
+//Create the sampler of the run. Nil if all the instances are kept
+func newInstanceSampler(ctx context.Context, opts *predictionOptions, seed int64) *instanceSampler {
+	if opts.SampleRate >= 1 {
+		return nil
+	}
+	logInfof(ctx, "instances sampled with rate %f and seed %d", opts.SampleRate, seed)
+	return &instanceSampler{
+		rate: opts.SampleRate,
+		rnd:  rand.New(rand.NewSource(seed)),
 	}
-	return string(b), nil
 }
 
-//Extract the location from Param
-func extractLocation(location string) (string, string, error) {
-	if !strings.HasPrefix(location, BUCKET_PREFIX) {
-		return "", "", errors.New("location must start with '" + BUCKET_PREFIX + "'")
+//Return true if the next instance is kept
+func (s *instanceSampler) keep() bool {
+	return s == nil || s.rnd.Float64() < s.rate
+}
+
+//Get the highest numeric version subdirectory directly under the model path
+func getLatestVersion(ctx context.Context, store ObjectStore, path string) (string, error) {
+	latest, latestName := int64(-1), ""
+	dirs, err := store.ListDirs(ctx, path)
+	if err != nil {
+		return "", err
 	}
-	location = location[len(BUCKET_PREFIX):]
-	s := strings.SplitN(location, "/", 2)
-	return s[0], s[1], nil
+	for _, dir := range dirs {
+		name := strings.TrimSuffix(dir[len(path):], "/")
+		if version, err := strconv.ParseInt(name, 10, 64); err == nil && version > latest {
+			latest, latestName = version, name
+		}
+	}
+	if latest < 0 {
+		return "", errors.New(fmt.Sprintf("no numeric version subdirectory in %s", path))
+	}
+	return latestName, nil
 }
 
-//List all the file with their name and relative path in a given bucket and path
-func listGcsFiles(ctx context.Context, bucket *storage.BucketHandle, path string) ([]filePath, error) {
+//List all the file with their name and relative path in a given bucket and path. The files are sorted by name, for the
+//same order of the predictions and of the outputs on each run, whatever the order of the storage listing
+func listFiles(ctx context.Context, store ObjectStore, path string) ([]filePath, error) {
 
 	var ret []filePath
-	it := bucket.Objects(ctx, &storage.Query{Prefix: path})
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return []filePath{}, err
+	objects, err := store.List(ctx, path)
+	if err != nil {
+		return []filePath{}, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	// Without trailing slash, the path is a single file when an object has exactly its name, else a prefix of the
+	// object names, like gs://bucket/data/2024 for all the objects starting by data/2024
+	if !strings.HasSuffix(path, "/") {
+		for _, attrs := range objects {
+			if attrs.Name == path {
+				objects = []objectInfo{attrs}
+				break
+			}
 		}
-
+	}
+	for _, attrs := range objects {
 		n := attrs.Name[strings.LastIndex(path, "/")+1:]
 		if n == "" || strings.HasSuffix(n, "/") {
 			// Root path or directory of the bucket filter path
 			continue
 		}
+		// The relative name is used for the local model files and the output names
+		if hasParentSegment(n) {
+			return []filePath{}, errors.New(fmt.Sprintf("object %s rejected, its name has a '..' segment", store.Location(attrs.Name)))
+		}
 		ret = append(ret, filePath{
 			RelativePath: n[:strings.LastIndex(n, "/")+1],
 			FileName:     n[strings.LastIndex(n, "/")+1:],
+			Size:         attrs.Size,
+			ContentType:  attrs.ContentType,
+			Checksums:    attrs.Checksums,
 		})
 	}
 	return ret, nil
 }
 
-//Download files from storage to the localDest. If there is subdirectory into GCS path, a loop is performed for getting
-//subdirectories
-//The path must represent a GCS directory (prefix)
-func downloadFiles(ctx context.Context, bucket *storage.BucketHandle, path string, localDest string) error {
+//Download files from storage to the localDest. The listing of the prefix is flat: the subdirectories are only implied
+//by the "/" of the object names, with or without directory placeholder objects, and are created locally with their
+//files
+//The path must represent a storage directory (prefix)
+func downloadFiles(ctx context.Context, store ObjectStore, path string, localDest string) error {
 	if !strings.HasSuffix(path, "/") {
-		return errors.New("downloadFiles: path must be GCS directory")
+		return errors.New("downloadFiles: path must be storage directory")
 	}
 
-	list, err := listGcsFiles(ctx, bucket, path)
+	list, err := listFiles(ctx, store, path)
 	if err != nil {
 		return err
 	}
-
+	if len(list) == 0 {
+		return &notFoundError{message: fmt.Sprintf("no object in %s", store.Location(path))}
+	}
+	start := time.Now()
+	defer func() { modelDownloadSeconds.Observe(time.Since(start).Seconds()) }()
+	var size int64
 	for _, l := range list {
-		// Make directory is required
-		os.MkdirAll(localDest+l.RelativePath, 0755)
-
-		//Copy each file in the dest directory
-		src, err := bucket.Object(path + l.RelativePath + l.FileName).NewReader(ctx)
-		if err != nil {
-			return err
+		size += l.Size
+	}
+	spanFromContext(ctx).set("objects", len(list))
+	spanFromContext(ctx).set("bytes", size)
+	progress, stopProgress := startDownloadProgress(ctx, store.Location(path), len(list), size)
+	defer stopProgress()
+	for _, l := range list {
+		if !isWithinDir(localDest, localDest+l.RelativePath+l.FileName) {
+			return errors.New(fmt.Sprintf("object %s rejected, outside of the local directory %s", store.Location(path+l.RelativePath+l.FileName), localDest))
 		}
-		defer src.Close()
+	}
 
-		destination, err := os.Create(localDest + l.RelativePath + l.FileName)
-		if err != nil {
-			return err
+	// Download the files with a pool of workers. The first error cancels the other downloads
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	files := make(chan filePath)
+	workers := downloadConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range files {
+				if err := downloadFile(ctx, store, path+l.RelativePath+l.FileName, localDest+l.RelativePath+l.FileName, l.Checksums, progress); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				progress.fileDone()
+			}
+		}()
+	}
+	go func() {
+		defer close(files)
+		for _, l := range list {
+			select {
+			case files <- l:
+			case <-ctx.Done():
+				return
+			}
 		}
-		defer destination.Close()
+	}()
+	wg.Wait()
 
-		_, err = io.Copy(destination, src)
-		if err != nil {
-			return err
-		}
+	select {
+	case err = <-errs:
+		return err
+	default:
+	}
+	// A cancellation of the request stops the feeding of the workers without error, the download is incomplete
+	return ctx.Err()
+}
+
+//Copy the object in the local file, its parent directories created if needed. The content is verified against the
+//checksums, a mismatch is an error. The copied bytes are counted in the progress, if any
+func downloadFile(ctx context.Context, store ObjectStore, name string, localFile string, checksums objectChecksums, progress *downloadProgress) error {
+	src, err := store.Download(ctx, name, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Safe with the concurrent downloads of the files of the same directory
+	if err = os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		return err
+	}
+	destination, err := os.Create(localFile)
+	if err != nil {
+		return err
+	}
+	verifier := newChecksumVerifier(checksums)
+	if _, err = io.Copy(io.MultiWriter(destination, verifier, progress), src); err != nil {
+		destination.Close()
+		return err
+	}
+	if err = destination.Close(); err != nil {
+		return err
+	}
+	// A truncated or corrupted model fails here, not with an unclear error of the server
+	if err = verifier.verify(); err != nil {
+		return errors.New(fmt.Sprintf("download of %s corrupted: %s", store.Location(name), err))
 	}
 	return nil
 }
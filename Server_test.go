@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//Get the prediction options of the query string, like a request would
+func testOptions(t *testing.T, query string) *predictionOptions {
+	t.Helper()
+	opts, err := getPredictionOptions(httptest.NewRequest("GET", "/?"+query, nil))
+	if err != nil {
+		t.Fatalf("options %q: %s", query, err)
+	}
+	return opts
+}
+
+//Stub of the Tensorflow Serving REST API. The predict handler answers the prediction requests, the model status is
+//always available
+func newStubTF(predict http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, ":") {
+			predict(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model_version_status":[{"version":"1","state":"AVAILABLE"}]}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+//Serve the predictions from the stub as the remote Tensorflow server, instead of a local server. The returned function
+//restores the backend
+func useStubTF(predict http.HandlerFunc) (*httptest.Server, func()) {
+	server := newStubTF(predict)
+	previousURL, previousPredictor := tfRemoteURL, predictor
+	tfRemoteURL, predictor = server.URL, &tfPredictor{layout: MODEL_LAYOUT_FLAT}
+	return server, func() {
+		server.Close()
+		tfRemoteURL, predictor = previousURL, previousPredictor
+	}
+}
+
+//Predict handler of the stub which answers each instance with its value under "echo"
+func echoPredictions(w http.ResponseWriter, r *http.Request) {
+	var request inputPredictions
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"bad request"}`))
+		return
+	}
+	predictions := []interface{}{}
+	for _, instance := range request.Instances {
+		predictions = append(predictions, map[string]interface{}{"echo": instance})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{PREDICTIONS_KEY: predictions})
+}
+
+//Run the request on the router, the handlers and the middlewares of the server
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	initializeRouter().ServeHTTP(w, r)
+	return w
+}
+
+func TestExtractLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		want     storeLocation
+		err      bool
+	}{
+		{location: "gs://bucket/path/to/model/", want: storeLocation{Scheme: SCHEME_GCS, Bucket: "bucket", Path: "path/to/model/"}},
+		{location: "gs://bucket/file.json", want: storeLocation{Scheme: SCHEME_GCS, Bucket: "bucket", Path: "file.json"}},
+		{location: "gs://bucket/", want: storeLocation{Scheme: SCHEME_GCS, Bucket: "bucket", Path: ""}},
+		{location: "s3://bucket/input/", want: storeLocation{Scheme: SCHEME_S3, Bucket: "bucket", Path: "input/"}},
+		{location: "gs://bucket", err: true},
+		{location: "gs:///path", err: true},
+		{location: "gs://bucket/a/../b", err: true},
+		{location: "bucket/path", err: true},
+		{location: "http://bucket/path", err: true},
+		{location: "", err: true},
+	}
+	for _, test := range tests {
+		got, err := extractLocation(test.location)
+		if test.err {
+			if err == nil {
+				t.Errorf("extractLocation(%q) = %+v, error expected", test.location, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("extractLocation(%q): %s", test.location, err)
+		} else if got != test.want {
+			t.Errorf("extractLocation(%q) = %+v, %+v expected", test.location, got, test.want)
+		}
+	}
+}
+
+func TestExtractLocalLocation(t *testing.T) {
+	previous := localStorage
+	defer func() { localStorage = previous }()
+
+	localStorage = false
+	if _, err := extractLocation("file:///data/input/"); err == nil {
+		t.Errorf("local location accepted without LOCAL_STORAGE")
+	}
+	localStorage = true
+	tests := map[string]storeLocation{
+		"file:///data/input/":     {Scheme: SCHEME_FILE, Path: "data/input/"},
+		"/data/input/../model.pb": {Scheme: SCHEME_FILE, Path: "data/model.pb"},
+	}
+	for location, want := range tests {
+		if got, err := extractLocation(location); err != nil || got != want {
+			t.Errorf("extractLocation(%q) = %+v, %v, %+v expected", location, got, err, want)
+		}
+	}
+	if _, err := extractLocation("file://data/input/"); err == nil {
+		t.Errorf("relative local location accepted")
+	}
+}
+
+func TestFormatInput(t *testing.T) {
+	instances := []interface{}{
+		map[string]interface{}{"x": 1.0, "y": "a"},
+		map[string]interface{}{"x": 2.0, "y": "b"},
+	}
+	tests := []struct {
+		name      string
+		query     string
+		instances []interface{}
+		want      string
+		err       bool
+	}{
+		{name: "rows", instances: instances, want: `{"instances":[{"x":1,"y":"a"},{"x":2,"y":"b"}]}`},
+		{name: "signature", query: "signature=serving_other", instances: []interface{}{1.0}, want: `{"signature_name":"serving_other","instances":[1]}`},
+		{name: "columnar", query: "request_format=columnar", instances: instances, want: `{"inputs":{"x":[1,2],"y":["a","b"]}}`},
+		{name: "columnar single input", query: "request_format=columnar", instances: []interface{}{[]interface{}{1.0}, []interface{}{2.0}}, want: `{"inputs":[[1],[2]]}`},
+		{name: "columnar different inputs", query: "request_format=columnar", instances: []interface{}{instances[0], map[string]interface{}{"x": 3.0}}, err: true},
+		{name: "classify", query: "method=classify", instances: instances, want: `{"examples":[{"x":1,"y":"a"},{"x":2,"y":"b"}]}`},
+		{name: "classify without object", query: "method=classify", instances: []interface{}{1.0}, err: true},
+	}
+	p := &tfPredictor{}
+	for _, test := range tests {
+		got, err := p.FormatInput(test.instances, testOptions(t, test.query))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: %s, error expected", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if string(got) != test.want {
+			t.Errorf("%s: %s, %s expected", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatOutput(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		want  []interface{}
+		err   string
+	}{
+		{name: "predictions", body: `{"predictions":[[0.5],[1.5]]}`, want: []interface{}{[]interface{}{0.5}, []interface{}{1.5}}},
+		{name: "empty predictions", body: `{"predictions":[]}`, want: []interface{}{}},
+		{name: "classify result", query: "method=classify", body: `{"result":[[["a",0.9]]]}`, want: []interface{}{[]interface{}{[]interface{}{"a", 0.9}}}},
+		{name: "columnar outputs", query: "request_format=columnar", body: `{"outputs":{"p":[1,2]}}`, want: []interface{}{map[string]interface{}{"p": 1.0}, map[string]interface{}{"p": 2.0}}},
+		{name: "columnar single output", query: "request_format=columnar", body: `{"outputs":[1,2]}`, want: []interface{}{1.0, 2.0}},
+		{name: "error", body: `{"error":"bad input"}`, err: "bad input"},
+		{name: "empty error", body: `{"error":"","predictions":[1]}`, want: []interface{}{1.0}},
+		{name: "missing predictions", body: `{"foo":[1]}`, err: "no 'predictions' field"},
+		{name: "invalid JSON", body: `{"predictions":[1]`, err: "invalid JSON serving response"},
+		{name: "trailing data", body: `{"predictions":[1]}}`, err: "unexpected data after the JSON object"},
+	}
+	p := &tfPredictor{}
+	for _, test := range tests {
+		got, err := p.FormatOutput([]byte(test.body), testOptions(t, test.query))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: %v, %v, error %q expected", test.name, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %#v, %#v expected", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadAndPredict(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(echoPredictions)
+	defer restore()
+
+	input := stores.bucket(SCHEME_GCS, "in")
+	input.put("data/a.jsonl", []byte("{\"x\":1}\n{\"x\":2}\n"), "application/json")
+	input.put("data/b.jsonl", []byte("[3]\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/predictions/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	summary := runSummary{}
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("summary %s: %s", w.Body, err)
+	}
+	if summary.Files != 2 || summary.Instances != 3 || summary.Outputs["gs://out/predictions/"] != 2 {
+		t.Errorf("summary %+v, 2 files, 3 instances and 2 outputs expected", summary)
+	}
+
+	output := stores.bucket(SCHEME_GCS, "out")
+	want := map[string]string{
+		"predictions/a.jsonl": "{\"echo\":{\"x\":1}}\n{\"echo\":{\"x\":2}}\n",
+		"predictions/b.jsonl": "{\"echo\":[3]}\n",
+	}
+	if names := output.names(); !reflect.DeepEqual(names, []string{"predictions/a.jsonl", "predictions/b.jsonl"}) {
+		t.Fatalf("outputs %v", names)
+	}
+	for name, content := range want {
+		if got := string(output.get(name).data); got != content {
+			t.Errorf("output %s: %q, %q expected", name, got, content)
+		}
+	}
+}
+
+func TestLoadAndPredictErrors(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(echoPredictions)
+	defer restore()
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   string
+	}{
+		{name: "missing input", query: "output=gs://out/p/", status: http.StatusBadRequest, body: "'input' is missing"},
+		{name: "bad input", query: "input=bucket/data/&output=gs://out/p/", status: http.StatusBadRequest, body: "'input' bad formatted"},
+		{name: "missing output", query: "input=gs://in/data/", status: http.StatusBadRequest, body: "'output' is missing"},
+		{name: "missing input files", query: "input=gs://in/none/&output=gs://out/p/", status: http.StatusNotFound},
+		{name: "bad option", query: "input=gs://in/data/&output=gs://out/p/&predict_retries=x", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := serve(httptest.NewRequest("GET", "/?"+test.query, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		if w.Code != test.status || !strings.Contains(string(body), test.body) {
+			t.Errorf("%s: status %d %s, %d %q expected", test.name, w.Code, body, test.status, test.body)
+		}
+	}
+	if names := stores.bucket(SCHEME_GCS, "out").names(); len(names) > 0 {
+		t.Errorf("outputs %v of the failed runs", names)
+	}
+}
+
+func TestGetResponseError(t *testing.T) {
+	tests := map[string]string{
+		``:                   "",
+		`null`:               "",
+		`false`:              "",
+		`0`:                  "",
+		`""`:                 "",
+		`[]`:                 "",
+		`{}`:                 "",
+		`"bad input"`:        "bad input",
+		`true`:               "true",
+		`1`:                  "1",
+		`["a","b"]`:          `["a","b"]`,
+		`{"message":"oops"}`: `{"message":"oops"}`,
+	}
+	for raw, want := range tests {
+		if got := getResponseError(json.RawMessage(raw)); got != want {
+			t.Errorf("getResponseError(%s) = %q, %q expected", raw, got, want)
+		}
+	}
+}
+
+func TestFormatOutputErrorKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		want  []interface{}
+		err   string
+	}{
+		{name: "errors key", query: "error_key=errors", body: `{"errors":["bad input"]}`, err: `["bad input"]`},
+		{name: "detail key", query: "error_key=detail", body: `{"detail":"bad input","predictions":[1]}`, err: "bad input"},
+		{name: "empty detail", query: "error_key=detail", body: `{"detail":null,"predictions":[1]}`, want: []interface{}{1.0}},
+		{name: "default key ignored", query: "error_key=detail", body: `{"error":"ignored","predictions":[1]}`, want: []interface{}{1.0}},
+		{name: "other key ignored", body: `{"detail":"ignored","predictions":[1]}`, want: []interface{}{1.0}},
+	}
+	p := &tfPredictor{}
+	for _, test := range tests {
+		got, err := p.FormatOutput([]byte(test.body), testOptions(t, test.query))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: %v, %v, error %q expected", test.name, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %#v, %#v expected", test.name, got, test.want)
+		}
+	}
+
+	err := statusError(http.StatusBadRequest, []byte(`{"detail":"shape mismatch"}`), testOptions(t, "error_key=detail"))
+	if want := "serving response status 400 Bad Request: shape mismatch"; err.Error() != want {
+		t.Errorf("status error %q, %q expected", err, want)
+	}
+}
+
+//The error of a custom serving layer, under the error_key field, fails the run instead of being an empty prediction
+func TestLoadAndPredictErrorKey(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"detail":"model failure","predictions":[]}`))
+	})
+	defer restore()
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"x\":1}\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/&error_key=detail&continue_on_error=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	output := stores.bucket(SCHEME_GCS, "out")
+	if o := output.get("p/a.jsonl"); o != nil {
+		t.Errorf("output %q of the failed input", o.data)
+	}
+	report := output.get("p/" + ERRORS_NAME)
+	if report == nil || !strings.Contains(string(report.data), "model failure") {
+		t.Errorf("errors report without the error of the detail field: %v", report)
+	}
+}
+
+func TestRenameFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		renames  map[string]string
+		instance string
+		want     string
+		err      bool
+	}{
+		{name: "rename", renames: map[string]string{"a": "x"}, instance: `{"a":1,"b":2}`, want: `{"b":2,"x":1}`},
+		{name: "missing field", renames: map[string]string{"c": "x"}, instance: `{"a":1}`, want: `{"a":1}`},
+		{name: "swap", renames: map[string]string{"a": "b", "b": "a"}, instance: `{"a":1,"b":2}`, want: `{"a":2,"b":1}`},
+		{name: "nested kept", renames: map[string]string{"a": "x"}, instance: `{"n":{"a":1}}`, want: `{"n":{"a":1}}`},
+		{name: "not an object", renames: map[string]string{"a": "x"}, instance: `[1,2]`, want: `[1,2]`},
+		{name: "collision", renames: map[string]string{"a": "b"}, instance: `{"a":1,"b":2}`, err: true},
+	}
+	for _, test := range tests {
+		var instance interface{}
+		json.Unmarshal([]byte(test.instance), &instance)
+		err := renameFields(instance, test.renames)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: error expected", test.name)
+			}
+			continue
+		}
+		if got, _ := json.Marshal(instance); err != nil || string(got) != test.want {
+			t.Errorf("%s: %s, %v, %s expected", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestRenameFieldsOption(t *testing.T) {
+	opts := testOptions(t, "rename_fields=a=x,b=y")
+	if want := map[string]string{"a": "x", "b": "y"}; !reflect.DeepEqual(opts.RenameFields, want) {
+		t.Errorf("renames %v, %v expected", opts.RenameFields, want)
+	}
+	for _, query := range []string{"rename_fields=a=x,b=x", "rename_fields=a"} {
+		if _, err := getPredictionOptions(httptest.NewRequest("GET", "/?"+query, nil)); err == nil {
+			t.Errorf("%s accepted", query)
+		}
+	}
+
+	instances, _, err := readInstances(strings.NewReader("{\"a\":1,\"c\":3}\n{\"b\":2}\n"), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(instances)
+	if want := `[{"c":3,"x":1},{"y":2}]`; string(got) != want {
+		t.Errorf("instances %s, %s expected", got, want)
+	}
+	if _, _, err = readInstances(strings.NewReader("{\"a\":1,\"x\":2}\n"), nil, opts); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("collision error %v, error of the line 1 expected", err)
+	}
+}
+
+//The renamed instances are sent to the serving backend, the outputs are in the renamed fields
+func TestLoadAndPredictRenameFields(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(echoPredictions)
+	defer restore()
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("{\"age\":30,\"city\":\"Paris\"}\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/&rename_fields=age=feature_age", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	want := "{\"echo\":{\"city\":\"Paris\",\"feature_age\":30}}\n"
+	if got := string(stores.bucket(SCHEME_GCS, "out").get("p/a.jsonl").data); got != want {
+		t.Errorf("output %q, %q expected", got, want)
+	}
+}
+
+//In the aggregated output of sampled instances, each prediction has the input and the position of its instance
+func TestLoadAndPredictAnnotateIndex(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(echoPredictions)
+	defer restore()
+	input := stores.bucket(SCHEME_GCS, "in")
+	for _, name := range []string{"a", "b"} {
+		data := ""
+		for i := 0; i < 20; i++ {
+			data += fmt.Sprintf("{\"x\":%d}\n", i)
+		}
+		input.put("data/"+name+".jsonl", []byte(data), "application/json")
+	}
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/&aggregate=true&annotate_index=true&sample_rate=0.5&sample_seed=3", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	lines := strings.Split(strings.TrimSpace(string(stores.bucket(SCHEME_GCS, "out").get("p/"+DEFAULT_AGGREGATE_NAME+".jsonl").data)), "\n")
+	if len(lines) == 0 || len(lines) >= 40 {
+		t.Fatalf("%d predictions of 40 instances sampled at 0.5", len(lines))
+	}
+	seen := map[string]bool{}
+	for _, line := range lines {
+		var annotated struct {
+			Input      string
+			Index      int
+			Prediction struct{ Echo struct{ X int } }
+		}
+		if err := json.Unmarshal([]byte(line), &annotated); err != nil {
+			t.Fatalf("line %s: %s", line, err)
+		}
+		if annotated.Index != annotated.Prediction.Echo.X {
+			t.Errorf("line %s: index of instance %d", line, annotated.Prediction.Echo.X)
+		}
+		key := fmt.Sprintf("%s/%d", annotated.Input, annotated.Index)
+		if seen[key] || (annotated.Input != "a.jsonl" && annotated.Input != "b.jsonl") {
+			t.Errorf("line %s: input and index not unique", line)
+		}
+		seen[key] = true
+	}
+}
+
+func TestReplaceNonFinite(t *testing.T) {
+	body := `{"predictions":[NaN,1.5,-Infinity,"NaN",{"v":Infinity},"a \"NaN\" b"]}`
+	tests := []struct {
+		behavior string
+		want     string
+		err      bool
+	}{
+		{behavior: ON_NONFINITE_FAIL, err: true},
+		{behavior: ON_NONFINITE_NULL, want: `{"predictions":[null,1.5,null,"NaN",{"v":null},"a \"NaN\" b"]}`},
+		{behavior: ON_NONFINITE_STRING, want: `{"predictions":["NaN",1.5,"-Infinity","NaN",{"v":"Infinity"},"a \"NaN\" b"]}`},
+		{behavior: "-1", want: `{"predictions":[-1,1.5,-1,"NaN",{"v":-1},"a \"NaN\" b"]}`},
+	}
+	for _, test := range tests {
+		got, err := replaceNonFinite([]byte(body), test.behavior)
+		if test.err {
+			if err == nil || !strings.Contains(err.Error(), "NaN") {
+				t.Errorf("%s: %s, %v, error of the NaN expected", test.behavior, got, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: %s, %v, %s expected", test.behavior, got, err, test.want)
+		}
+	}
+
+	finite := []byte(`{"predictions":[1,"Infinity"]}`)
+	if got, err := replaceNonFinite(finite, ON_NONFINITE_FAIL); err != nil || string(got) != string(finite) {
+		t.Errorf("finite body changed: %s, %v", got, err)
+	}
+}
+
+func TestOnNonFiniteOption(t *testing.T) {
+	for _, value := range []string{ON_NONFINITE_FAIL, ON_NONFINITE_NULL, ON_NONFINITE_STRING, "0", "-1", "1.5e3"} {
+		if opts, err := getPredictionOptions(httptest.NewRequest("GET", "/?on_nonfinite="+url.QueryEscape(value), nil)); err != nil || opts.OnNonFinite != value {
+			t.Errorf("on_nonfinite=%s: %v", value, err)
+		}
+	}
+	for _, value := range []string{"NaN", "Inf", "+Inf", "-Infinity", "0x1p3", "1e999", "01", "zero"} {
+		if _, err := getPredictionOptions(httptest.NewRequest("GET", "/?on_nonfinite="+url.QueryEscape(value), nil)); err == nil {
+			t.Errorf("on_nonfinite=%s accepted", value)
+		}
+	}
+}
+
+//The non finite values of a regression model are replaced in the outputs, or fail the run by default
+func TestLoadAndPredictNonFinite(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"predictions":[[NaN],[1.5],[-Infinity]]}`))
+	})
+	defer restore()
+	stores.bucket(SCHEME_GCS, "in").put("data/a.jsonl", []byte("[1]\n[2]\n[3]\n"), "application/json")
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/&on_nonfinite=null", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got, want := string(stores.bucket(SCHEME_GCS, "out").get("p/a.jsonl").data), "[null]\n[1.5]\n[null]\n"; got != want {
+		t.Errorf("output %q, %q expected", got, want)
+	}
+
+	w = serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/failed/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d: %s, 500 expected on the NaN", w.Code, w.Body)
+	}
+	if o := stores.bucket(SCHEME_GCS, "out").get("failed/a.jsonl"); o != nil {
+		t.Errorf("output %q of the failed run", o.data)
+	}
+}
+
+//Compress the content with gzip
+func gzipBytes(t *testing.T, content string) []byte {
+	t.Helper()
+	b := &bytes.Buffer{}
+	gz := gzip.NewWriter(b)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReadBatchesLayout(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		input string
+		want  string
+		err   bool
+	}{
+		{name: "lines", input: "{\"x\":1}\n\n{\"x\":2}\n", want: `[{"x":1},{"x":2}]`},
+		{name: "array", input: " [{\"x\":1},\n{\"x\":2}]\n", want: `[{"x":1},{"x":2}]`},
+		{name: "lines of arrays", input: "[1,2]\n[3,4]\n", want: `[[1,2],[3,4]]`},
+		{name: "forced array", query: "json_layout=array", input: "[[1,2],[3,4]]", want: `[[1,2],[3,4]]`},
+		{name: "forced lines", query: "json_layout=lines", input: "[1,2]\n", want: `[[1,2]]`},
+		{name: "forced array on lines", query: "json_layout=array", input: "{\"x\":1}\n{\"x\":2}\n", err: true},
+		{name: "invalid line", input: "{\"x\":1}\n{\"x\":\n", err: true},
+		{name: "blank lines of arrays", input: "\n [1,2]\n\n[3,4]", want: `[[1,2],[3,4]]`},
+		{name: "single line array", input: "[{\"x\":1},{\"x\":2}]\n\n", want: `[{"x":1},{"x":2}]`},
+		{name: "single line instance", input: "[1,2,3]\n", want: `[[1,2,3]]`},
+		{name: "array of arrays", input: "[\n[1,2],\n[3,4]\n]\n", want: `[[1,2],[3,4]]`},
+		{name: "data after the array", input: "[\n{\"x\":1}\n]\n{\"x\":2}\n", err: true},
+		{name: "invalid element", input: "[{\"x\":1},\n{\"x\"}]", err: true},
+		{name: "forced empty array", query: "json_layout=array", input: " \n", want: `[]`},
+	}
+	for _, test := range tests {
+		instances, _, err := readInstances(strings.NewReader(test.input), nil, testOptions(t, test.query))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: %v, error expected", test.name, instances)
+			}
+			continue
+		}
+		if got, _ := json.Marshal(instances); err != nil || string(got) != test.want {
+			t.Errorf("%s: %s, %v, %s expected", test.name, got, err, test.want)
+		}
+	}
+}
+
+//Reader of the input which counts the bytes read
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+//The JSON lines of arrays and the JSON arrays are both streamed, the first batch is handled before the whole input is
+//read. The line numbers of the JSON lines are kept
+func TestReadBatchesStreaming(t *testing.T) {
+	lines, array := &bytes.Buffer{}, &bytes.Buffer{}
+	array.WriteString("[\n")
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(lines, "[%d,%d]\n", i, i+1)
+		fmt.Fprintf(array, "{\"x\":%d},\n", i)
+	}
+	array.WriteString("{\"x\":-1}\n]\n")
+	for name, data := range map[string][]byte{"lines": lines.Bytes(), "array": array.Bytes()} {
+		input := &countingReader{reader: bytes.NewReader(data)}
+		read := -1
+		count, err := readBatches(input, nil, testOptions(t, ""), 10, func(positions []int, batch []interface{}) error {
+			if read < 0 {
+				read = input.read
+			}
+			return nil
+		})
+		if err != nil || count < 100000 {
+			t.Errorf("%s: %d instances, %v", name, count, err)
+		}
+		if read < 0 || read > len(data)/10 {
+			t.Errorf("%s: %d bytes of %d read before the first batch", name, read, len(data))
+		}
+	}
+
+	_, _, err := readInstances(strings.NewReader("[1,2]\n\n[3,\n"), nil, testOptions(t, ""))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("invalid third line: %v", err)
+	}
+}
+
+//The gzip decompression and the JSON array detection work together, on the .json.gz inputs
+func TestLoadAndPredictGzipArray(t *testing.T) {
+	stores := newMemStores()
+	defer useMemStores(stores)()
+	_, restore := useStubTF(echoPredictions)
+	defer restore()
+	input := stores.bucket(SCHEME_GCS, "in")
+	input.put("data/array.json.gz", gzipBytes(t, "[{\"x\":1},\n {\"x\":2}]\n"), "application/gzip")
+	input.put("data/lines.jsonl.gz", gzipBytes(t, "{\"x\":3}\n{\"x\":4}\n"), "application/gzip")
+
+	w := serve(httptest.NewRequest("GET", "/?input=gs://in/data/&output=gs://out/p/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	output := stores.bucket(SCHEME_GCS, "out")
+	want := map[string]string{
+		"p/array.json.gz":  "{\"echo\":{\"x\":1}}\n{\"echo\":{\"x\":2}}\n",
+		"p/lines.jsonl.gz": "{\"echo\":{\"x\":3}}\n{\"echo\":{\"x\":4}}\n",
+	}
+	for name, content := range want {
+		o := output.get(name)
+		if o == nil {
+			t.Errorf("output %s missing in %v", name, output.names())
+		} else if string(o.data) != content {
+			t.Errorf("output %s: %q, %q expected", name, o.data, content)
+		}
+	}
+
+	// A truncated gzip stream fails the file
+	input.put("data/array.json.gz", gzipBytes(t, "[{\"x\":1}]")[:12], "application/gzip")
+	w = serve(httptest.NewRequest("GET", "/?input=gs://in/data/array.json.gz&output=gs://out/truncated/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d: %s, 500 expected on the truncated gzip input", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	//Max duration, in seconds, of the in-flight requests on shutdown. Cloud Run kills the container 10 seconds after
+	//the SIGTERM
+	shutdownTimeout = getEnvInt("SHUTDOWN_TIMEOUT", 8)
+)
+
+//Tensorflow servers running, killed on shutdown
+var runningServers = struct {
+	sync.Mutex
+	servers      map[*tfServer]bool
+	shuttingDown bool
+}{servers: map[*tfServer]bool{}}
+
+//Record the running server. False if the process is shutting down, the server must not run
+func trackServer(s *tfServer) bool {
+	runningServers.Lock()
+	defer runningServers.Unlock()
+	if runningServers.shuttingDown {
+		return false
+	}
+	runningServers.servers[s] = true
+	return true
+}
+
+func untrackServer(s *tfServer) {
+	runningServers.Lock()
+	defer runningServers.Unlock()
+	delete(runningServers.servers, s)
+}
+
+//Wait SIGINT or SIGTERM, then stop accepting new requests and let the in-flight ones and the running jobs finish, up
+//to SHUTDOWN_TIMEOUT seconds. The Tensorflow servers still running are killed and the local model is removed before returning
+func waitShutdown(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logInfof(context.Background(), "%s received, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logWarningf(ctx, "in-flight requests not completed after %d seconds: %s", shutdownTimeout, err)
+	}
+	if err := waitJobs(ctx); err != nil {
+		logWarningf(ctx, "running jobs not completed after %d seconds: %s", shutdownTimeout, err)
+	}
+	if err := waitMetrics(ctx); err != nil {
+		logWarningf(ctx, "metrics not sent after %d seconds: %s", shutdownTimeout, err)
+	}
+	stopServers(ctx)
+}
+
+//Kill the Tensorflow servers still running, the persistent and the served ones included, and remove the local model
+//and the model cache.
+//No server can be started after
+func stopServers(ctx context.Context) {
+	runningServers.Lock()
+	runningServers.shuttingDown = true
+	var servers []*tfServer
+	for s := range runningServers.servers {
+		servers = append(servers, s)
+	}
+	runningServers.Unlock()
+	for _, s := range servers {
+		s.stop()
+	}
+	os.RemoveAll(localModelPath)
+	os.RemoveAll(modelCacheDir)
+	logInfof(ctx, "shutdown completed, %d tensorflow server(s) stopped", len(servers))
+}
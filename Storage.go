@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	//Scheme of the GCS locations
+	SCHEME_GCS = "gs"
+	//Scheme of the S3 and S3 compatible, like MinIO, locations
+	SCHEME_S3 = "s3"
+	//Scheme of the local filesystem locations
+	SCHEME_FILE = "file"
+)
+
+//Error of a missing object, bucket, or storage directory without object. It's a user error, answered with a 404
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+//Bucket of an object storage holding the models, the inputs or the outputs. The object names are the full paths in
+//the bucket
+type ObjectStore interface {
+	//Location of the object, with the scheme and the bucket. The location of the bucket if the name is empty
+	Location(name string) string
+	//List the objects whose name starts with the prefix. A missing bucket returns a *notFoundError
+	List(ctx context.Context, prefix string) ([]objectInfo, error)
+	//List the subdirectories directly under the directory prefix, ending by "/", with their full name. A missing bucket
+	//returns a *notFoundError
+	ListDirs(ctx context.Context, prefix string) ([]string, error)
+	//Read the object, at the generation if not 0. A missing object returns a *notFoundError
+	Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error)
+	//Write the object. It's only created when the writer is closed without error. Canceling the context before the
+	//close aborts the upload. The content encoding, like gzip, is set on the object if not empty
+	Upload(ctx context.Context, name string, contentType string, contentEncoding string, metadata map[string]string) io.WriteCloser
+	//Delete the object. Deleting a missing object isn't an error
+	Delete(ctx context.Context, name string) error
+}
+
+//Object of a listing
+type objectInfo struct {
+	Name string
+	Size int64
+	//Empty if unknown
+	ContentType string
+	Checksums   objectChecksums
+	//Version of the content, changed when the object is written again: the GCS generation, the S3 ETag or the local
+	//modification time. Empty if unknown
+	Version string
+}
+
+//Checksums of the object content stored by the backend, for verifying the downloads. The zero value checks nothing
+type objectChecksums struct {
+	//CRC32C, with the Castagnoli table, only checked if HasCRC32C
+	CRC32C    uint32
+	HasCRC32C bool
+	//Empty if unknown, like for the GCS composite objects
+	MD5 []byte
+}
+
+//Hash of the downloaded content, compared to the stored checksums when the download is complete. The CRC32C is
+//preferred, the MD5 is only computed without it
+type checksumVerifier struct {
+	want objectChecksums
+	hash hash.Hash
+}
+
+func newChecksumVerifier(want objectChecksums) *checksumVerifier {
+	v := &checksumVerifier{want: want}
+	switch {
+	case want.HasCRC32C:
+		v.hash = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case len(want.MD5) > 0:
+		v.hash = md5.New()
+	}
+	return v
+}
+
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	if v.hash != nil {
+		v.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+//Check the hash of the written content. The error explains the mismatch
+func (v *checksumVerifier) verify() error {
+	switch {
+	case v.want.HasCRC32C:
+		if got := v.hash.(hash.Hash32).Sum32(); got != v.want.CRC32C {
+			return errors.New(fmt.Sprintf("CRC32C %08x of the downloaded content different from %08x", got, v.want.CRC32C))
+		}
+	case len(v.want.MD5) > 0:
+		if got := v.hash.Sum(nil); !bytes.Equal(got, v.want.MD5) {
+			return errors.New(fmt.Sprintf("MD5 %x of the downloaded content different from %x", got, v.want.MD5))
+		}
+	}
+	return nil
+}
+
+//Storage location of a location param
+type storeLocation struct {
+	//Scheme of the location, which selects the storage backend
+	Scheme string
+	//Empty for the local filesystem
+	Bucket string
+	//Path in the bucket. For the local filesystem, absolute path without the leading "/"
+	Path string
+}
+
+//Provider of the stores of the locations of a request. The handlers only access the storage through it
+type StoreProvider interface {
+	//Get the store of the location bucket. The requests are billed to the user project if set
+	Store(ctx context.Context, location storeLocation, userProject string) (ObjectStore, error)
+}
+
+//Create the store provider of a request. The storage clients by default, it can be replaced by another
+//implementation, like an in-memory one, without changing the handlers
+var newStoreProvider = func() StoreProvider {
+	return &storageClients{}
+}
+
+//Clients of the storage backends of a request, created on first use
+type storageClients struct {
+	gcs *storage.Client
+	s3  *s3Client
+}
+
+//Get the store of the location bucket. For GCS, if a user project is set, the requests on the bucket are billed to
+//it, as required by the requester pays buckets. The calls of the bucket stores are bounded by the storage timeouts
+//and retried on the transient errors
+func (c *storageClients) Store(ctx context.Context, location storeLocation, userProject string) (ObjectStore, error) {
+	switch location.Scheme {
+	case SCHEME_GCS:
+		if c.gcs == nil {
+			client, err := storage.NewClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			c.gcs = client
+		}
+		return &retryStore{&timeoutStore{&gcsStore{name: location.Bucket, bucket: getBucket(c.gcs, location.Bucket, userProject)}}}, nil
+	case SCHEME_S3:
+		if c.s3 == nil {
+			client, err := newS3Client()
+			if err != nil {
+				return nil, err
+			}
+			c.s3 = client
+		}
+		return &retryStore{&timeoutStore{c.s3.bucket(location.Bucket)}}, nil
+	case SCHEME_FILE:
+		return &localStore{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported storage scheme '%s'", location.Scheme))
+}
+
+//GCS bucket
+type gcsStore struct {
+	name   string
+	bucket *storage.BucketHandle
+}
+
+func (s *gcsStore) Location(name string) string {
+	return SCHEME_GCS + "://" + s.name + "/" + name
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var ret []objectInfo
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err == storage.ErrBucketNotExist {
+			return nil, &notFoundError{message: fmt.Sprintf("bucket %s not found", s.Location(""))}
+		}
+		if err != nil {
+			return nil, err
+		}
+		info := objectInfo{Name: attrs.Name, Size: attrs.Size, ContentType: attrs.ContentType, Version: strconv.FormatInt(attrs.Generation, 10)}
+		// The gzip encoded objects are decompressed on download, their content doesn't match the stored checksums
+		if attrs.ContentEncoding != "gzip" {
+			info.Checksums = objectChecksums{CRC32C: attrs.CRC32C, HasCRC32C: true, MD5: attrs.MD5}
+		}
+		ret = append(ret, info)
+	}
+	return ret, nil
+}
+
+func (s *gcsStore) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	var ret []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err == storage.ErrBucketNotExist {
+			return nil, &notFoundError{message: fmt.Sprintf("bucket %s not found", s.Location(""))}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			ret = append(ret, attrs.Prefix)
+		}
+	}
+	return ret, nil
+}
+
+func (s *gcsStore) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	object := s.bucket.Object(name)
+	if generation != 0 {
+		object = object.Generation(generation)
+	}
+	r, err := object.NewReader(ctx)
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return nil, &notFoundError{message: fmt.Sprintf("object %s not found", s.Location(name))}
+	}
+	return r, err
+}
+
+//GCS commits the object on the writer close
+func (s *gcsStore) Upload(ctx context.Context, name string, contentType string, contentEncoding string, metadata map[string]string) io.WriteCloser {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.Metadata = metadata
+	w.ContentType = contentType
+	w.ContentEncoding = contentEncoding
+	return w
+}
+
+func (s *gcsStore) Delete(ctx context.Context, name string) error {
+	if err := s.bucket.Object(name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
+}
+
+//Get the bucket handle. If a user project is set, the requests on the bucket are billed to it, as required by the
+//requester pays buckets
+func getBucket(client *storage.Client, bucket string, userProject string) *storage.BucketHandle {
+	handle := client.Bucket(bucket)
+	if userProject != "" {
+		handle = handle.UserProject(userProject)
+	}
+	return handle
+}
+
+//Extract the location from Param. The scheme, gs://, s3:// or file://, selects the storage backend. An absolute path,
+//starting by "/", is a file:// location
+func extractLocation(location string) (storeLocation, error) {
+	if strings.HasPrefix(location, "/") {
+		location = SCHEME_FILE + "://" + location
+	}
+	s := strings.SplitN(location, "://", 2)
+	if len(s) == 2 && s[0] == SCHEME_FILE {
+		if !localStorage {
+			return storeLocation{}, errors.New("local filesystem locations are disabled, set LOCAL_STORAGE=true for enabling them")
+		}
+		if !strings.HasPrefix(s[1], "/") {
+			return storeLocation{}, errors.New("location must be " + SCHEME_FILE + ":///<absolute path>")
+		}
+		return storeLocation{Scheme: SCHEME_FILE, Path: filepath.Clean(s[1])[1:] + trailingSlash(s[1])}, nil
+	}
+	if len(s) != 2 || (s[0] != SCHEME_GCS && s[0] != SCHEME_S3) {
+		return storeLocation{}, errors.New("location must start with '" + SCHEME_GCS + "://', '" + SCHEME_S3 + "://' or '" + SCHEME_FILE + "://'")
+	}
+	bucketPath := strings.SplitN(s[1], "/", 2)
+	if bucketPath[0] == "" || len(bucketPath) != 2 {
+		return storeLocation{}, errors.New("location must be " + s[0] + "://<bucket>/<path>")
+	}
+	if hasParentSegment(bucketPath[1]) {
+		return storeLocation{}, errors.New("location path must not contain '..' segments")
+	}
+	return storeLocation{Scheme: s[0], Bucket: bucketPath[0], Path: bucketPath[1]}, nil
+}
+
+//Return true if the "/" separated path has a ".." segment. Valid in an object name, it would escape the local
+//directory of the files named after the object
+func hasParentSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+//Return true if the local path is inside the directory, once both are cleaned
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//Keep the directory marker of the path, removed by the cleaning
+func trailingSlash(path string) string {
+	if strings.HasSuffix(path, "/") && path != "/" {
+		return "/"
+	}
+	return ""
+}
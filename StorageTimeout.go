@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	//Max duration, in seconds, of an attempt of a storage listing, deletion or download opening. 0 for no limit
+	storageTimeout = getEnvInt("STORAGE_TIMEOUT", 60)
+	//Max duration, in seconds, of a read or a write of a storage download or upload, without progress. 0 for no limit
+	storageStallTimeout = getEnvInt("STORAGE_STALL_TIMEOUT", 60)
+)
+
+//Error of a storage call cancelled by its timeout. It's transient, the call can be retried
+type storageTimeoutError struct {
+	message string
+}
+
+func (e *storageTimeoutError) Error() string {
+	return e.message
+}
+
+//Store which bounds the duration of its calls. A stalled call fails with a *storageTimeoutError instead of blocking
+//the run. The downloads and the uploads are only bounded while a read or a write waits the backend, a slow client
+//isn't a stall
+type timeoutStore struct {
+	ObjectStore
+}
+
+func (s *timeoutStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	ctx, watchdog := newStorageWatchdog(ctx, storageTimeout)
+	defer watchdog.cancel()
+	var ret []objectInfo
+	err := watchdog.guard("STORAGE_TIMEOUT", "listing of "+s.Location(prefix), func() error {
+		var err error
+		ret, err = s.ObjectStore.List(ctx, prefix)
+		return err
+	})
+	return ret, err
+}
+
+func (s *timeoutStore) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	ctx, watchdog := newStorageWatchdog(ctx, storageTimeout)
+	defer watchdog.cancel()
+	var ret []string
+	err := watchdog.guard("STORAGE_TIMEOUT", "listing of "+s.Location(prefix), func() error {
+		var err error
+		ret, err = s.ObjectStore.ListDirs(ctx, prefix)
+		return err
+	})
+	return ret, err
+}
+
+//The context of the download lasts until the reader is closed
+func (s *timeoutStore) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	ctx, watchdog := newStorageWatchdog(ctx, storageTimeout)
+	var ret io.ReadCloser
+	err := watchdog.guard("STORAGE_TIMEOUT", "download of "+s.Location(name), func() error {
+		var err error
+		ret, err = s.ObjectStore.Download(ctx, name, generation)
+		return err
+	})
+	if err != nil {
+		watchdog.cancel()
+		return nil, err
+	}
+	stall := &storageWatchdog{timeout: time.Duration(storageStallTimeout) * time.Second, cancel: watchdog.cancel}
+	return &stallReader{ReadCloser: ret, watchdog: stall, operation: "download of " + s.Location(name)}, nil
+}
+
+//The context of the upload lasts until the writer is closed
+func (s *timeoutStore) Upload(ctx context.Context, name string, contentType string, contentEncoding string, metadata map[string]string) io.WriteCloser {
+	ctx, watchdog := newStorageWatchdog(ctx, storageStallTimeout)
+	w := s.ObjectStore.Upload(ctx, name, contentType, contentEncoding, metadata)
+	return &stallWriter{WriteCloser: w, watchdog: watchdog, operation: "upload of " + s.Location(name)}
+}
+
+func (s *timeoutStore) Delete(ctx context.Context, name string) error {
+	ctx, watchdog := newStorageWatchdog(ctx, storageTimeout)
+	defer watchdog.cancel()
+	return watchdog.guard("STORAGE_TIMEOUT", "deletion of "+s.Location(name), func() error {
+		return s.ObjectStore.Delete(ctx, name)
+	})
+}
+
+//Cancellation of the context of a storage call when it lasts more than the timeout
+type storageWatchdog struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+	fired   int32
+}
+
+//Get the cancellable context of a storage call and its watchdog, with the timeout in seconds
+func newStorageWatchdog(ctx context.Context, seconds int) (context.Context, *storageWatchdog) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &storageWatchdog{timeout: time.Duration(seconds) * time.Second, cancel: cancel}
+}
+
+//Run the call, with its context cancelled if it lasts more than the timeout. The error of a call cancelled by the
+//timeout is a *storageTimeoutError naming the limit
+func (w *storageWatchdog) guard(limit string, operation string, call func() error) error {
+	if w.timeout <= 0 {
+		return call()
+	}
+	timer := time.AfterFunc(w.timeout, func() {
+		atomic.StoreInt32(&w.fired, 1)
+		w.cancel()
+	})
+	err := call()
+	timer.Stop()
+	if err != nil && atomic.LoadInt32(&w.fired) == 1 {
+		return &storageTimeoutError{message: fmt.Sprintf("%s stalled for %s, limit set by %s: %s", operation, w.timeout, limit, err)}
+	}
+	return err
+}
+
+//Reader of a download, cancelled when a read waits the backend more than STORAGE_STALL_TIMEOUT
+type stallReader struct {
+	io.ReadCloser
+	watchdog  *storageWatchdog
+	operation string
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	var n int
+	err := r.watchdog.guard("STORAGE_STALL_TIMEOUT", r.operation, func() error {
+		var err error
+		n, err = r.ReadCloser.Read(p)
+		return err
+	})
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.watchdog.cancel()
+	return err
+}
+
+//Writer of an upload, aborted when a write, or the commit on the close, waits the backend more than
+//STORAGE_STALL_TIMEOUT
+type stallWriter struct {
+	io.WriteCloser
+	watchdog  *storageWatchdog
+	operation string
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	var n int
+	err := w.watchdog.guard("STORAGE_STALL_TIMEOUT", w.operation, func() error {
+		var err error
+		n, err = w.WriteCloser.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (w *stallWriter) Close() error {
+	err := w.watchdog.guard("STORAGE_STALL_TIMEOUT", w.operation, w.WriteCloser.Close)
+	w.watchdog.cancel()
+	return err
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//Path of the traces on the OTLP/HTTP collector, added to OTEL_EXPORTER_OTLP_ENDPOINT
+	OTLP_TRACES_PATH = "/v1/traces"
+	//Timeout of the export of the spans of a run
+	OTLP_EXPORT_TIMEOUT = 10 * time.Second
+	//W3C trace context header of the incoming requests
+	TRACEPARENT_HEADER = "traceparent"
+
+	//Kinds and status codes of the OTLP spans
+	OTLP_SPAN_KIND_INTERNAL = 1
+	OTLP_SPAN_KIND_SERVER   = 2
+	OTLP_STATUS_OK          = 1
+	OTLP_STATUS_ERROR       = 2
+)
+
+var (
+	//OTLP/HTTP collector of the traces, with the standard OpenTelemetry variables. The tracing is disabled without
+	//endpoint
+	otlpTracesEndpoint = getOTLPTracesEndpoint()
+	//Comma separated list of key=value headers of the export requests, like an API key of the collector
+	otlpHeaders = getEnvString("OTEL_EXPORTER_OTLP_HEADERS", "")
+	//Name of the service in the traces
+	otelServiceName = getEnvString("OTEL_SERVICE_NAME", "embedded-tf")
+)
+
+//The traces endpoint is used as is, the generic endpoint is completed by the traces path
+func getOTLPTracesEndpoint() string {
+	tracesEndpoint := getEnvString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	endpoint := getEnvString("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if tracesEndpoint != "" {
+		return tracesEndpoint
+	}
+	if endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + OTLP_TRACES_PATH
+	}
+	return ""
+}
+
+//Step of a run, exported to the OTLP collector with the other spans of the run when the root span ends. The nil span,
+//outside of a traced run, records nothing
+type span struct {
+	mu         sync.Mutex
+	trace      *traceBuffer
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]interface{}
+	events     []otlpEvent
+	err        error
+}
+
+//Ended spans of a run, exported together
+type traceBuffer struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+type spanKey struct{}
+
+//Start the root span of the run. It continues the trace of the traceparent header if valid, else starts a new trace.
+//Nil if the tracing is disabled
+func startRootSpan(ctx context.Context, r *http.Request, name string) (context.Context, *span) {
+	if otlpTracesEndpoint == "" {
+		return ctx, nil
+	}
+	s := &span{trace: &traceBuffer{}, traceID: randomHex(16), spanID: randomHex(8), name: name,
+		kind: OTLP_SPAN_KIND_SERVER, start: time.Now(), attributes: map[string]interface{}{}}
+	// version-trace_id-parent_id-flags
+	parts := strings.Split(r.Header.Get(TRACEPARENT_HEADER), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 && isHex(parts[1]) && isHex(parts[2]) &&
+		parts[1] != strings.Repeat("0", 32) {
+		s.traceID, s.parentID = parts[1], parts[2]
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+//Start a child span of the span of the context. Nil outside of a traced run
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, ok := ctx.Value(spanKey{}).(*span)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+	s := &span{trace: parent.trace, traceID: parent.traceID, spanID: randomHex(8), parentID: parent.spanID, name: name,
+		kind: OTLP_SPAN_KIND_INTERNAL, start: time.Now(), attributes: map[string]interface{}{}}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+//Get the span of the context, nil outside of a traced run
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+//Set an attribute of the span: a string, a bool, an integer or a float
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+//Record an event of the span, at the current time
+func (s *span) event(name string, attributes map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, otlpEvent{TimeUnixNano: unixNano(time.Now()), Name: name, Attributes: otlpAttributes(attributes)})
+}
+
+//Record the error of the span, its status is then in error
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+//End the span. The end of the root span exports all the ended spans of the run. Best effort, the errors are only
+//logged
+func (s *span) end(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(time.Now()),
+		Attributes:        otlpAttributes(s.attributes),
+		Events:            s.events,
+		Status:            otlpStatus{Code: OTLP_STATUS_OK},
+	}
+	if s.err != nil {
+		ended.Status = otlpStatus{Code: OTLP_STATUS_ERROR, Message: s.err.Error()}
+	}
+	s.mu.Unlock()
+
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, ended)
+	spans := s.trace.spans
+	s.trace.mu.Unlock()
+	if s.kind == OTLP_SPAN_KIND_SERVER {
+		if err := exportSpans(spans); err != nil {
+			logWarningf(ctx, "trace %s not exported: %s", s.traceID, err)
+		}
+	}
+}
+
+//OTLP/HTTP JSON encoding of the spans
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+//The 64 bits integers are JSON strings in the OTLP JSON encoding
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	var ret []otlpAttribute
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch t := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": t}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(t)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(t, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": t}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(t)}
+		}
+		ret = append(ret, otlpAttribute{Key: key, Value: v})
+	}
+	return ret
+}
+
+//Post the spans to the OTLP collector
+func exportSpans(spans []otlpSpan) error {
+	export := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{{Spans: spans}}}
+	export.Resource.Attributes = otlpAttributes(map[string]interface{}{"service.name": otelServiceName})
+	export.ScopeSpans[0].Scope.Name = otelServiceName
+	b, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{export}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, otlpTracesEndpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, kv := range strings.Split(otlpHeaders, ",") {
+		if s := strings.SplitN(kv, "=", 2); len(s) == 2 {
+			req.Header.Set(strings.TrimSpace(s[0]), strings.TrimSpace(s[1]))
+		}
+	}
+	client := &http.Client{Timeout: OTLP_EXPORT_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("collector returned %s", resp.Status))
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
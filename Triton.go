@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sync"
+)
+
+//Triton Inference Server backend, with the KServe v2 REST API. The model param must reference a Triton model
+//directory, with the config.pbtxt and the numeric version subdirectories
+type tritonPredictor struct {
+	mu sync.Mutex
+	//Metadata of the served model, fetched by the first batch. Reset when the server is started, with another model
+	//or after a restart
+	metadata *tritonModelMetadata
+}
+
+//Tensor of the KServe v2 API. The data are flattened in row-major order
+type tritonTensor struct {
+	Name     string        `json:"name"`
+	Shape    []int         `json:"shape"`
+	Datatype string        `json:"datatype"`
+	Data     []interface{} `json:"data,omitempty"`
+}
+
+//Metadata of the served model, with the expected inputs
+type tritonModelMetadata struct {
+	Inputs []tritonTensor `json:"inputs"`
+}
+
+func (p *tritonPredictor) Name() string {
+	return BACKEND_TRITON
+}
+
+//The model directory is named as the model in the model repository
+func (p *tritonPredictor) ModelPath() string {
+	return localModelPath + modelName + "/"
+}
+
+//The model repository layout, with its config and version directories, is checked by Triton at startup
+func (p *tritonPredictor) ValidateModel(path string) error {
+	return nil
+}
+
+func (p *tritonPredictor) Command() *exec.Cmd {
+	p.mu.Lock()
+	p.metadata = nil
+	p.mu.Unlock()
+	return exec.Command("tritonserver", "--model-repository="+localModelPath, "--http-port="+tfPort,
+		"--grpc-port="+tfGRPCPort, "--allow-metrics=false")
+}
+
+func (p *tritonPredictor) StartMarker() string {
+	return "Started HTTPService"
+}
+
+func (p *tritonPredictor) StatusURL() string {
+	return p.modelURL() + "/ready"
+}
+
+//The ready URL of the model answers 200 only once the model is loaded
+func (p *tritonPredictor) ModelAvailable() error {
+	resp, err := tfClient.Get(p.StatusURL())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("model status returned %s", resp.Status))
+	}
+	return nil
+}
+
+func (p *tritonPredictor) PredictURL(opts *predictionOptions) string {
+	return p.modelURL() + "/infer"
+}
+
+func (p *tritonPredictor) modelURL() string {
+	return "http://localhost:" + tfPort + "/v2/models/" + modelName
+}
+
+//Build the input tensors from the instances. Each instance is a JSON object with one field per model input, or
+//directly the value of the input if the model has only one input. The tensor datatypes are the ones declared in
+//the model metadata
+func (p *tritonPredictor) FormatInput(instances []interface{}, opts *predictionOptions) ([]byte, error) {
+	metadata, err := p.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	var tensors []tritonTensor
+	for _, input := range metadata.Inputs {
+		tensor := tritonTensor{Name: input.Name, Datatype: input.Datatype, Data: []interface{}{}}
+		var instanceShape []int
+		for i, instance := range instances {
+			value, err := getInstanceInput(instance, input.Name, len(metadata.Inputs))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("instance %d: %s", i, err))
+			}
+			shape := getShape(value)
+			if i == 0 {
+				instanceShape = shape
+			} else if !equalShapes(shape, instanceShape) {
+				return nil, errors.New(fmt.Sprintf("instance %d: input '%s' shape %v different from %v", i, input.Name, shape, instanceShape))
+			}
+			tensor.Data = flatten(value, tensor.Data)
+		}
+		tensor.Shape = append([]int{len(instances)}, instanceShape...)
+		tensors = append(tensors, tensor)
+	}
+	return json.Marshal(map[string]interface{}{"inputs": tensors})
+}
+
+//The first dimension of the model inputs is the batch, as built by FormatInput
+func (p *tritonPredictor) InputShapes(opts *predictionOptions) (map[string][]int, error) {
+	metadata, err := p.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+	shapes := map[string][]int{}
+	for _, input := range metadata.Inputs {
+		if len(input.Shape) > 0 {
+			shapes[input.Name] = input.Shape[1:]
+		}
+	}
+	return shapes, nil
+}
+
+//Split the output tensors per instance. With only one output, the prediction is the value of the output, else it's
+//a JSON object with one field per output, like Tensorflow
+func (p *tritonPredictor) FormatOutput(output []byte, opts *predictionOptions) ([]interface{}, error) {
+	answer := map[string]json.RawMessage{}
+	if err := decodeResponse(output, &answer); err != nil {
+		return nil, err
+	}
+	if predictionError := getResponseError(answer[opts.ErrorKey]); predictionError != "" {
+		return nil, errors.New(predictionError)
+	}
+
+	var outputs []tritonTensor
+	if err := json.Unmarshal(answer["outputs"], &outputs); err != nil || len(outputs) == 0 {
+		return nil, errors.New(fmt.Sprintf("no 'outputs' in the serving response %s", output))
+	}
+
+	var predictions []interface{}
+	for _, o := range outputs {
+		if len(o.Shape) == 0 {
+			return nil, errors.New(fmt.Sprintf("output '%s' without batch dimension", o.Name))
+		}
+		size := 1
+		for _, d := range o.Shape[1:] {
+			size *= d
+		}
+		if len(o.Data) != o.Shape[0]*size {
+			return nil, errors.New(fmt.Sprintf("output '%s' has %d values for the shape %v", o.Name, len(o.Data), o.Shape))
+		}
+		if predictions == nil {
+			predictions = make([]interface{}, o.Shape[0])
+		} else if len(predictions) != o.Shape[0] {
+			return nil, errors.New(fmt.Sprintf("output '%s' batch size %d different from %d", o.Name, o.Shape[0], len(predictions)))
+		}
+
+		for i := range predictions {
+			value := reshape(o.Data[i*size:(i+1)*size], o.Shape[1:])
+			if len(outputs) == 1 {
+				predictions[i] = value
+				continue
+			}
+			if predictions[i] == nil {
+				predictions[i] = map[string]interface{}{}
+			}
+			predictions[i].(map[string]interface{})[o.Name] = value
+		}
+	}
+	return predictions, nil
+}
+
+//Get the metadata of the served model, requested only once per started server
+func (p *tritonPredictor) getMetadata() (*tritonModelMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	resp, err := tfClient.Get(p.modelURL())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("model metadata returned %s: %s", resp.Status, body))
+	}
+
+	metadata := &tritonModelMetadata{}
+	if err = json.Unmarshal(body, metadata); err != nil {
+		return nil, err
+	}
+	p.metadata = metadata
+	return metadata, nil
+}
+
+//Get the value of the input in the instance
+func getInstanceInput(instance interface{}, name string, inputCount int) (interface{}, error) {
+	if o, ok := instance.(map[string]interface{}); ok {
+		if value, ok := o[name]; ok {
+			return value, nil
+		}
+	}
+	if inputCount == 1 {
+		return instance, nil
+	}
+	return nil, errors.New(fmt.Sprintf("missing input '%s'", name))
+}
+
+//Get the shape of a value made of nested JSON arrays. The shape of a scalar is empty
+func getShape(value interface{}) []int {
+	var shape []int
+	for {
+		a, ok := value.([]interface{})
+		if !ok {
+			return shape
+		}
+		shape = append(shape, len(a))
+		if len(a) == 0 {
+			return shape
+		}
+		value = a[0]
+	}
+}
+
+func equalShapes(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//Append the scalars of the nested JSON arrays to data, in row-major order
+func flatten(value interface{}, data []interface{}) []interface{} {
+	a, ok := value.([]interface{})
+	if !ok {
+		return append(data, value)
+	}
+	for _, v := range a {
+		data = flatten(v, data)
+	}
+	return data
+}
+
+//Build nested JSON arrays of the shape from the flat data in row-major order. A scalar if the shape is empty
+func reshape(data []interface{}, shape []int) interface{} {
+	if len(shape) == 0 {
+		return data[0]
+	}
+	ret := make([]interface{}, shape[0])
+	if shape[0] == 0 {
+		return ret
+	}
+	size := len(data) / shape[0]
+	for i := range ret {
+		ret[i] = reshape(data[i*size:(i+1)*size], shape[1:])
+	}
+	return ret
+}
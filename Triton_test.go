@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+//The model metadata is requested by the first batch only, and again once the server is started again
+func TestTritonMetadataCache(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"inputs":[{"name":"x","shape":[-1,2],"datatype":"FP32"}]}`))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousPort := tfPort
+	tfPort = u.Port()
+	defer func() { tfPort = previousPort }()
+
+	p := &tritonPredictor{}
+	opts := testOptions(t, "")
+	for i := 0; i < 3; i++ {
+		if _, err = p.FormatInput([]interface{}{[]interface{}{1.0, 2.0}}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shapes, err := p.InputShapes(opts)
+	if err != nil || len(shapes["x"]) != 1 || shapes["x"][0] != 2 {
+		t.Errorf("input shapes %v, %v", shapes, err)
+	}
+	if requests != 1 {
+		t.Errorf("%d metadata requests for 4 batches, 1 expected", requests)
+	}
+
+	p.Command()
+	if _, err = p.FormatInput([]interface{}{[]interface{}{1.0, 2.0}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("%d metadata requests after the restart, 2 expected", requests)
+	}
+}
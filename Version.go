@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+//Timeout of the version command of the serving binary at startup
+const SERVING_VERSION_TIMEOUT = 10 * time.Second
+
+//Version and commit of the build, set with -ldflags "-X main.buildVersion=<version> -X main.buildCommit=<commit>"
+var (
+	buildVersion = "dev"
+	buildCommit  = "unknown"
+)
+
+//Output of the version command of the Tensorflow Serving binary, captured at startup. Empty if unknown, like for the
+//remote Tensorflow server and the Triton backend
+var servingVersion string
+
+//JSON response of the version endpoint
+type versionReport struct {
+	Version        string `json:"version"`
+	Commit         string `json:"commit"`
+	GoVersion      string `json:"go_version"`
+	Backend        string `json:"backend"`
+	ServingVersion string `json:"serving_version,omitempty"`
+}
+
+//Run the Tensorflow Serving binary with --version. Best effort, a failure is only logged
+func captureServingVersion(ctx context.Context) {
+	if predictor.Name() != BACKEND_TENSORFLOW {
+		return
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, SERVING_VERSION_TIMEOUT)
+	defer cancel()
+	out, err := exec.CommandContext(cmdCtx, tfServingBinary, "--version").CombinedOutput()
+	if err != nil {
+		logWarningf(ctx, "version of %s unknown: %s", tfServingBinary, err)
+		return
+	}
+	servingVersion = strings.TrimSpace(string(out))
+	logInfof(ctx, "serving binary version: %s", servingVersion)
+}
+
+//Return the build of the server, the Go runtime and the serving backend, as JSON
+func Version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(versionReport{
+		Version:        buildVersion,
+		Commit:         buildCommit,
+		GoVersion:      runtime.Version(),
+		Backend:        predictor.Name(),
+		ServingVersion: servingVersion,
+	})
+}
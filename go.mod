@@ -4,6 +4,11 @@ go 1.13
 
 require (
 	cloud.google.com/go/storage v1.6.0
+	github.com/aws/aws-sdk-go v1.34.34
 	github.com/gorilla/mux v1.7.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/vmihailenco/msgpack/v4 v4.3.11
 	google.golang.org/api v0.18.0
+	google.golang.org/grpc v1.27.1
+	google.golang.org/protobuf v1.23.0
 )
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Object of the in-memory store
+type memObject struct {
+	data            []byte
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+	generation      int64
+	//Listed with the object, none by default
+	checksums objectChecksums
+}
+
+//In-memory bucket, for testing the handlers without storage backend. The objects are kept by name
+type memStore struct {
+	scheme string
+	bucket string
+
+	mu         sync.Mutex
+	objects    map[string]*memObject
+	generation int64
+}
+
+func newMemStore(scheme string, bucket string) *memStore {
+	return &memStore{scheme: scheme, bucket: bucket, objects: map[string]*memObject{}}
+}
+
+//Write the object, like an upload which succeeded
+func (s *memStore) put(name string, data []byte, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.objects[name] = &memObject{data: append([]byte(nil), data...), contentType: contentType, generation: s.generation}
+}
+
+//Get the object, nil if missing
+func (s *memStore) get(name string) *memObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[name]
+}
+
+//Sorted names of the objects
+func (s *memStore) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []string
+	for name := range s.objects {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (s *memStore) Location(name string) string {
+	return s.scheme + "://" + s.bucket + "/" + name
+}
+
+func (s *memStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []objectInfo
+	for name, o := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			ret = append(ret, objectInfo{
+				Name:        name,
+				Size:        int64(len(o.data)),
+				ContentType: o.contentType,
+				Version:     strconv.FormatInt(o.generation, 10),
+				Checksums:   o.checksums,
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (s *memStore) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirs := map[string]bool{}
+	for name := range s.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], "/"); i >= 0 {
+			dirs[name[:len(prefix)+i+1]] = true
+		}
+	}
+	var ret []string
+	for dir := range dirs {
+		ret = append(ret, dir)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *memStore) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := s.get(name)
+	if o == nil || (generation != 0 && o.generation != generation) {
+		return nil, &notFoundError{fmt.Sprintf("object %s not found", s.Location(name))}
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (s *memStore) Upload(ctx context.Context, name string, contentType string, contentEncoding string, metadata map[string]string) io.WriteCloser {
+	return &memWriter{ctx: ctx, store: s, name: name, object: memObject{contentType: contentType, contentEncoding: contentEncoding, metadata: metadata}}
+}
+
+func (s *memStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, name)
+	return nil
+}
+
+//Upload of an object of the in-memory store, created on close unless the context is canceled
+type memWriter struct {
+	ctx    context.Context
+	store  *memStore
+	name   string
+	object memObject
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write on a closed upload")
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.generation++
+	o := w.object
+	o.data = w.buf.Bytes()
+	o.generation = w.store.generation
+	w.store.objects[w.name] = &o
+	return nil
+}
+
+//Provider of the in-memory stores, one per scheme and bucket, created on first use
+type memStores struct {
+	mu     sync.Mutex
+	stores map[string]*memStore
+}
+
+func newMemStores() *memStores {
+	return &memStores{stores: map[string]*memStore{}}
+}
+
+//Get the store of the bucket, for seeding it or checking its objects
+func (p *memStores) bucket(scheme string, bucket string) *memStore {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := scheme + "://" + bucket
+	s, ok := p.stores[key]
+	if !ok {
+		s = newMemStore(scheme, bucket)
+		p.stores[key] = s
+	}
+	return s
+}
+
+func (p *memStores) Store(ctx context.Context, location storeLocation, userProject string) (ObjectStore, error) {
+	return p.bucket(location.Scheme, location.Bucket), nil
+}
+
+//Serve the stores of the requests from the in-memory provider. The returned function restores the storage clients
+func useMemStores(p *memStores) func() {
+	previous := newStoreProvider
+	newStoreProvider = func() StoreProvider {
+		return p
+	}
+	return func() {
+		newStoreProvider = previous
+	}
+}